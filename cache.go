@@ -0,0 +1,110 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/qur/withmock/lib"
+)
+
+func cacheUsage() {
+	fmt.Fprintf(os.Stderr, "usage: %s cache <list|stat|clean|gc> [options]\n\n",
+		os.Args[0])
+	fmt.Fprintf(os.Stderr, "Manage the cache of generated packages.\n\n")
+	fmt.Fprintf(os.Stderr, "  list   list the cached packages, least recently used first\n")
+	fmt.Fprintf(os.Stderr, "  stat   summarise the contents of the cache\n")
+	fmt.Fprintf(os.Stderr, "  clean  remove everything from the cache\n")
+	fmt.Fprintf(os.Stderr, "  gc     remove packages to keep the cache within budget\n")
+}
+
+// doCache implements "withmock cache ..."
+func doCache(args []string) error {
+	if len(args) < 1 {
+		cacheUsage()
+		os.Exit(1)
+	}
+
+	cache := lib.NewCache("")
+
+	flags := flag.NewFlagSet("cache "+args[0], flag.ExitOnError)
+	stale := flags.Bool("stale", false, "only list stale packages (list), or also remove stale packages (gc)")
+	maxSize := flags.String("max-size", "1G", "maximum total size of the cache (gc)")
+	maxAge := flags.Duration("max-age", 30*24*time.Hour, "remove packages not used for this long (gc)")
+	flags.Parse(args[1:])
+
+	switch args[0] {
+	case "list":
+		entries, err := cache.Entries()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if *stale && !e.Stale {
+				continue
+			}
+			state := "ok"
+			switch {
+			case e.Broken:
+				state = "broken"
+			case e.Stale:
+				state = "stale"
+			}
+			fmt.Printf("%s %-6s %8s %s %s\n", e.Key[:12], state, size(e.Size),
+				e.Used.Format("2006-01-02 15:04"), e.Package)
+		}
+	case "stat":
+		entries, err := cache.Entries()
+		if err != nil {
+			return err
+		}
+		total, stale := int64(0), 0
+		for _, e := range entries {
+			total += e.Size
+			if e.Stale {
+				stale++
+			}
+		}
+		fmt.Printf("root:     %s\n", cache.Root())
+		fmt.Printf("packages: %d (%d stale)\n", len(entries), stale)
+		fmt.Printf("size:     %s\n", size(total))
+	case "clean":
+		return cache.Clean()
+	case "gc":
+		max, err := lib.ParseSize(*maxSize)
+		if err != nil {
+			return err
+		}
+		removed, err := cache.GC(max, *maxAge, *stale)
+		if err != nil {
+			return err
+		}
+		freed := int64(0)
+		for _, e := range removed {
+			freed += e.Size
+		}
+		fmt.Printf("removed %d packages, freeing %s\n", len(removed), size(freed))
+	default:
+		cacheUsage()
+		os.Exit(1)
+	}
+
+	return nil
+}
+
+func size(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -98,6 +98,277 @@ UsefulType instance:
  // And now, call the code under test
  importantFunction(ut)
 
+Generic functions are a little different, as each instantiation of the function
+is mocked separately.  So expectations are set using a function named after the
+generic function, with the type arguments supplied explicitly:
+
+ // We expect to see Map called to convert strings to ints
+ ext.EXPECT_Map[string, int]().Map([]string{"1"}, gomock.Any()).Return([]int{1})
+
+Methods of generic types work just like any other method, using the EXPECT()
+method of an instance of the type (e.g. &ext.List[string]{}).
+
+Exported package variables can be set using a method of the MOCK() object named
+after the variable, which puts the old value back when the test finishes:
+
+ // Use our own client for the rest of the test
+ ext.MOCK().SetDefaultClient(&http.Client{Transport: transport})
+
+The test is the one given to MOCK().Scope(t), or failing that the test of the
+controller (with a version of gomock that supports t.Cleanup).  Variables
+declared without a type have their type found by type checking the package.  A
+variable whose type can't be found, or can't be written in the file that
+declares it (e.g. an unexported type of another package), doesn't get a setter -
+the reason is given by a comment in the generated package file.  Variables are
+shared by all tests, so tests setting them shouldn't be run in parallel.
+
+As a mocked package still runs the real code, any state it keeps in package
+variables (caches, registries, sync.Once etc) carries over from one test to the
+next.  MOCK().Snapshot() saves the value of every package variable (exported or
+not), and MOCK().Restore() puts them back:
+
+ func init() {
+ 	ext.MOCK().Snapshot()
+ }
+
+ func TestSomething(t *testing.T) {
+ 	ext.MOCK().Restore()
+ 	...
+ }
+
+Values are copied all the way down when saved and restored, so changes made to
+maps, the elements of slices, or through pointers are undone too.  The exception
+is pointers to the types of other packages, which are shared rather than copied
+as they usually point at state belonging to the other package (e.g. time.UTC) -
+so changes made through them aren't undone, even for something like a *sync.Map
+kept by the package itself.  Locks (sync.Mutex, sync.RWMutex, sync.Once and
+sync.WaitGroup) aren't copied, they are left as their zero value.
+
+Scopes and Parallel Tests
+
+The state of a mocked package (what is mocked or spied on, and the controller)
+is shared by every test, and is safe to use from multiple goroutines.  A test
+can also have a scope of it's own, which starts as a copy of the current state
+and is thrown away when the test finishes:
+
+ func TestSomething(t *testing.T) {
+ 	t.Parallel()
+
+ 	ctrl := gomock.NewController(t)
+ 	ext.MOCK().Scope(t)
+ 	ext.MOCK().SetController(ctrl)
+ 	ext.MOCK().MockAll(true)
+ 	...
+ }
+
+The scope is used by the test, and by any goroutines that it starts (or that
+they start, and so on) - so tests with their own scopes can be run in parallel,
+and subtests can have scopes of their own (or share their parent's).  A
+goroutine is traced back to a test using the stack traces of the goroutines
+that started it, so it can't be traced once they have finished.  A goroutine
+that can't be traced back to a test with a scope uses the only scope if there is
+just one, and panics if there is more than one.  With testify, each scope has
+it's own mock.Mock, and with the fake backend it's own hooks.
+
+MOCK().CheckLeaks(t) can be used to make sure that a test doesn't leave the
+state modified, causing the test to fail if the state has been changed when it
+finishes.
+
+Instead of setting up each mocked package by hand, a test can use withmock.T(t),
+which gives the test a scope in every package it imports for mocking - and sets
+a new gomock controller, which is finished when the test does:
+
+ func TestSomething(t *testing.T) {
+ 	t.Parallel()
+
+ 	m := withmock.T(t)
+ 	ext.EXPECT().HandyFunction(1).Return(2)
+ 	store := mock_store.NewMockStore(m.Controller) // from mockgen
+ 	...
+ }
+
+withmock is defined by code added to the test package when running the tests,
+and so can't be used if the test package declares it's own withmock.  The
+packages that use gomock share the controller, which is only set (as the
+Controller field of the returned value) if there are any - and they must all
+use the same gomock.  Packages using testify or fakes just get a scope, so
+their expectations or hooks are set using MOCK() or FAKE() as usual.
+
+Spying
+
+Rather than mocking a function, we can spy on it - so that the real function is
+called, but each call is recorded.  Functions are named as for EnableMock, with
+methods named after their type (e.g. "UsefulType.HandyMethod"), and SpyAll
+spies on everything that hasn't had mocking enabled or disabled explicitly:
+
+ ext.MOCK().Spy("HandyFunction", "UsefulType.HandyMethod")
+
+ importantFunction(ut)
+
+ for _, call := range ext.MOCK().Calls("UsefulType.HandyMethod") {
+ 	t.Logf("%v.HandyMethod(%v) = %v", call.Recv, call.Args, call.Results)
+ }
+
+Each call records the receiver (for a method), the arguments (with any variadic
+arguments as a slice), the results, the value of any panic, and when the call
+was made and how long it took.  Calls are kept in the current scope (see Scopes
+and Parallel Tests above) until ClearCalls is called, so a test with a scope of
+it's own only sees the calls that it made.
+
+Recording and Replaying
+
+Instead of writing expectations by hand, the calls to mocked functions can be
+recorded while running the real code, and replayed in later runs:
+
+ ext.MOCK().MockAll(true)
+
+ // Run once against the real package, writing each call to the file
+ ext.MOCK().Record(t, "testdata/TestImportant.json")
+
+ // And then replay the recorded results
+ ext.MOCK().Replay(t, "testdata/TestImportant.json")
+
+The recording belongs to the current scope, and is written when the test
+finishes (and stops being used at the same time).  A call that panics is
+recorded with the panic's message, and panics with that message when it is
+replayed.  When replaying, a call that doesn't match the next recorded call
+(by name and arguments) is reported as an error and causes a panic, and any
+recorded calls that haven't been made when the test finishes are reported as
+errors.  The testdata directory of the package under test is made available
+when running under withmock, so recordings can be kept there - but the
+directory must already exist.
+
+Values are converted to JSON for the recording, with errors stored using their
+message.  Types that can't be handled like this need a codec of their own, set
+with SetCodec - which takes any value with the methods:
+
+ Encode(v interface{}) ([]byte, error)
+ Decode(data []byte, v interface{}) error
+
+Encode is given each argument and result, and must return JSON.  Decode is
+given a pointer to each result to be filled in.  Setting the codec to nil goes
+back to the default, and the codec of the current scope when Record or Replay is
+called is used for that recording.
+
+Choosing gomock
+
+The generated code uses the same gomock package as the test code, whether that
+is go.uber.org/mock/gomock, github.com/golang/mock/gomock or the original
+code.google.com/p/gomock/gomock.  The import path can also be set in the config
+file given with -c, either for a particular package or as the default:
+
+ mocks:
+   DEFAULT:
+     gomock: go.uber.org/mock/gomock
+
+With anything other than the original gomock, the generated code uses the newer
+controller API.  Failures are reported against the test code, the values given
+to Return, Do and DoAndReturn are checked against the type of the mocked
+function, and the controller is forgotten once the test has finished - so a
+controller created with gomock.NewController(t) doesn't need Finish to be
+called.
+
+Using testify instead
+
+Instead of gomock, the mocks for a package can use testify's mock package
+(github.com/stretchr/testify/mock), by setting the backend in the config file:
+
+ mocks:
+   example.com/some/external/package:
+     backend: testify
+
+There is then no controller or EXPECT(), instead the object returned by MOCK()
+embeds a *mock.Mock - and expectations are set on it using the name of the
+function (or the type and method, with the receiver as the first argument):
+
+ ext.MOCK().On("HandyFunction", "input").Return(true)
+ ext.MOCK().On("UsefulType.HandyMethod", ut).Return(true)
+
+ importantFunction(ut)
+
+ ext.MOCK().AssertExpectations(t)
+
+The mock lives as long as the package (or scope, see below), so MOCK().Reset()
+should be called at the start of each test to forget any earlier expectations
+and calls - unless the test has a scope of it's own.  Mocks of
+interfaces embed a mock.Mock of their own, so expectations are set on the mock
+object itself.  As MOCK().Calls is used for spying (see above), the calls
+recorded by testify are found using MOCK().Mock.Calls.
+
+Fakes
+
+The fake backend doesn't use a mocking library, instead each function and method
+gets a hook that can be set to a function of the same type:
+
+ mocks:
+   example.com/some/external/package:
+     backend: fake
+
+The hooks are set using methods, named after the function, of the object
+returned by FAKE() (for the functions of the package), or the FAKE() method of a
+value (for it's methods):
+
+ ext.FAKE().HandyFunction(func(s string) bool {
+ 	return s == "input"
+ })
+ ut.FAKE().HandyMethod(func() bool { return true })
+
+ importantFunction(ut)
+
+A hook that hasn't been set calls the real function or method (or panics, for a
+mock of an interface).  There is no controller, and the hooks are reset for each
+test automatically.  A test that calls MOCK().Scope(t) (or uses withmock.T(t))
+gets it's own hooks, which are forgotten when it finishes - and hooks set
+without a scope belong to the top level test that set them (along with it's
+subtests and the goroutines they start), and are forgotten as soon as another
+test uses the package.  Tests that set hooks in parallel need scopes, but a hook
+can be set while other goroutines are calling the function.  Methods with a
+value receiver share their hooks between all values of the type, and generic
+functions use FAKE_ followed by the name of the function (e.g.
+ext.FAKE_Map[string, int]().Map(f)).  The name FAKE can be changed using the
+FAKE setting in the config file.
+
+Unexported functions
+
+Only exported functions and methods are mocked by default.  Unexported ones can
+be mocked too, which allows the internal helpers of a package to be mocked while
+still running the exported code that calls them:
+
+ mocks:
+   example.com/some/external/package:
+     unexported: true
+
+As the recorders of unexported functions can't be used outside the package, the
+expectations are set using methods of the MOCK() object instead - named after
+EXPECT and the function, or EXPECT, the type and the method (with the receiver
+as the first argument):
+
+ ext.MOCK().MockAll(false)
+ ext.MOCK().EnableMock("dial")
+ ext.MOCK().EXPECT_dial("example.com:80").Return(nil)
+ ext.MOCK().EXPECT_Conn_send(conn, gomock.Any()).Return(nil)
+
+With the fake backend, MOCK().FAKE_dial(f) sets the hook instead.  Unexported
+generic functions (and the methods of generic types) are not mocked, and the
+original gomock (code.google.com/p/gomock) can't be used.
+
+Mocking the code under test
+
+The code under test normally only has it's imports changed, so one function
+can't be tested in isolation from another in the same package.  Adding a
+"// mock self" comment to one of the package's test files (or setting self in
+the config for the package) means that the code under test is mocked as well,
+with mocking disabled until a test enables it:
+
+ MOCK().SetController(ctrl)
+ MOCK().EnableMock("Count")
+ EXPECT().Count("a").Return(1, nil)
+
+ n, err := Total("a") // the real Total, calling the mocked Count
+
+The interface mocks in the _mocks_ package can still be used alongside the mocked
+code.
+
 Running the tests
 
 And now we just need to wrap our call to "go test", so we run:
@@ -106,5 +377,106 @@ And now we just need to wrap our call to "go test", so we run:
 
 and gomock and the Go testing framework will do the rest for us ... :D
 
+Modules
+
+If the current directory is inside a module, then withmock and mocktest will
+work with modules instead of GOPATH.  The generated packages are grouped into
+copies of the modules that own them, and the code under test is placed in a
+synthetic main module which uses replace directives to pick up those copies in
+place of the originals.  The go tool is then run with -mod=mod, so that it may
+tidy up the generated go.mod files as required.
+
+If a workspace (i.e. a go.work file) is in use, then a temporary workspace is
+created instead, which uses the copies of the modules in place of the
+originals.  This allows packages from other modules in the workspace to be
+mocked.  When run from the root of the workspace, mocktest will also expand
+"./..." to cover the packages of all of the modules in the workspace.
+
+Vendoring
+
+Imports are resolved in the same way as the go tool resolves them, so if the
+code under test uses a vendored copy of a package then that is the copy that
+will be mocked.  This works for both GOPATH vendor directories and modules
+using -mod=vendor.  Since the generated packages are written using the import
+path from the source, different vendored copies of the same package can't be
+used together.
+
+Overlays
+
+Both withmock and mocktest accept a -overlay option.  With this option, rather
+than copying (or linking) every package into the work area, the generated code
+is passed to the go tool using an overlay file (see "go help build").  The
+original package directories remain in use, so file paths reported by the
+compiler, coverage tools and debuggers refer to the real source.  Only the
+packages that have no original location (such as the interface mocks, and
+mocked copies of standard library packages) are written into the work area -
+along with packages from modules other than the main module (or workspace
+modules), as the go tool won't use an overlay for the module cache.
+
+Targets and Build Tags
+
+Both withmock and mocktest accept -goos and -goarch options, which select the
+target to generate code for.  The files included in each package are chosen
+for the target (following the go command's rules for file names and build
+constraints), and the target is passed on to the go command run inside the
+work area - so "mocktest -goos=linux -goarch=arm64" will build and run the tests
+for linux/arm64.
+
+Similarly, the -tags option sets custom build tags (e.g. "integration"), which
+are passed on to the go command run inside the work area.  Files that wouldn't
+be built for the target and tags (the current ones, unless these options are
+given) are ignored when looking for imports and generating mocks.
+
+Caching
+
+Generated packages are stored in a cache, so that they don't need to be
+generated again on the next run.  The cache is kept in ~/.withmock/cache by
+default, or the directory given by the WITHMOCK_CACHE_DIR environment variable.
+Entries are found using a hash of the package source and it's location, the
+mock configuration, the import path of the mocking library used (which, if
+gomock isn't configured, depends on which gomock is installed), the build
+target, the Go version and the withmock binary - so changing any of these will
+simply cause the package to be generated again.
+Entries also record the source of any other packages that were read to generate
+the code (e.g. for embedded interfaces), and an entry is replaced if any of them
+have changed, or if it can't be read.  Setting
+WITHMOCK_DISABLE_CACHE disables the cache entirely.
+
+The cache can be shared by withmock and mocktest processes running at the same
+time, and is managed using "withmock cache":
+
+ withmock cache list [-stale]   # list cached packages, least recently used first
+ withmock cache stat            # summarise the cache
+ withmock cache clean           # empty the cache
+ withmock cache gc [-max-size=1G] [-max-age=720h] [-stale]
+
+A cached package is stale if it's source has changed since it was generated,
+gc will remove stale packages if -stale is given - along with any packages that
+haven't been used within -max-age, and then the least recently used packages
+until the cache is no bigger than -max-size.  Entries that can't be read are
+listed as broken, and are always removed by gc.
+
+Static Mocks
+
+If tests can't be run under withmock, then the mocks can be generated ahead of
+time and committed alongside the code:
+
+ withmock gen example.com/some/external/package -o mock_package
+
+writes the mock version of the package into mock_package (which defaults to
+"mock_" followed by the last element of the import path), and mocks of it's
+interfaces into mock_package/mocks - just as withmock would provide them.  The
+mock package can then be imported in place of the original.  As there is no
+test code for withmock to look at, mocking must be enabled explicitly:
+
+ ext.MOCK().SetController(ctrl)
+ ext.MOCK().MockAll(true)
+
+The generated files are marked as generated code, and "withmock verify" (with
+the same arguments) regenerates the mocks and fails if the files on disk are out
+of date - which is useful as a check in CI.  Any configuration file given with
+-c, and the -goos, -goarch and -tags options, are used in the same way as when
+running a command.
+
 */
 package main
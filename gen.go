@@ -0,0 +1,94 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/qur/withmock/lib"
+)
+
+func genUsage(cmd string) {
+	fmt.Fprintf(os.Stderr, "usage: %s %s <package> [-o <dir>]\n\n",
+		os.Args[0], cmd)
+	if cmd == "verify" {
+		fmt.Fprintf(os.Stderr, "Check that the mocks written by \"%s gen\" "+
+			"are up to date.\n\n", os.Args[0])
+	} else {
+		fmt.Fprintf(os.Stderr, "Write a mock version of the package, and "+
+			"mocks of it's interfaces (in the %s sub-directory), into the "+
+			"given directory.\n\n", lib.StaticMocksDir)
+	}
+	fmt.Fprintf(os.Stderr, "options:\n\n")
+}
+
+// doGen implements "withmock gen ..." and "withmock verify ..."
+func doGen(cmd string, args []string) error {
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	out := flags.String("o", "", "output directory (default \"mock_<name>\")")
+	flags.Usage = func() {
+		genUsage(cmd)
+		flags.PrintDefaults()
+	}
+
+	// Allow the options to come before or after the package
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	pkg := flags.Arg(0)
+	flags.Parse(flags.Args()[1:])
+	if flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	impPath, err := lib.GetOutput("go", "list", pkg)
+	if err != nil {
+		return err
+	}
+
+	cfg := &lib.Config{}
+	if *cfgFile != "" {
+		cfg, err = lib.ReadConfig(*cfgFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	dir := *out
+	if dir == "" {
+		dir = "mock_" + path.Base(impPath)
+	}
+
+	files, err := lib.GenStatic(impPath, cfg.Mock(impPath))
+	if err != nil {
+		return err
+	}
+
+	if cmd == "gen" {
+		return lib.WriteGenerated(dir, files)
+	}
+
+	stale, err := lib.CheckGenerated(dir, files)
+	if err != nil {
+		return err
+	}
+
+	if len(stale) > 0 {
+		for _, name := range stale {
+			fmt.Fprintf(os.Stderr, "%s\n", filepath.Join(dir, name))
+		}
+		return fmt.Errorf("mocks of %s in %s are out of date, run \"%s gen\"",
+			impPath, dir, os.Args[0])
+	}
+
+	return nil
+}
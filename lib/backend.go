@@ -0,0 +1,234 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"fmt"
+	"io"
+)
+
+// testifyMock is the import path of the testify mock package.
+const testifyMock = "github.com/stretchr/testify/mock"
+
+// backend is the mocking library used by the generated code.  The backend
+// decides how a call to a mocked function is dispatched, and what the test code
+// uses to set expectations.
+type backend interface {
+	// importPath returns the import path of the library (or "" if there
+	// isn't one).
+	importPath() string
+
+	// addIfImports adds the imports used by the mocks of interfaces to used,
+	// given whether any mock types or methods were written, and whether
+	// writeExtState was used.
+	addIfImports(used map[string]string, types, methods, ext bool)
+
+	// addPkgImports adds the imports used by the code written by
+	// writePkgRecorder and writeTypeRecorder to used.
+	addPkgImports(used map[string]string) error
+
+	// writeImports writes the imports for a generated file, and writeUsed
+	// makes sure that they are used.
+	writeImports(out io.Writer)
+	writeUsed(out io.Writer)
+
+	// skipImport returns true if an import of impPath by the original code
+	// should be left out, as the generated code already imports it.
+	skipImport(impPath string) bool
+
+	// metaType returns the type returned by MOCK(), writeState writes any
+	// package variables needed, and writeMeta writes MOCK() and any methods of
+	// the meta type specific to the backend.
+	metaType() string
+	writeState(out io.Writer)
+	writeMeta(out io.Writer, MOCK string)
+
+	// writeScope writes the fields of the runtime state (a _scope) used by
+	// the backend, and writeNewScope sets them up in a new scope s - given the
+	// parent scope (which may be nil).
+	writeScope(out io.Writer)
+	writeNewScope(out io.Writer)
+
+	// writeExtState writes the package state of a _mocks_ package.
+	writeExtState(out io.Writer)
+
+	// writeMockType writes the declaration of the mock type for an interface.
+	writeMockType(out io.Writer, tname, params string)
+
+	// writeCall writes the body of the mock of fi (which has args
+	// parameters), dispatching the call to the library.
+	writeCall(out io.Writer, fi *funcInfo, args int)
+
+	// writeRecorder writes the method of recorder used to set expectations for
+	// fi, and writeExpect writes the function returning a recorder for a
+	// generic function.
+	writeRecorder(out io.Writer, fi *funcInfo, recorder string)
+	writeExpect(out io.Writer, fi *funcInfo, expect string)
+
+	// writeMetaRecorder writes the method of the meta type used to set
+	// expectations for fi, which isn't exported - so the test code can't use
+	// the recorder.
+	writeMetaRecorder(out io.Writer, fi *funcInfo, EXPECT, ObjEXPECT string)
+
+	// writePkgRecorder writes the recorder for the package functions, and
+	// writeTypeRecorder writes the recorder for the methods of base.
+	writePkgRecorder(out io.Writer, EXPECT string)
+	writeTypeRecorder(out io.Writer, base, rec, params, args, EXPECT string)
+}
+
+// newBackend returns the backend selected by cfg.
+func newBackend(cfg *MockConfig) (backend, error) {
+	switch cfg.Backend {
+	case "", "gomock":
+		path := cfg.Gomock
+		if path == "" {
+			path = defaultGomock()
+		}
+		if cfg.Unexported && path == legacyGomock {
+			// gomock can only find the type of an unexported method if we
+			// tell it, which the original gomock doesn't support.
+			return nil, fmt.Errorf("mocking unexported functions needs a newer gomock than %s", legacyGomock)
+		}
+		return gomockBackend{path}, nil
+	case "testify":
+		return testifyBackend{}, nil
+	case "fake":
+		return newFakeBackend(cfg.FAKE), nil
+	}
+
+	return nil, fmt.Errorf("unknown mock backend: %s", cfg.Backend)
+}
+
+// testifyBackend generates mocks that use testify's mock package.  There are
+// no recorders, instead expectations are set using the *mock.Mock returned by
+// MOCK() (or embedded in the mock of an interface).
+type testifyBackend struct{}
+
+func (b testifyBackend) importPath() string {
+	return testifyMock
+}
+
+func (b testifyBackend) addIfImports(used map[string]string, types, methods, ext bool) {
+	if types {
+		used["_mock"] = testifyMock
+	}
+}
+
+func (b testifyBackend) addPkgImports(used map[string]string) error {
+	return nil
+}
+
+func (b testifyBackend) writeImports(out io.Writer) {
+	// Use a name that won't clash with the package's own imports
+	fmt.Fprintf(out, "import _mock %q\n\n", testifyMock)
+}
+
+func (b testifyBackend) skipImport(impPath string) bool {
+	return false
+}
+
+func (b testifyBackend) writeUsed(out io.Writer) {
+	fmt.Fprintf(out, "\n// Make sure testify is used\n")
+	fmt.Fprintf(out, "var _ = _mock.Anything\n")
+}
+
+func (b testifyBackend) metaType() string {
+	return "struct{\n\t*_mock.Mock\n}"
+}
+
+func (b testifyBackend) writeState(out io.Writer) {
+}
+
+func (b testifyBackend) writeScope(out io.Writer) {
+	fmt.Fprintf(out, "\tmock *_mock.Mock\n")
+}
+
+func (b testifyBackend) writeNewScope(out io.Writer) {
+	// Expectations aren't inherited, a new scope starts with a new mock
+	fmt.Fprintf(out, "\ts.mock = &_mock.Mock{}\n")
+}
+
+func (b testifyBackend) writeMeta(out io.Writer, MOCK string) {
+	fmt.Fprintf(out, "func _currentMock() (mock *_mock.Mock) {\n")
+	fmt.Fprintf(out, "\t_read(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\tmock = s.mock\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "\treturn\n")
+	fmt.Fprintf(out, "}\n")
+
+	fmt.Fprintf(out, "func %s() *_meta {\n", MOCK)
+	fmt.Fprintf(out, "\treturn &_meta{_currentMock()}\n")
+	fmt.Fprintf(out, "}\n")
+
+	// The mock lives as long as the scope, so we need a way to throw away
+	// the expectations and calls of the previous test.
+	fmt.Fprintf(out, "func (m *_meta) Reset() {\n")
+	fmt.Fprintf(out, "\t_write(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\ts.mock = &_mock.Mock{}\n")
+	fmt.Fprintf(out, "\t\tm.Mock = s.mock\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "}\n")
+}
+
+func (b testifyBackend) writeExtState(out io.Writer) {
+}
+
+func (b testifyBackend) writeMockType(out io.Writer, tname, params string) {
+	fmt.Fprintf(out, "type Mock%s%s struct{\n", tname, params)
+	fmt.Fprintf(out, "\t_mock.Mock\n")
+	fmt.Fprintf(out, "}\n")
+}
+
+func (b testifyBackend) writeCall(out io.Writer, fi *funcInfo, args int) {
+	fi.writeGuard(out, args)
+	params := fi.writeCallArgs(out, args)
+	target, name := "_currentMock()", fi.name
+	switch {
+	case fi.realDisabled:
+		// Only mocks of interfaces have no real version, and they have their
+		// own mock.Mock.
+		target = "_m"
+	case fi.IsMethod():
+		// Methods are named after their type, and get the receiver as the
+		// first argument - so that expectations can be set for a particular
+		// value.
+		name = baseTypeName(fi.recv.expr) + "." + fi.name
+		if fi.varidic {
+			params = []string{"append([]interface{}{_m}, args...)"}
+		} else {
+			params = append([]string{"_m"}, params...)
+		}
+	}
+	fmt.Fprintf(out, "\t")
+	if len(fi.results) > 0 {
+		fmt.Fprintf(out, "ret := ")
+	}
+	fmt.Fprintf(out, "%s.MethodCalled(\"%s\"", target, name)
+	for _, param := range params {
+		fmt.Fprintf(out, ", %s", param)
+	}
+	if fi.varidic {
+		fmt.Fprintf(out, "...")
+	}
+	fmt.Fprintf(out, ")\n")
+	fi.writeResults(out, "ret.Get(%d)")
+}
+
+func (b testifyBackend) writeRecorder(out io.Writer, fi *funcInfo, recorder string) {
+}
+
+func (b testifyBackend) writeExpect(out io.Writer, fi *funcInfo, expect string) {
+}
+
+func (b testifyBackend) writeMetaRecorder(out io.Writer, fi *funcInfo, EXPECT, ObjEXPECT string) {
+	// Expectations are set by name, so unexported functions need nothing
+	// special.
+}
+
+func (b testifyBackend) writePkgRecorder(out io.Writer, EXPECT string) {
+}
+
+func (b testifyBackend) writeTypeRecorder(out io.Writer, base, rec, params, args, EXPECT string) {
+}
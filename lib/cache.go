@@ -5,10 +5,27 @@
 package lib
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Cache is a persistent store of generated packages, so that we don't have to
+// regenerate the same mock code every time.  Entries are content-addressed,
+// using a key derived from everything that goes into generating the code (see
+// cacheKey), so an entry never needs to be invalidated - changing the input
+// just means that a different entry is used.
 type Cache struct {
 	enabled bool
 	root string
@@ -25,7 +42,7 @@ func NewCache(tmpDir string) *Cache {
 		if home == "" {
 			enabled = false
 		}
-		filepath.Join(home, ".withmock", "cache")
+		root = filepath.Join(home, ".withmock", "cache")
 	}
 
 	return &Cache{
@@ -35,30 +52,693 @@ func NewCache(tmpDir string) *Cache {
 	}
 }
 
-func (c *Cache) Store(path string) error {
+// cacheInfo is stored alongside each cache entry.
+type cacheInfo struct {
+	Package    string
+	Source     string
+	SourceHash string
+	Created    time.Time
+	Imports    map[string]importMode
+
+	// Deps has the hashes of the source of the other packages that were read
+	// to generate the code (e.g. for embedded interfaces), keyed by directory.
+	Deps map[string]string
+}
+
+// Gen generates the code for the package name from the source in src into
+// dst.  If the cache already has the code then it is simply copied into dst,
+// otherwise gen is called to generate the code - and the result is added to
+// the cache.  The returned imports are those of the generated code.
+func (c *Cache) Gen(src, dst, name string, mock bool, cfg *MockConfig, gen func() (importSet, error)) (importSet, error) {
 	if !c.enabled {
+		return gen()
+	}
+
+	srcHash, err := hashSource(src)
+	if err != nil {
+		return nil, Cerr{"hashSource", err}
+	}
+
+	key, err := cacheKey(src, srcHash, name, mock, cfg)
+	if err != nil {
+		return nil, Cerr{"cacheKey", err}
+	}
+
+	imports, err := c.fetch(key, src, dst)
+	if err != nil {
+		return nil, Cerr{"c.fetch", err}
+	}
+
+	if imports != nil {
+		return imports, nil
+	}
+
+	imports, dirs, err := recordDeps(gen)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &cacheInfo{
+		Package: name,
+		Source: src,
+		SourceHash: srcHash,
+		Created: time.Now(),
+		Imports: make(map[string]importMode),
+		Deps: make(map[string]string),
+	}
+	for path, i := range imports {
+		info.Imports[path] = i.mode
+	}
+	for dir := range dirs {
+		if dir == src {
+			continue
+		}
+		hash, err := hashSource(dir)
+		if err != nil {
+			// We can't tell when this entry would be out of date
+			return imports, nil
+		}
+		info.Deps[dir] = hash
+	}
+
+	// The cache is only an optimisation, so failing to store the generated
+	// code isn't a reason to give up.
+	c.store(key, dst, info)
+
+	return imports, nil
+}
+
+func (c *Cache) entry(key string) string {
+	return filepath.Join(c.root, key[:2], key)
+}
+
+// lock takes a lock on the whole cache, shared for anything that reads or adds
+// entries and exclusive for anything that removes them (the returned function
+// releases the lock).  The lock is advisory, but that's enough for multiple
+// withmock processes sharing a cache.
+func (c *Cache) lock(exclusive bool) (func(), error) {
+	if err := os.MkdirAll(c.root, 0700); err != nil {
+		return nil, Cerr{"MkdirAll", err}
+	}
+
+	f, err := os.OpenFile(filepath.Join(c.root, ".lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, Cerr{"os.OpenFile", err}
+	}
+
+	if err := lockFile(f, exclusive); err != nil {
+		f.Close()
+		return nil, Cerr{"lockFile", err}
+	}
+
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// fetch copies the cached code for key into dst, and returns the imports.  If
+// there is no usable entry for key, then nil is returned - and an unusable
+// entry is removed, so that it can be replaced.
+func (c *Cache) fetch(key, src, dst string) (importSet, error) {
+	entry := c.entry(key)
+
+	if !exists(entry) {
+		return nil, nil
+	}
+
+	// Stop the entry being removed while we are using it
+	unlock, err := c.lock(false)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := readEntry(entry)
+	if err == nil {
+		err = info.check()
+	}
+	if err != nil {
+		unlock()
+		c.Remove(key)
+		return nil, nil
+	}
+	defer unlock()
+
+	if err := copyTree(filepath.Join(entry, "pkg"), dst); err != nil {
+		return nil, Cerr{"copyTree", err}
+	}
+
+	// Record the use, so that gc knows what has been used recently
+	now := time.Now()
+	os.Chtimes(filepath.Join(entry, "info.json"), now, now)
+
+	// The generated code doesn't have mocked (or replaced) imports, and they
+	// are all from src
+	imports := make(importSet)
+	for path, mode := range info.Imports {
+		if err := imports.Set(path, src, mode, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return imports, nil
+}
+
+// readEntry returns the information stored for the cache entry in dir.
+func readEntry(dir string) (*cacheInfo, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "info.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	info := &cacheInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "pkg")); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// check returns an error if the source of any dependency has changed since
+// the entry was created.
+func (info *cacheInfo) check() error {
+	for dir, hash := range info.Deps {
+		h, err := hashSource(dir)
+		if err != nil {
+			return err
+		}
+		if h != hash {
+			return fmt.Errorf("dependency changed: %s", dir)
+		}
+	}
+	return nil
+}
+
+// store adds the code in dir to the cache under key.  The entry is built in a
+// temporary directory, and then renamed into place - so that an entry is
+// never seen half written, and concurrent stores of the same entry are
+// harmless.
+func (c *Cache) store(key, dir string, info *cacheInfo) error {
+	entry := c.entry(key)
+
+	if exists(entry) {
+		// Someone else stored it first
 		return nil
 	}
 
-	// TODO: ...
+	// Stop clean or gc removing our temporary directory
+	unlock, err := c.lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.MkdirAll(filepath.Dir(entry), 0700); err != nil {
+		return Cerr{"MkdirAll", err}
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Dir(entry), ".tmp-")
+	if err != nil {
+		return Cerr{"TempDir", err}
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := copyTree(dir, filepath.Join(tmp, "pkg")); err != nil {
+		return Cerr{"copyTree", err}
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return Cerr{"json.MarshalIndent", err}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, "info.json"), data, 0600); err != nil {
+		return Cerr{"WriteFile", err}
+	}
+
+	if err := os.Rename(tmp, entry); err != nil && !exists(entry) {
+		return Cerr{"Rename", err}
+	}
 
 	return nil
 }
 
-func (c *Cache) Fetch(path string) (Package, error) {
-	if !c.enabled {
-		return nil, nil
+// CacheEntry describes an entry in the cache.
+type CacheEntry struct {
+	Key     string
+	Package string
+	Source  string
+	Size    int64
+	Created time.Time
+	Used    time.Time
+
+	// Stale is set if the source (or the source of a dependency) no longer
+	// matches the source used to generate the code (including the source
+	// having been removed).  Stale entries won't be used unless the source
+	// changes back.
+	Stale bool
+
+	// Broken is set if the entry can't be read, in which case only Key, Size
+	// and Used are set.  Broken entries are always stale, and will never be
+	// used.
+	Broken bool
+}
+
+// Root returns the directory that the cache is stored in.
+func (c *Cache) Root() string {
+	return c.root
+}
+
+// Entries returns details of all the entries in the cache, least recently
+// used first.
+func (c *Cache) Entries() ([]*CacheEntry, error) {
+	unlock, err := c.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	dirs, err := filepath.Glob(filepath.Join(c.root, "*", "*"))
+	if err != nil {
+		return nil, Cerr{"Glob", err}
+	}
+
+	entries := []*CacheEntry{}
+
+	for _, dir := range dirs {
+		key := filepath.Base(dir)
+
+		// Skip entries that store is still writing
+		if !isCacheKey(key) {
+			continue
+		}
+
+		entry := &CacheEntry{
+			Key: key,
+		}
+		entries = append(entries, entry)
+
+		// A broken entry still takes up space
+		entry.Size, _ = dirSize(dir)
+
+		fi, err := os.Stat(filepath.Join(dir, "info.json"))
+		if err != nil {
+			fi, err = os.Stat(dir)
+		}
+		if err == nil {
+			entry.Used = fi.ModTime()
+		}
+
+		info, err := readEntry(dir)
+		if err != nil {
+			entry.Broken = true
+			entry.Stale = true
+			continue
+		}
+
+		srcHash, err := hashSource(info.Source)
+
+		entry.Package = info.Package
+		entry.Source = info.Source
+		entry.Created = info.Created
+		entry.Stale = err != nil || srcHash != info.SourceHash || info.check() != nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Used.Before(entries[j].Used)
+	})
+
+	return entries, nil
+}
+
+// isCacheKey returns true if key is a valid cache key (the name of a cache
+// entry, rather than a temporary directory).
+func isCacheKey(key string) bool {
+	b, err := hex.DecodeString(key)
+	return err == nil && len(b) == sha256.Size
+}
+
+// Remove removes the entries with the given keys from the cache.
+func (c *Cache) Remove(keys ...string) error {
+	for _, key := range keys {
+		if !isCacheKey(key) {
+			return fmt.Errorf("invalid cache key: %s", key)
+		}
+	}
+
+	unlock, err := c.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, key := range keys {
+		if err := os.RemoveAll(c.entry(key)); err != nil {
+			return Cerr{"RemoveAll", err}
+		}
+	}
+
+	return nil
+}
+
+// Clean removes everything from the cache.
+func (c *Cache) Clean() error {
+	unlock, err := c.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	dirs, err := filepath.Glob(filepath.Join(c.root, "*"))
+	if err != nil {
+		return Cerr{"Glob", err}
+	}
+
+	for _, dir := range dirs {
+		if filepath.Base(dir) == ".lock" {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return Cerr{"RemoveAll", err}
+		}
+	}
+
+	return nil
+}
+
+// GC removes entries from the cache to keep it within budget.  Entries not used
+// for longer than maxAge are removed, and then the least recently used entries
+// are removed until the total size is no more than maxSize.  If stale is set,
+// then stale entries are removed too.  Broken entries are always removed.  A
+// zero maxAge or maxSize means no limit.  The removed entries are returned.
+func (c *Cache) GC(maxSize int64, maxAge time.Duration, stale bool) ([]*CacheEntry, error) {
+	entries, err := c.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	total := int64(0)
+	for _, entry := range entries {
+		total += entry.Size
+	}
+
+	removed := []*CacheEntry{}
+	keys := []string{}
+
+	for _, entry := range entries {
+		old := maxAge > 0 && time.Since(entry.Used) > maxAge
+		big := maxSize > 0 && total > maxSize
+		if old || big || entry.Broken || (stale && entry.Stale) {
+			removed = append(removed, entry)
+			keys = append(keys, entry.Key)
+			total -= entry.Size
+		}
+	}
+
+	if err := c.Remove(keys...); err != nil {
+		return nil, err
+	}
+
+	// Also tidy up after any writers that didn't finish
+	tmps, err := filepath.Glob(filepath.Join(c.root, "*", ".tmp-*"))
+	if err != nil {
+		return nil, Cerr{"Glob", err}
+	}
+	for _, tmp := range tmps {
+		if fi, err := os.Stat(tmp); err == nil && time.Since(fi.ModTime()) > time.Hour {
+			os.RemoveAll(tmp)
+		}
+	}
+
+	return removed, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	size := int64(0)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size, err
+}
+
+// ParseSize parses a size such as "512M" or "2G" into bytes.
+func ParseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+
+	return n * mult, nil
+}
+
+// copyTree copies the files in src into dst (creating it if required).  Only
+// the top level is copied (as a package is a single directory), and symlinks
+// are copied as symlinks.
+func copyTree(src, dst string) error {
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return err
+	}
+
+	infos, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		from := filepath.Join(src, info.Name())
+		to := filepath.Join(dst, info.Name())
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(from)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(target, to); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if err := copyFile(from, to); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// hashSource returns a hash of the files in the package directory dir.
+func hashSource(dir string) (string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
 	}
 
-	// TODO: ...
+	h := sha256.New()
+
+	// (ReadDir sorts by name, so the order is stable)
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return "", err
+		}
 
-	return nil, nil
+		fmt.Fprintf(h, "%s %d\n", info.Name(), info.Size())
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+var (
+	genDeps     map[string]bool
+	genDepsLock sync.Mutex
+)
+
+// recordDep notes that the source in dir has been read to generate code, if
+// recordDeps is running.
+func recordDep(dir string) {
+	genDepsLock.Lock()
+	defer genDepsLock.Unlock()
+
+	if genDeps != nil && dir != "" {
+		genDeps[dir] = true
+	}
+}
+
+// recordDeps calls gen, and also returns the directories passed to recordDep
+// while it was running.
+func recordDeps(gen func() (importSet, error)) (importSet, map[string]bool, error) {
+	genDepsLock.Lock()
+	genDeps = make(map[string]bool)
+	genDepsLock.Unlock()
+
+	imports, err := gen()
+
+	genDepsLock.Lock()
+	dirs := genDeps
+	genDeps = nil
+	genDepsLock.Unlock()
+
+	return imports, dirs, err
+}
+
+var (
+	goVersion   string
+	toolVersion string
+)
+
+// cacheKey returns the key for the generated code for the package name, with
+// source in src that has the hash srcHash.  Anything else that affects the
+// generated code (the configuration, the mocking library actually used, build
+// context, Go version and withmock itself) is included too.  The directory is
+// included, as the generated code links to the non-Go files in src.
+func cacheKey(src, srcHash, name string, mock bool, cfg *MockConfig) (string, error) {
+	if goVersion == "" {
+		v, err := GetOutput("go", "env", "GOVERSION")
+		if err != nil {
+			return "", Cerr{"GetOutput", err}
+		}
+		goVersion = v
+	}
+
+	if toolVersion == "" {
+		v, err := getToolVersion()
+		if err != nil {
+			return "", Cerr{"getToolVersion", err}
+		}
+		toolVersion = v
+	}
+
+	// Without configuration, the gomock used depends on what is installed -
+	// so it has to be resolved before it can be included.
+	b, err := newBackend(cfg)
+	if err != nil {
+		return "", Cerr{"newBackend", err}
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "withmock: %s\n", toolVersion)
+	fmt.Fprintf(h, "go: %s\n", goVersion)
+	fmt.Fprintf(h, "package: %s\n", name)
+	fmt.Fprintf(h, "dir: %s\n", src)
+	fmt.Fprintf(h, "source: %s\n", srcHash)
+	fmt.Fprintf(h, "mock: %v\n", mock)
+	fmt.Fprintf(h, "config: %#v\n", *cfg)
+	fmt.Fprintf(h, "library: %s\n", b.importPath())
+	fmt.Fprintf(h, "target: %s/%s cgo=%v tags=%v\n",
+		buildContext.GOOS, buildContext.GOARCH, buildContext.CgoEnabled,
+		buildContext.BuildTags)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// getToolVersion returns a string that identifies the version of withmock, so
+// that cache entries aren't shared between versions that might generate
+// different code.  withmock and mocktest report the same version if they are
+// built from the same code.
+func getToolVersion() (string, error) {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if v := bi.Main.Version; v != "" && v != "(devel)" {
+			return v, nil
+		}
+
+		rev, modified := "", true
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				rev = setting.Value
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+		if rev != "" && !modified {
+			return rev, nil
+		}
+	}
+
+	// We don't have a version number that we can trust to change when the
+	// code generation changes, so use the executable itself.
+	exe, err := os.Executable()
+	if err != nil {
+		return "", Cerr{"os.Executable", err}
+	}
+
+	f, err := os.Open(exe)
+	if err != nil {
+		return "", Cerr{"os.Open", err}
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", Cerr{"io.Copy", err}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 // ----------------------------------------------------------------------------
 // cachePackage
 // ----------------------------------------------------------------------------
 
+// cachePackage wraps a Package, so that generated code comes from the cache
+// when possible.
 type cachePackage struct {
+	Package
+	cache *Cache
+}
+
+// Package returns pkg wrapped so that it will use the cache.
+func (c *Cache) Package(pkg Package) Package {
+	if !c.enabled {
+		return pkg
+	}
+
+	return &cachePackage{
+		Package: pkg,
+		cache: c,
+	}
 }
 
+func (p *cachePackage) Gen(mock bool, cfg *MockConfig) (importSet, error) {
+	// Gen writes the code using the name, not the label
+	dst := filepath.Join(getTmpPath(p.cache.tmpDir), "src", p.Name())
+
+	return p.cache.Gen(p.Loc().src, dst, p.Name(), mock, cfg, func() (importSet, error) {
+		return p.Package.Gen(mock, cfg)
+	})
+}
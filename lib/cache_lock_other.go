@@ -0,0 +1,20 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !unix && !windows
+
+package lib
+
+import "os"
+
+// There is no file locking here, so the cache can't be safely shared between
+// processes that clean or gc it.
+
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+const lockfileExclusiveLock = 0x2
+
+// We lock the first byte of the file, which is enough as everyone locks the
+// same byte.
+
+func lockFile(f *os.File, exclusive bool) error {
+	flags := uintptr(0)
+	if exclusive {
+		flags = lockfileExclusiveLock
+	}
+
+	ol := &syscall.Overlapped{}
+	r, _, err := procLockFileEx.Call(f.Fd(), flags, 0, 1, 0, uintptr(unsafe.Pointer(ol)))
+	if r == 0 {
+		return err
+	}
+
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	ol := &syscall.Overlapped{}
+	r, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(ol)))
+	if r == 0 {
+		return err
+	}
+
+	return nil
+}
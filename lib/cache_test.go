@@ -0,0 +1,433 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testGen returns a generator for Cache.Gen that writes a file into dst,
+// imports dep and records that the source in deps was read - and a pointer to
+// the number of times that it has been called.
+func testGen(dst, dep string, deps ...string) (func() (importSet, error), *int) {
+	calls := 0
+	return func() (importSet, error) {
+		calls++
+		if err := os.MkdirAll(dst, 0700); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dst, "a.go"), []byte("package a\n"), 0600); err != nil {
+			return nil, err
+		}
+		for _, dir := range deps {
+			recordDep(dir)
+		}
+		imports := make(importSet)
+		imports.Set(dep, "", importNormal, "")
+		return imports, nil
+	}, &calls
+}
+
+func newTestCache(t *testing.T) *Cache {
+	return &Cache{
+		enabled: true,
+		root:    filepath.Join(t.TempDir(), "cache"),
+		tmpDir:  t.TempDir(),
+	}
+}
+
+func TestCacheGen(t *testing.T) {
+	c := newTestCache(t)
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	writeFile(t, filepath.Join(src, "a.go"), "package a\n")
+	cfg := &MockConfig{}
+
+	dst1 := filepath.Join(tmp, "dst1")
+	gen, calls := testGen(dst1, "example.com/dep")
+	if _, err := c.Gen(src, dst1, "a", true, cfg, gen); err != nil {
+		t.Fatalf("Gen failed: %s", err)
+	}
+	if *calls != 1 {
+		t.Fatalf("Expected 1 call to gen, got %d", *calls)
+	}
+
+	dst2 := filepath.Join(tmp, "dst2")
+	gen, calls = testGen(dst2, "example.com/dep")
+	imports, err := c.Gen(src, dst2, "a", true, cfg, gen)
+	if err != nil {
+		t.Fatalf("Gen failed: %s", err)
+	}
+	if *calls != 0 {
+		t.Errorf("Expected code from the cache, but gen was called")
+	}
+	if _, err := os.Stat(filepath.Join(dst2, "a.go")); err != nil {
+		t.Errorf("Cached code not copied: %s", err)
+	}
+
+	want := importSet{"example.com/dep": {mode: importNormal, dir: src}}
+	if !reflect.DeepEqual(imports, want) {
+		t.Errorf("Got imports %v, expected %v", imports, want)
+	}
+
+	// Anything that changes the key should miss
+	gen, calls = testGen(dst2, "example.com/dep")
+	if _, err := c.Gen(src, dst2, "a", false, cfg, gen); err != nil {
+		t.Fatalf("Gen failed: %s", err)
+	}
+	if *calls != 1 {
+		t.Errorf("Expected gen to be called after changing mock")
+	}
+
+	writeFile(t, filepath.Join(src, "a.go"), "package a\n\nvar A int\n")
+	gen, calls = testGen(dst2, "example.com/dep")
+	if _, err := c.Gen(src, dst2, "a", true, cfg, gen); err != nil {
+		t.Fatalf("Gen failed: %s", err)
+	}
+	if *calls != 1 {
+		t.Errorf("Expected gen to be called after changing source")
+	}
+}
+
+func TestCacheGenGomock(t *testing.T) {
+	c := newTestCache(t)
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	dst := filepath.Join(tmp, "dst")
+	writeFile(t, filepath.Join(src, "a.go"), "package a\n")
+	cfg := &MockConfig{}
+
+	// Pretend that a different gomock is installed for each run
+	defer func(path string) { defaultGomockPath = path }(defaultGomockPath)
+
+	for i, path := range []string{gomockPaths[0], gomockPaths[1], gomockPaths[1]} {
+		defaultGomockPath = path
+		gen, calls := testGen(dst, "example.com/dep")
+		if _, err := c.Gen(src, dst, "a", true, cfg, gen); err != nil {
+			t.Fatalf("Gen failed: %s", err)
+		}
+		want := 1
+		if i == 2 {
+			want = 0
+		}
+		if *calls != want {
+			t.Errorf("Run %d (%s): expected %d calls to gen, got %d", i, path,
+				want, *calls)
+		}
+	}
+}
+
+func TestCacheGenSourceDir(t *testing.T) {
+	c := newTestCache(t)
+	tmp := t.TempDir()
+	cfg := &MockConfig{}
+
+	// Identical code in two different places shouldn't share an entry, as
+	// the generated code links to files in the source directory.
+	for _, dir := range []string{"one", "two"} {
+		src := filepath.Join(tmp, dir, "src")
+		dst := filepath.Join(tmp, dir, "dst")
+		writeFile(t, filepath.Join(src, "a.go"), "package a\n")
+
+		gen, calls := testGen(dst, "example.com/dep")
+		if _, err := c.Gen(src, dst, "a", true, cfg, gen); err != nil {
+			t.Fatalf("Gen failed: %s", err)
+		}
+		if *calls != 1 {
+			t.Errorf("%s: expected 1 call to gen, got %d", dir, *calls)
+		}
+	}
+}
+
+func TestCacheGenDeps(t *testing.T) {
+	c := newTestCache(t)
+	tmp := t.TempDir()
+	src := filepath.Join(tmp, "src")
+	dep := filepath.Join(tmp, "dep")
+	dst := filepath.Join(tmp, "dst")
+	writeFile(t, filepath.Join(src, "a.go"), "package a\n")
+	writeFile(t, filepath.Join(dep, "dep.go"), "package dep\n")
+	cfg := &MockConfig{}
+
+	tests := []struct {
+		name   string
+		change func()
+		calls  int
+	}{
+		{"first", func() {}, 1},
+		{"unchanged", func() {}, 0},
+		{"changed", func() {
+			writeFile(t, filepath.Join(dep, "dep.go"), "package dep\n\ntype I interface{}\n")
+		}, 1},
+		{"replaced", func() {}, 0},
+	}
+
+	for _, test := range tests {
+		test.change()
+		gen, calls := testGen(dst, "example.com/dep", dep)
+		if _, err := c.Gen(src, dst, "a", true, cfg, gen); err != nil {
+			t.Fatalf("%s: Gen failed: %s", test.name, err)
+		}
+		if *calls != test.calls {
+			t.Errorf("%s: expected %d calls to gen, got %d", test.name, test.calls, *calls)
+		}
+	}
+}
+
+func TestCacheGenBrokenEntry(t *testing.T) {
+	tests := []struct {
+		name  string
+		spoil func(entry string) error
+	}{
+		{"bad info", func(entry string) error {
+			return ioutil.WriteFile(filepath.Join(entry, "info.json"), []byte("{"), 0600)
+		}},
+		{"no info", func(entry string) error {
+			return os.Remove(filepath.Join(entry, "info.json"))
+		}},
+		{"no code", func(entry string) error {
+			return os.RemoveAll(filepath.Join(entry, "pkg"))
+		}},
+	}
+
+	for _, test := range tests {
+		c := newTestCache(t)
+		tmp := t.TempDir()
+		src := filepath.Join(tmp, "src")
+		dst := filepath.Join(tmp, "dst")
+		writeFile(t, filepath.Join(src, "a.go"), "package a\n")
+		cfg := &MockConfig{}
+
+		gen, _ := testGen(dst, "example.com/dep")
+		if _, err := c.Gen(src, dst, "a", true, cfg, gen); err != nil {
+			t.Fatalf("%s: Gen failed: %s", test.name, err)
+		}
+
+		entries, err := filepath.Glob(filepath.Join(c.root, "*", "*"))
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("%s: expected one entry, got %v (%v)", test.name, entries, err)
+		}
+		if err := test.spoil(entries[0]); err != nil {
+			t.Fatal(err)
+		}
+
+		gen, calls := testGen(dst, "example.com/dep")
+		if _, err := c.Gen(src, dst, "a", true, cfg, gen); err != nil {
+			t.Errorf("%s: Gen failed: %s", test.name, err)
+			continue
+		}
+		if *calls != 1 {
+			t.Errorf("%s: expected gen to be called, got %d calls", test.name, *calls)
+		}
+		if _, err := readEntry(entries[0]); err != nil {
+			t.Errorf("%s: broken entry not replaced: %s", test.name, err)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		size int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"100", 100, true},
+		{"2K", 2 << 10, true},
+		{"512M", 512 << 20, true},
+		{"1G", 1 << 30, true},
+		{"", 0, false},
+		{"G", 0, false},
+		{"1.5G", 0, false},
+		{"12x", 0, false},
+		{"-1M", 0, false},
+		{"1T", 0, false},
+	}
+
+	for _, test := range tests {
+		size, err := ParseSize(test.s)
+		if test.ok && err != nil {
+			t.Errorf("ParseSize(%q) failed: %s", test.s, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("ParseSize(%q) returned %d, expected error", test.s, size)
+		} else if size != test.size {
+			t.Errorf("ParseSize(%q) returned %d, expected %d", test.s, size, test.size)
+		}
+	}
+}
+
+// addEntry adds an entry to the cache c with the key derived from n, holding
+// size bytes of code (plus the info), and last used at used.  The entry is stale if src has
+// been changed since.
+func addEntry(t *testing.T, c *Cache, n int, src string, size int, used time.Time) string {
+	t.Helper()
+
+	key := fmt.Sprintf("%064x", n)
+	entry := c.entry(key)
+
+	srcHash, err := hashSource(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, filepath.Join(entry, "pkg", "a.go"), strings.Repeat("x", size))
+
+	data, err := json.Marshal(&cacheInfo{Package: "a", Source: src, SourceHash: srcHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(entry, "info.json"), string(data))
+
+	if err := os.Chtimes(filepath.Join(entry, "info.json"), used, used); err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func entryKeys(entries []*CacheEntry) []string {
+	keys := []string{}
+	for _, e := range entries {
+		keys = append(keys, e.Key[63:])
+	}
+	return keys
+}
+
+func TestCacheEntries(t *testing.T) {
+	c := newTestCache(t)
+	src := filepath.Join(t.TempDir(), "src")
+	writeFile(t, filepath.Join(src, "a.go"), "package a\n")
+	now := time.Now()
+
+	addEntry(t, c, 1, src, 10, now.Add(-time.Hour))
+	addEntry(t, c, 2, src, 10, now.Add(-2*time.Hour))
+	broken := addEntry(t, c, 3, src, 10, now)
+	writeFile(t, filepath.Join(c.entry(broken), "info.json"), "{")
+
+	// An entry that is still being written isn't an entry yet
+	writeFile(t, filepath.Join(c.root, "00", ".tmp-123", "info.json"), "{}")
+
+	entries, err := c.Entries()
+	if err != nil {
+		t.Fatalf("Entries failed: %s", err)
+	}
+
+	if keys := entryKeys(entries); !reflect.DeepEqual(keys, []string{"2", "1", "3"}) {
+		t.Fatalf("Got entries %v, expected [2 1 3]", keys)
+	}
+	if entries[0].Package != "a" || entries[0].Size < 10 || entries[0].Stale || entries[0].Broken {
+		t.Errorf("Unexpected entry: %+v", entries[0])
+	}
+	if !entries[2].Broken || !entries[2].Stale {
+		t.Errorf("Expected broken entry: %+v", entries[2])
+	}
+
+	writeFile(t, filepath.Join(src, "a.go"), "package a\n\nvar A int\n")
+
+	entries, err = c.Entries()
+	if err != nil {
+		t.Fatalf("Entries failed: %s", err)
+	}
+	for _, e := range entries {
+		if !e.Stale {
+			t.Errorf("Expected stale entry: %+v", e)
+		}
+	}
+}
+
+func TestCacheGC(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		maxSize int64
+		maxAge  time.Duration
+		stale   bool
+		removed []string
+	}{
+		{"no limits", 0, 0, false, []string{}},
+		{"size", 2500, 0, false, []string{"4", "3"}},
+		{"size fits", 6000, 0, false, []string{}},
+		{"age", 0, 90 * time.Minute, false, []string{"4", "3"}},
+		{"age and size", 5, 150 * time.Minute, false, []string{"4", "3", "2", "1"}},
+		{"stale", 0, 0, true, []string{"3"}},
+	}
+
+	for _, test := range tests {
+		c := newTestCache(t)
+		tmp := t.TempDir()
+		src := filepath.Join(tmp, "src")
+		other := filepath.Join(tmp, "other")
+		writeFile(t, filepath.Join(src, "a.go"), "package a\n")
+		writeFile(t, filepath.Join(other, "a.go"), "package a\n")
+
+		// Each entry is a little over 1000 bytes
+		addEntry(t, c, 1, src, 1000, now)
+		addEntry(t, c, 2, src, 1000, now.Add(-time.Hour))
+		addEntry(t, c, 3, other, 1000, now.Add(-2*time.Hour))
+		addEntry(t, c, 4, src, 1000, now.Add(-3*time.Hour))
+
+		writeFile(t, filepath.Join(other, "a.go"), "package b\n")
+
+		removed, err := c.GC(test.maxSize, test.maxAge, test.stale)
+		if err != nil {
+			t.Fatalf("%s: GC failed: %s", test.name, err)
+		}
+		if keys := entryKeys(removed); !reflect.DeepEqual(keys, test.removed) {
+			t.Errorf("%s: removed %v, expected %v", test.name, keys, test.removed)
+		}
+
+		entries, err := c.Entries()
+		if err != nil {
+			t.Fatalf("%s: Entries failed: %s", test.name, err)
+		}
+		if len(entries)+len(removed) != 4 {
+			t.Errorf("%s: %d entries left after removing %d", test.name, len(entries), len(removed))
+		}
+	}
+}
+
+func TestCacheRemove(t *testing.T) {
+	c := newTestCache(t)
+	src := filepath.Join(t.TempDir(), "src")
+	writeFile(t, filepath.Join(src, "a.go"), "package a\n")
+
+	one := addEntry(t, c, 1, src, 10, time.Now())
+	two := addEntry(t, c, 2, src, 10, time.Now())
+
+	if err := c.Remove(one); err != nil {
+		t.Fatalf("Remove failed: %s", err)
+	}
+	if exists(c.entry(one)) || !exists(c.entry(two)) {
+		t.Errorf("Remove(%s) removed the wrong entries", one)
+	}
+
+	for _, key := range []string{"", ".tmp-123", "../" + two[3:], "zz" + two[2:]} {
+		if err := c.Remove(key); err == nil {
+			t.Errorf("Remove(%q) should have failed", key)
+		}
+	}
+	if !exists(c.entry(two)) {
+		t.Errorf("Entry removed by invalid key")
+	}
+}
@@ -41,17 +41,25 @@ type MockConfig struct {
 	// Local configuration
 	MockPrototypes   bool // Mock prototypes (i.e. functions without bodies)
 	IgnoreInits      bool // Don't call the original init functions
-	MatchOSArch      bool // only use files for GOOS & GOARCH
 	IgnoreNonGoFiles bool // Don't copy non-go files into the mocked package
 
 	// File based configuration
-	MOCK      string `yaml:"MOCK"`
-	EXPECT    string `yaml:"EXPECT"`
-	ObjEXPECT string `yaml:"obj.EXPECT"`
+	MOCK       string `yaml:"MOCK"`
+	EXPECT     string `yaml:"EXPECT"`
+	ObjEXPECT  string `yaml:"obj.EXPECT"`
+	Gomock     string `yaml:"gomock"`  // import path of gomock
+	Backend    string `yaml:"backend"` // gomock (the default), testify or fake
+	FAKE       string `yaml:"FAKE"`
+	Unexported bool   `yaml:"unexported"` // mock unexported functions too
+	Self       bool   `yaml:"self"`       // mock the code under test too
 }
 
 type Config struct {
 	Mocks map[string]*MockConfig
+
+	// gomock is the gomock import path found in the test code, which is used
+	// if the path isn't configured.
+	gomock string
 }
 
 func (c *Config) Mock(path string) *MockConfig {
@@ -59,6 +67,7 @@ func (c *Config) Mock(path string) *MockConfig {
 		MOCK:      "MOCK",
 		EXPECT:    "EXPECT",
 		ObjEXPECT: "EXPECT",
+		FAKE:      "FAKE",
 	}
 
 	dc, found := c.Mocks["DEFAULT"]
@@ -92,6 +101,32 @@ func (c *Config) Mock(path string) *MockConfig {
 		m.ObjEXPECT = dc.ObjEXPECT
 	}
 
+	switch {
+	case mc.Gomock != "":
+		m.Gomock = mc.Gomock
+	case dc.Gomock != "":
+		m.Gomock = dc.Gomock
+	default:
+		m.Gomock = c.gomock
+	}
+
+	switch {
+	case mc.FAKE != "":
+		m.FAKE = mc.FAKE
+	case dc.FAKE != "":
+		m.FAKE = dc.FAKE
+	}
+
+	switch {
+	case mc.Backend != "":
+		m.Backend = mc.Backend
+	case dc.Backend != "":
+		m.Backend = dc.Backend
+	}
+
+	m.Unexported = mc.Unexported || dc.Unexported
+	m.Self = mc.Self || dc.Self
+
 	return m
 }
 
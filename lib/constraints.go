@@ -5,73 +5,119 @@
 package lib
 
 import (
-	"go/build"
 	"go/ast"
+	"go/build"
+	"go/build/constraint"
+	"os"
 	"strings"
 )
 
 var (
-	goos = build.Default.GOOS
-	goarch = build.Default.GOARCH
+	// buildContext decides which files belong to a package, using the same
+	// rules as the go command.
+	buildContext = build.Default
+
+	// targetEnv and buildFlags hold the target and build tags, which are
+	// passed to every go command that we run (including the command run
+	// inside the context), so that they all agree about which files make up
+	// each package.
+	targetEnv  []string
+	buildFlags []string
 )
 
-func goodOSArchConstraints(file *ast.File) (ok bool) {
-	max := file.Package
+// SetTarget sets the GOOS and GOARCH to generate code for, an empty string
+// leaves the current value.
+func SetTarget(goos, goarch string) error {
+	if goos != "" {
+		targetEnv = append(targetEnv, "GOOS="+goos)
+		buildContext.GOOS = goos
+	}
 
-	for _, comment := range file.Comments {
-		if comment.Pos() >= max {
-			break
-		}
+	if goarch != "" {
+		targetEnv = append(targetEnv, "GOARCH="+goarch)
+		buildContext.GOARCH = goarch
+	}
 
-		if len(comment.List) == 0 {
-			continue
-		}
+	// The go command disables cgo by default when cross compiling, so ask it
+	// rather than trying to replicate the logic.
+	cgo, err := GetOutput("go", "env", "CGO_ENABLED")
+	if err != nil {
+		return Cerr{"GetOutput", err}
+	}
+	buildContext.CgoEnabled = cgo == "1"
 
-		line := comment.List[0].Text
-		line = strings.TrimLeft(line, "/")
-		line = strings.TrimSpace(line)
+	return nil
+}
+
+// SetBuildTags sets the custom build tags to use, given as a comma (or space)
+// separated list as for "go build -tags".  The tags are added to GOFLAGS for
+// every go command that we run.
+func SetBuildTags(tags string) error {
+	sep := ","
+	if !strings.Contains(tags, ",") {
+		sep = " "
+	}
 
-		if !strings.HasPrefix(line, "+build ") {
-			continue
+	buildContext.BuildTags = nil
+	for _, tag := range strings.Split(tags, sep) {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			buildContext.BuildTags = append(buildContext.BuildTags, tag)
 		}
+	}
 
-		// Loop over lines == AND
-		for _, cmt := range comment.List {
-			line := cmt.Text
-			line = strings.TrimLeft(line, "/")
-			line = strings.TrimSpace(line)[7:]
+	buildFlags = []string{"-tags=" + strings.Join(buildContext.BuildTags, ",")}
 
-			satisfied := false
+	return nil
+}
 
-			// Loop over groups == OR
-			for _, group := range strings.Split(line, " ") {
-				gSatisfied := true
+// goEnv returns the environment to run the go command with, which is the
+// current environment with the target and build tags applied.
+func goEnv() []string {
+	env := append(os.Environ(), targetEnv...)
+	if len(buildFlags) > 0 {
+		env = append(env, "GOFLAGS="+goFlags())
+	}
+	return env
+}
 
-				// Loop over constraints == AND
-				for _, constraint := range strings.Split(group, ",") {
-					if constraint == goos || constraint == goarch {
-						continue
-					}
+// goodFile returns true if the go command would include the file name from dir
+// when building for the current target.  Both the file name (e.g.
+// foo_linux_arm64.go) and any build constraints (either //go:build or the
+// older // +build lines) are considered.
+func goodFile(dir, name string) (bool, error) {
+	return buildContext.MatchFile(dir, name)
+}
 
-					if knownOS[constraint] || knownArch[constraint] {
-						gSatisfied = false
-					}
+// includeFile returns true if the file name from dir should be parsed, i.e.
+// if the go command would build it for the target.  Files for other targets
+// would otherwise add duplicate (or conflicting) declarations.
+func includeFile(dir, name string) bool {
+	good, err := goodFile(dir, name)
+	if err != nil {
+		// Leave it to the parser (or go command) to report the problem
+		return true
+	}
 
-					if constraint == "ignore" {
-						gSatisfied = false
-					}
-				}
+	return good
+}
 
-				if gSatisfied {
-					satisfied = true
-				}
-			}
+// buildConstraints returns the build constraint lines from the header of file
+// (i.e. before the package clause), so that they can be copied into the
+// generated code.
+func buildConstraints(file *ast.File) []string {
+	lines := []string{}
+
+	for _, cg := range file.Comments {
+		if cg.Pos() >= file.Package {
+			break
+		}
 
-			if !satisfied {
-				return false
+		for _, c := range cg.List {
+			if constraint.IsGoBuild(c.Text) || constraint.IsPlusBuild(c.Text) {
+				lines = append(lines, c.Text)
 			}
 		}
 	}
 
-	return true
+	return lines
 }
@@ -10,11 +10,12 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
 type Context struct {
-	goPath string
+	goPath string // empty when using modules
 	goRoot string
 
 	tmpPath  string
@@ -41,6 +42,9 @@ type Context struct {
 
 	cache *Cache
 	packages map[string]Package
+
+	modules *moduleSet // nil unless using modules
+	overlay *overlay   // nil unless using an overlay
 }
 
 type codeLoc struct {
@@ -69,6 +73,16 @@ func NewContext() (*Context, error) {
 		return nil, err
 	}
 
+	workFile, err := getWorkFile()
+	if err != nil {
+		return nil, err
+	}
+
+	mainModules, err := getMainModules(workFile)
+	if err != nil {
+		return nil, err
+	}
+
 	// Now we need to sort out some temporary directories to work with
 
 	tmpDir, err := ioutil.TempDir("", "withmock")
@@ -80,6 +94,25 @@ func NewContext() (*Context, error) {
 
 	cache := NewCache(tmpDir)
 
+	// When using modules we don't use GOPATH to find code, instead we use a
+	// set of modules (or a workspace) to wire the work area together.
+
+	var modules *moduleSet
+	if len(mainModules) > 0 {
+		goPath = ""
+		modules = newModuleSet(mainModules, workFile, filepath.Join(getTmpPath(tmpDir), "src"))
+	}
+
+	// create excludes already including gomock and testify, as we can't mock
+	// them.
+
+	excludes := map[string]bool{
+		testifyMock: true,
+	}
+	for _, path := range gomockPaths {
+		excludes[path] = true
+	}
+
 	// Build and return the context
 
 	return &Context{
@@ -97,8 +130,8 @@ func NewContext() (*Context, error) {
 		cfg:            &Config{},
 		cache:          cache,
 		packages:       make(map[string]Package),
-		// create excludes already including gomock, as we can't mock it.
-		excludes: map[string]bool{"code.google.com/p/gomock/gomock": true},
+		modules:        modules,
+		excludes:       excludes,
 	}, nil
 }
 
@@ -113,6 +146,17 @@ func (c *Context) DisableRewrite() {
 	c.doRewrite = false
 }
 
+// UseOverlay arranges for the generated code to be used via an overlay (i.e.
+// "go build -overlay"), instead of mirroring packages into the work area.  The
+// original package directories stay in use, so paths in the output refer to
+// the real code.  This must be called before any packages are added.
+func (c *Context) UseOverlay() {
+	c.overlay = newOverlay(filepath.Join(c.tmpDir, "overlay.json"))
+	if c.modules != nil {
+		c.modules.inPlace = true
+	}
+}
+
 func (c *Context) Close() error {
 	if c.removeTmp {
 		if err := os.RemoveAll(c.tmpDir); err != nil {
@@ -133,25 +177,150 @@ func (c *Context) LoadConfig(path string) (err error) {
 }
 
 func (c *Context) insideCommand(command string, args ...string) *exec.Cmd {
-	env := os.Environ()
+	env := goEnv()
 
-	// remove any current GOPATH from the environment
+	if c.modules != nil {
+		return c.insideModuleCommand(env, command, args...)
+	}
+
+	// remove any current GOPATH and GOFLAGS from the environment
 	for i := range env {
-		if strings.HasPrefix(env[i], "GOPATH=") {
+		if strings.HasPrefix(env[i], "GOPATH=") ||
+			strings.HasPrefix(env[i], "GOFLAGS=") {
 			env[i] = "__IGNORE="
 		}
 	}
 
+	// With an overlay the original code is used in place, so the work area
+	// only needs to provide the packages that don't exist anywhere else.
+	goPath := c.tmpPath
+	flags := []string{}
+	if c.overlay != nil {
+		goPath = c.goPath + string(filepath.ListSeparator) + c.tmpPath
+		flags = append(flags, "-overlay="+c.overlay.path)
+	}
+
 	// Setup the environment variables that we want
-	env = append(env, "GOPATH=" + c.tmpPath)
+	env = append(env, "GOPATH=" + goPath)
 	env = append(env, "ORIG_GOPATH=" + c.origPath)
+	env = append(env, "GOFLAGS=" + goFlags(flags...))
 
 	cmd := exec.Command(command, args...)
 	cmd.Env = env
 	return cmd
 }
 
+func (c *Context) insideModuleCommand(env []string, command string, args ...string) *exec.Cmd {
+	// remove any current GOFLAGS or GOWORK from the environment
+	for i := range env {
+		if strings.HasPrefix(env[i], "GOFLAGS=") ||
+			strings.HasPrefix(env[i], "GOWORK=") {
+			env[i] = "__IGNORE="
+		}
+	}
+
+	flags := c.modules.goFlags()
+	if c.overlay != nil {
+		flags = append(flags, "-overlay="+c.overlay.path)
+	}
+
+	// Setup the environment variables that we want
+	env = append(env, "GOFLAGS=" + goFlags(flags...))
+	env = append(env, "GOWORK=" + c.modules.goWork())
+
+	cmd := exec.Command(command, args...)
+	cmd.Env = env
+	c.modules.setupCommand(cmd)
+	return cmd
+}
+
+// goFlags returns the value to use for GOFLAGS inside the context, which is
+// the current value with the build flags and the given flags added (replacing
+// any existing setting of the same flags).
+func goFlags(flags ...string) string {
+	flags = append(append([]string{}, buildFlags...), flags...)
+
+	set := make(map[string]bool)
+	for _, flag := range flags {
+		set[strings.SplitN(flag, "=", 2)[0]] = true
+	}
+
+	result := []string{}
+	for _, flag := range strings.Fields(os.Getenv("GOFLAGS")) {
+		if !set[strings.SplitN(flag, "=", 2)[0]] {
+			result = append(result, flag)
+		}
+	}
+
+	return strings.Join(append(result, flags...), " ")
+}
+
+// writeOverlay fills in the overlay with all the packages we have generated,
+// and then writes it out for the go tool to use.
+func (c *Context) writeOverlay() error {
+	labels := make([]string, 0, len(c.packages))
+	for label := range c.packages {
+		labels = append(labels, label)
+	}
+
+	// The code under test needs to go first, so that it isn't replaced by a
+	// version generated because some other package imports it.
+	sort.Slice(labels, func(i, j int) bool {
+		ti, tj := getMark(labels[i]) == testMark, getMark(labels[j]) == testMark
+		if ti != tj {
+			return ti
+		}
+		return labels[i] < labels[j]
+	})
+
+	for _, label := range labels {
+		mark := getMark(label)
+		if mark == mockMark {
+			// Mocked stdlib packages only exist in the work area
+			continue
+		}
+
+		if inPlace, err := c.usedInPlace(c.packages[label].Name()); err != nil {
+			return err
+		} else if !inPlace {
+			continue
+		}
+
+		loc := c.packages[label].Loc()
+		if !exists(loc.dst) {
+			// Nothing was generated (e.g. the package was excluded)
+			continue
+		}
+
+		if err := c.overlay.addPackage(loc.src, loc.dst, mark == testMark); err != nil {
+			return Cerr{"overlay.addPackage", err}
+		}
+	}
+
+	return c.overlay.write()
+}
+
 func (c *Context) installPackages() error {
+	if c.overlay != nil {
+		if err := c.writeOverlay(); err != nil {
+			return Cerr{"writeOverlay", err}
+		}
+	}
+
+	if c.modules != nil {
+		// With modules there is no GOPATH to install into, we just need
+		// to wire the modules together.
+		if err := c.modules.write(); err != nil {
+			return Cerr{"modules.write", err}
+		}
+		return nil
+	}
+
+	if c.overlay != nil {
+		// The go tool will build what it needs using the overlay
+		return nil
+	}
+
 	for _, pkg := range c.packages {
 		if c.stdlibImports[pkg.Label()] {
 			// stdlib imports don't need installing
@@ -169,6 +338,15 @@ func (c *Context) installPackages() error {
 func (c *Context) Chdir(pkg string) error {
 	path := filepath.Join(c.tmpPath, "src", pkg)
 
+	if c.overlay != nil {
+		// The code is used in place
+		p, err := LookupImportPath(pkg)
+		if err != nil {
+			return err
+		}
+		path = p
+	}
+
 	if err := os.Chdir(path); err != nil {
 		return err
 	}
@@ -187,6 +365,7 @@ type importMode int
 type importCfg struct {
 	mode importMode
 	path string
+	dir  string // directory of the (first) importing package
 }
 type importSet map[string]importCfg
 
@@ -202,9 +381,13 @@ func (i importCfg) ShouldInstall() bool {
 	return i.mode != importNoInstall
 }
 
-func (s importSet) Set(path string, mode importMode, path2 string) error {
+func (s importSet) Set(path, dir string, mode importMode, path2 string) error {
 	i := s[path]
 
+	if i.dir == "" {
+		i.dir = dir
+	}
+
 	if mode != importNormal {
 		if i.mode != importNormal && i.mode != mode {
 			return fmt.Errorf("Cannot change mode from %s to %s", i.mode, mode)
@@ -249,6 +432,19 @@ func (c *Context) wantToProcess(mockAllowed bool, imports importSet) map[string]
 	return names
 }
 
+// pending returns the labels of the packages that haven't been processed yet,
+// in sorted order so that the packages are always generated in the same order.
+func (c *Context) pending() []string {
+	labels := []string{}
+	for label, done := range c.processed {
+		if !done {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+	return labels
+}
+
 func (c *Context) installImports(imports importSet) (map[string]string, error) {
 	// Start by updating processed to include anything in imports we haven't
 	// seen before, this also gives us the name rewrite map we need to return
@@ -265,11 +461,7 @@ func (c *Context) installImports(imports importSet) (map[string]string, error) {
 
 	for !complete {
 		complete = true
-		for label, done := range c.processed {
-			if done {
-				continue
-			}
-
+		for _, label := range c.pending() {
 			complete = false
 			c.processed[label] = true
 
@@ -284,12 +476,34 @@ func (c *Context) installImports(imports importSet) (map[string]string, error) {
 			if imports[name].IsReplace() {
 				// Install the requested package in place of the
 				// package that the code thinks it wants.
-				srcPath := imports[name].path
+				srcPath, err := vendoredImport(imports[name].path, imports[name].dir)
+				if err != nil {
+					return nil, Cerr{"vendoredImport", err}
+				}
 				pkgImports, err := ReplacePkg(c.goPath, c.tmpPath, srcPath, label)
 				if err != nil {
 					return nil, Cerr{"ReplacePkg", err}
 				}
 
+				if c.overlay != nil {
+					impPath, err := vendoredImport(label, imports[name].dir)
+					if err != nil {
+						return nil, Cerr{"vendoredImport", err}
+					}
+					dir, err := LookupImportPath(impPath)
+					if err != nil {
+						return nil, Cerr{"LookupImportPath", err}
+					}
+					dst := filepath.Join(c.tmpPath, "src", label)
+					if err := c.overlay.addPackage(dir, dst, false); err != nil {
+						return nil, Cerr{"overlay.addPackage", err}
+					}
+				}
+
+				if err := c.addModule(name, label); err != nil {
+					return nil, err
+				}
+
 				// Update imports from the package we just processed, but it
 				// can only add actual packages, not mocks
 				c.wantToProcess(false, pkgImports)
@@ -302,7 +516,11 @@ func (c *Context) installImports(imports importSet) (map[string]string, error) {
 				continue
 			}
 
-			pkg, err := c.getPkg(name, label)
+			if err := c.addModule(name, label); err != nil {
+				return nil, err
+			}
+
+			pkg, err := c.getPkg(name, label, imports[name].dir)
 			if err != nil {
 				return nil, Cerr{"context.getPkg", err}
 			}
@@ -316,16 +534,46 @@ func (c *Context) installImports(imports importSet) (map[string]string, error) {
 			if c.excludes[name] {
 				// this package has been specifically excluded from mocking, so
 				// we just link it, even if mocked is indicated.
-				if _, err := pkg.Link(); err != nil {
+				if inPlace, err := c.usedInPlace(name); err != nil {
+					return nil, err
+				} else if inPlace {
+					// or just use it in place, if we can
+					continue
+				}
+				pkgImports, err := pkg.Link()
+				if err != nil {
 					return nil, Cerr{"pkg.Link", err}
 				}
+				// We still need the packages that it imports (e.g. testify's
+				// mock package has dependencies, unlike gomock).  With modules
+				// the go tool finds the packages of other modules itself, but
+				// the rest of the module needs linking too.
+				if c.modules != nil {
+					pkgImports, err = sameModule(name, pkgImports)
+					if err != nil {
+						return nil, Cerr{"sameModule", err}
+					}
+					for p := range pkgImports {
+						c.excludes[p] = true
+					}
+				}
+				c.wantToProcess(false, pkgImports)
+				for p, i := range pkgImports {
+					if _, set := imports[p]; !set {
+						imports[p] = i
+					}
+				}
 				continue
 			}
 
 			if c.stdlibImports[name] {
 				// We already checked earlier for unmocked stdlib, so
 				// this is mocked stdlib
-				err := MockStandard(c.goRoot, c.tmpPath, name, cfg)
+				src := standardSource(c.goRoot, name)
+				dst := filepath.Join(c.tmpPath, "src", label)
+				_, err := c.cache.Gen(src, dst, name, true, cfg, func() (importSet, error) {
+					return nil, MockStandard(c.goRoot, c.tmpPath, name, cfg)
+				})
 				if err != nil {
 					return nil, Cerr{"MockStandard", err}
 				}
@@ -358,36 +606,72 @@ func (c *Context) installImports(imports importSet) (map[string]string, error) {
 	return names, nil
 }
 
-func (c *Context) getPkg(pkgName, label string) (Package, error) {
+func (c *Context) getPkg(pkgName, label, srcDir string) (Package, error) {
 	pkg, found := c.packages[label]
 	if found {
 		return pkg, nil
 	}
 
-	pkg, err := c.cache.Fetch(pkgName)
+	pkg, err := NewPackage(pkgName, label, srcDir, c.tmpDir, c.goPath)
 	if err != nil {
-		return nil, Cerr{"cache.Fetch", err}
+		return nil, Cerr{"NewPackage", err}
 	}
 
-	if pkg == nil {
-		pkg, err = NewPackage(pkgName, label, c.tmpDir, c.goPath)
-		if err != nil {
-			return nil, Cerr{"NewPackage", err}
-		}
-	}
+	// Use the cache to avoid generating code that we have generated before
+	pkg = c.cache.Package(pkg)
 
 	c.packages[label] = pkg
 
 	return pkg, nil
 }
 
+func (c *Context) addModule(name, label string) error {
+	if c.modules == nil {
+		return nil
+	}
+
+	if err := c.modules.add(name, label); err != nil {
+		return Cerr{"modules.add", err}
+	}
+
+	return nil
+}
+
+// usedInPlace returns true if the named package will be used from it's
+// original location (via the overlay), rather than from the work area.
+func (c *Context) usedInPlace(name string) (bool, error) {
+	if c.overlay == nil {
+		return false, nil
+	}
+
+	if c.modules == nil {
+		return true, nil
+	}
+
+	inPlace, err := c.modules.usedInPlace(name)
+	if err != nil {
+		return false, Cerr{"modules.usedInPlace", err}
+	}
+
+	return inPlace, nil
+}
+
 func (c *Context) LinkPackage(pkg string) error {
-	_, err := LinkPkg(c.goPath, c.tmpPath, pkg)
+	if inPlace, err := c.usedInPlace(pkg); err != nil || inPlace {
+		// The package can just be used in place
+		return err
+	}
+
+	if err := c.addModule(pkg, pkg); err != nil {
+		return err
+	}
+
+	_, err := LinkPkg(c.goPath, c.tmpPath, pkg, pkg)
 	return err
 }
 
 func (c *Context) AddPackage(pkgName string) (string, error) {
-	pkg, err := c.getPkg(pkgName, markImport(pkgName, testMark))
+	pkg, err := c.getPkg(pkgName, markImport(pkgName, testMark), "")
 	if err != nil {
 		return "", Cerr{"context.getPkg", err}
 	}
@@ -397,23 +681,44 @@ func (c *Context) AddPackage(pkgName string) (string, error) {
 		return "", Cerr{"pkg.GetImports", err}
 	}
 
+	// Unless configured otherwise, the mocks use the same gomock as the test
+	// code.
+	if c.cfg.gomock == "" {
+		c.cfg.gomock = detectGomock(imports)
+	}
+
 	importNames, err := c.installImports(imports)
 	if err != nil {
 		return "", Cerr{"installImports", err}
 	}
 
-	newName := pkg.Label()
-	c.importRewrites[newName] = pkgName
-	importNames[pkgName] = newName
+	// With an overlay the code under test keeps it's own name, as the
+	// overlay replaces the original files.
+	newName := pkgName
+	if c.overlay == nil {
+		newName = pkg.Label()
+		c.importRewrites[newName] = pkgName
+		importNames[pkgName] = newName
+	}
+
+	cfg := c.cfg.Mock(pkgName)
+
+	self, err := selfMocked(pkg.Loc().src, cfg)
+	if err != nil {
+		return "", Cerr{"selfMocked", err}
+	}
 
-	err = pkg.MockImports(importNames, c.cfg)
+	err = pkg.MockImports(importNames, self, c.cfg)
 	if err != nil {
 		return "", Cerr{"MockImports", err}
 	}
 
-	cfg := c.cfg.Mock(pkgName)
+	mocksPkg := pkgName + "/_mocks_"
+	if err := c.addModule(mocksPkg, mocksPkg); err != nil {
+		return "", err
+	}
 
-	err = MockInterfaces(c.tmpPath, pkgName, cfg)
+	err = MockInterfaces(c.tmpPath, pkgName, newName, self, cfg)
 	if err != nil {
 		return "", Cerr{"MockInterfaces", err}
 	}
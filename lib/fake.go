@@ -0,0 +1,277 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// fakeBackend generates fakes instead of mocks.  Each function and method gets
+// a hook in a fake type (returned by FAKE()), which is called instead of the
+// real version when it is set.  No mocking library is needed.
+type fakeBackend struct {
+	FAKE string
+
+	// fields records the hooks of each fake type, as the hooks are found one
+	// method at a time - but are all needed to write the type.
+	fields map[string][]string
+
+	// hooked records the functions with hooks in the fake types, as the types
+	// are written in the package file - which needs to import the packages
+	// used by the hooks.
+	hooked []*funcInfo
+}
+
+func newFakeBackend(FAKE string) *fakeBackend {
+	return &fakeBackend{
+		FAKE:   FAKE,
+		fields: make(map[string][]string),
+	}
+}
+
+func (b *fakeBackend) importPath() string {
+	return ""
+}
+
+func (b *fakeBackend) addIfImports(used map[string]string, types, methods, ext bool) {
+	if ext {
+		used["_sync"] = "sync"
+	}
+}
+
+func (b *fakeBackend) addPkgImports(used map[string]string) error {
+	for _, fi := range b.hooked {
+		if err := fi.usedImports(used); err != nil {
+			return Cerr{"fi.usedImports", err}
+		}
+	}
+	return nil
+}
+
+func (b *fakeBackend) writeImports(out io.Writer) {
+}
+
+func (b *fakeBackend) skipImport(impPath string) bool {
+	return false
+}
+
+func (b *fakeBackend) writeUsed(out io.Writer) {
+}
+
+func (b *fakeBackend) metaType() string {
+	return "struct{}"
+}
+
+func (b *fakeBackend) writeState(out io.Writer) {
+}
+
+func (b *fakeBackend) writeScope(out io.Writer) {
+	fmt.Fprintf(out, "\tfakes map[interface{}]interface{}\n")
+	fmt.Fprintf(out, "\tfakeTest int64\n")
+	fmt.Fprintf(out, "\tfakeTests map[int64]int64\n")
+}
+
+func (b *fakeBackend) writeNewScope(out io.Writer) {
+	// Fakes aren't inherited, a new scope starts with none set
+	fmt.Fprintf(out, "\ts.fakes = make(map[interface{}]interface{})\n")
+	fmt.Fprintf(out, "\ts.fakeTests = make(map[int64]int64)\n")
+}
+
+func (b *fakeBackend) writeMeta(out io.Writer, MOCK string) {
+	fmt.Fprintf(out, "func %s() *_meta {\n", MOCK)
+	fmt.Fprintf(out, "\treturn nil\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// Without a scope of their own, tests share the base scope - so the fakes
+	// set there belong to the (top level) test that set them, and are
+	// forgotten as soon as another test uses them.  Finding the test is
+	// expensive, so we remember the test of each goroutine that asks.
+	fmt.Fprintf(out, "func (s *_scope) checkFakes() {\n")
+	fmt.Fprintf(out, "\tif s != _base {\n")
+	fmt.Fprintf(out, "\t\treturn\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tid := _goid()\n")
+	fmt.Fprintf(out, "\ttest, found := s.fakeTests[id]\n")
+	fmt.Fprintf(out, "\tif !found {\n")
+	fmt.Fprintf(out, "\t\t_, test = _ancestors()\n")
+	fmt.Fprintf(out, "\t\ts.fakeTests[id] = test\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tif test == 0 || test == s.fakeTest {\n")
+	fmt.Fprintf(out, "\t\treturn\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\ts.fakes = make(map[interface{}]interface{})\n")
+	fmt.Fprintf(out, "\ts.fakeTest = test\n")
+	fmt.Fprintf(out, "\ts.fakeTests = map[int64]int64{id: test}\n")
+	fmt.Fprintf(out, "}\n\n")
+}
+
+func (b *fakeBackend) writeExtState(out io.Writer) {
+	// A _mocks_ package has no scopes, but its fakes are found by the mock -
+	// and each test makes its own mocks, so a single scope is enough.
+	fmt.Fprintf(out, "type _scope struct {\n")
+	b.writeScope(out)
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "var (\n")
+	fmt.Fprintf(out, "\t_ext = &_scope{fakes: make(map[interface{}]interface{})}\n")
+	fmt.Fprintf(out, "\t_extLock _sync.Mutex\n")
+	fmt.Fprintf(out, ")\n\n")
+
+	fmt.Fprintf(out, "func _write(f func(s *_scope)) {\n")
+	fmt.Fprintf(out, "\t_extLock.Lock()\n")
+	fmt.Fprintf(out, "\tdefer _extLock.Unlock()\n")
+	fmt.Fprintf(out, "\tf(_ext)\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// The fakes of the mocks belong to the mocks, so there is nothing to
+	// forget when the test changes
+	fmt.Fprintf(out, "func (s *_scope) checkFakes() {\n")
+	fmt.Fprintf(out, "}\n\n")
+}
+
+func (b *fakeBackend) writeMockType(out io.Writer, tname, params string) {
+	fmt.Fprintf(out, "type Mock%s%s struct{int}\n", tname, params)
+}
+
+func (b *fakeBackend) writeCall(out io.Writer, fi *funcInfo, args int) {
+	fmt.Fprintf(out, "\tif _f := _m._hooks()._%s; _f != nil {\n", fi.name)
+	fi.writeReturn(out, "\t\t", "_f("+fi.callArgs(args)+")")
+	fmt.Fprintf(out, "\t}\n")
+	if fi.realDisabled {
+		fmt.Fprintf(out, "\tpanic(\"no fake set for %s.%s\")\n",
+			baseTypeName(fi.recv.expr), fi.name)
+		return
+	}
+	fi.writeSpy(out, args)
+	fi.writeReturn(out, "\t", fi.realCall(args))
+}
+
+// hook returns the declaration of the hook for fi.
+func (b *fakeBackend) hook(fi *funcInfo) string {
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "%s func(", fi.name)
+	fi.writeParams(out)
+	fmt.Fprintf(out, ")")
+	if returns := fi.retTypes(); len(returns) > 0 {
+		fmt.Fprintf(out, " (%s)", strings.Join(returns, ", "))
+	}
+	return out.String()
+}
+
+func (b *fakeBackend) writeRecorder(out io.Writer, fi *funcInfo, recorder string) {
+	if i := strings.Index(recorder, "["); i >= 0 {
+		recorder = recorder[:i]
+	}
+	b.fields[recorder] = append(b.fields[recorder], b.hook(fi))
+	if !fi.IsGeneric() {
+		// The fake of a generic function is written by writeExpect
+		b.hooked = append(b.hooked, fi)
+	}
+}
+
+// writeFake writes the fake type rec, with the given hooks, and the _fake
+// method of recv used to find the fake for a particular receiver.  If recv
+// isn't a pointer then the receiver can't be used to find the fake (as it
+// may not be comparable), so all values of the type share a fake.
+//
+// The hooks are set using a method named after the function, and read using
+// _hooks, which both hold the state lock - so a hook can be set while another
+// goroutine is calling the function.
+func (b *fakeBackend) writeFake(out io.Writer, recv, rec, params, args string, hooks []string) {
+	fmt.Fprintf(out, "type %s%s struct {\n", rec, params)
+	for _, hook := range hooks {
+		fmt.Fprintf(out, "\t_%s\n", hook)
+	}
+	fmt.Fprintf(out, "}\n\n")
+
+	for _, hook := range hooks {
+		i := strings.Index(hook, " ")
+		fmt.Fprintf(out, "func (_r *%s%s) %s(_f %s) {\n", rec, args, hook[:i],
+			hook[i+1:])
+		fmt.Fprintf(out, "\t_write(func(s *_scope) {\n")
+		fmt.Fprintf(out, "\t\t_r._%s = _f\n", hook[:i])
+		fmt.Fprintf(out, "\t})\n")
+		fmt.Fprintf(out, "}\n\n")
+	}
+
+	fmt.Fprintf(out, "func (_m %s) _fakeIn(s *_scope) *%s%s {\n", recv, rec, args)
+	key := "_m"
+	if recv[0] != '*' {
+		key = fmt.Sprintf("(*%s%s)(nil)", rec, args)
+	}
+	fmt.Fprintf(out, "\ts.checkFakes()\n")
+	fmt.Fprintf(out, "\tf, _ := s.fakes[%s].(*%s%s)\n", key, rec, args)
+	fmt.Fprintf(out, "\tif f == nil {\n")
+	fmt.Fprintf(out, "\t\tf = &%s%s{}\n", rec, args)
+	fmt.Fprintf(out, "\t\ts.fakes[%s] = f\n", key)
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\treturn f\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func (_m %s) _fake() (f *%s%s) {\n", recv, rec, args)
+	fmt.Fprintf(out, "\t_write(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\tf = _m._fakeIn(s)\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "\treturn\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// A copy, so that the hooks can be read without holding the lock
+	fmt.Fprintf(out, "func (_m %s) _hooks() (h %s%s) {\n", recv, rec, args)
+	fmt.Fprintf(out, "\t_write(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\th = *_m._fakeIn(s)\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "\treturn\n")
+	fmt.Fprintf(out, "}\n\n")
+}
+
+// writeExpect writes the fake type for a generic function, along with the
+// function used to get the fake for a particular instantiation.
+func (b *fakeBackend) writeExpect(out io.Writer, fi *funcInfo, expect string) {
+	rec := "_" + fi.name + "_Rec"
+	mock := "_" + fi.name + "_mock" + fi.typeArgs
+	b.writeFake(out, mock, rec, fi.typeParams, fi.typeArgs,
+		[]string{b.hook(fi)})
+
+	fmt.Fprintf(out, "func %s_%s%s() *%s%s {\n", b.FAKE, fi.name,
+		fi.typeParams, rec, fi.typeArgs)
+	fmt.Fprintf(out, "\treturn %s{}._fake()\n", mock)
+	fmt.Fprintf(out, "}\n\n")
+}
+
+func (b *fakeBackend) writeMetaRecorder(out io.Writer, fi *funcInfo, EXPECT, ObjEXPECT string) {
+	hook := strings.TrimPrefix(b.hook(fi), fi.name+" ")
+	if !fi.IsMethod() {
+		fmt.Fprintf(out, "func (_ *_meta) %s_%s(_f %s) {\n", b.FAKE, fi.name,
+			hook)
+		fmt.Fprintf(out, "\t%s().%s(_f)\n", b.FAKE, fi.name)
+		fmt.Fprintf(out, "}\n")
+		return
+	}
+	fmt.Fprintf(out, "func (_ *_meta) %s_%s_%s(_m %s, _f %s) {\n", b.FAKE,
+		baseTypeName(fi.recv.expr), fi.name, fi.recv.expr, hook)
+	fmt.Fprintf(out, "\t_m.%s().%s(_f)\n", b.FAKE, fi.name)
+	fmt.Fprintf(out, "}\n")
+}
+
+func (b *fakeBackend) writePkgRecorder(out io.Writer, EXPECT string) {
+	b.writeFake(out, "*_packageMock", "_package_Rec", "", "",
+		b.fields["_package_Rec"])
+
+	fmt.Fprintf(out, "func %s() *_package_Rec {\n", b.FAKE)
+	fmt.Fprintf(out, "\treturn _pkgMock._fake()\n")
+	fmt.Fprintf(out, "}\n\n")
+}
+
+func (b *fakeBackend) writeTypeRecorder(out io.Writer, base, rec, params, args, EXPECT string) {
+	b.writeFake(out, base+args, rec, params, args, b.fields[rec])
+
+	fmt.Fprintf(out, "func (_m %s%s) %s() *%s%s {\n", base, args, b.FAKE,
+		rec, args)
+	fmt.Fprintf(out, "\treturn _m._fake()\n")
+	fmt.Fprintf(out, "}\n\n")
+}
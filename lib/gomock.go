@@ -0,0 +1,346 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// legacyGomock is the import path of the original gomock, which predates the
+// T field of the Controller and recording calls with their method type.
+const legacyGomock = "code.google.com/p/gomock/gomock"
+
+// gomockPaths lists the import paths that gomock is known by, in order of
+// preference.
+var gomockPaths = []string{
+	"go.uber.org/mock/gomock",
+	"github.com/golang/mock/gomock",
+	legacyGomock,
+}
+
+var defaultGomockPath = ""
+
+// defaultGomock returns the gomock import path to use when it hasn't been
+// configured, or detected from the test code.  This is the first of the known
+// paths that the go tool can find, or go.uber.org/mock/gomock if none of them
+// can be found.
+func defaultGomock() string {
+	if defaultGomockPath != "" {
+		return defaultGomockPath
+	}
+
+	defaultGomockPath = gomockPaths[0]
+	for _, path := range gomockPaths {
+		if _, err := LookupImportPath(path); err == nil {
+			defaultGomockPath = path
+			break
+		}
+	}
+
+	return defaultGomockPath
+}
+
+// detectGomock returns the known gomock import path found in imports, or the
+// empty string if there isn't one.
+func detectGomock(imports importSet) string {
+	for _, path := range gomockPaths {
+		if _, found := imports[path]; found {
+			return path
+		}
+	}
+	return ""
+}
+
+// gomockBackend generates mocks that use gomock, imported from path.
+type gomockBackend struct {
+	path string
+}
+
+func (b gomockBackend) importPath() string {
+	return b.path
+}
+
+func (b gomockBackend) legacy() bool {
+	return b.path == legacyGomock
+}
+
+func (b gomockBackend) addIfImports(used map[string]string, types, methods, ext bool) {
+	if methods || ext {
+		used["gomock"] = b.path
+	}
+	if methods && !b.legacy() {
+		used["_reflect"] = "reflect"
+	}
+	if ext {
+		used["_sync"] = "sync"
+	}
+}
+
+func (b gomockBackend) addPkgImports(used map[string]string) error {
+	return nil
+}
+
+func (b gomockBackend) writeImports(out io.Writer) {
+	fmt.Fprintf(out, "import %q\n\n", b.path)
+	if !b.legacy() {
+		// Use a name that won't clash with the package's own imports
+		fmt.Fprintf(out, "import _reflect \"reflect\"\n\n")
+	}
+}
+
+func (b gomockBackend) skipImport(impPath string) bool {
+	// The generated code already imports gomock
+	return impPath == b.path
+}
+
+func (b gomockBackend) writeUsed(out io.Writer) {
+	fmt.Fprintf(out, "\n// Make sure gomock is used\n")
+	fmt.Fprintf(out, "var _ = gomock.Any()\n")
+	if !b.legacy() {
+		fmt.Fprintf(out, "var _ = _reflect.TypeOf\n")
+	}
+}
+
+func (b gomockBackend) metaType() string {
+	return "struct{}"
+}
+
+func (b gomockBackend) writeState(out io.Writer) {
+}
+
+func (b gomockBackend) writeScope(out io.Writer) {
+	fmt.Fprintf(out, "\tctrl *gomock.Controller\n")
+}
+
+func (b gomockBackend) writeNewScope(out io.Writer) {
+	fmt.Fprintf(out, "\tif parent != nil {\n")
+	fmt.Fprintf(out, "\t\ts.ctrl = parent.ctrl\n")
+	fmt.Fprintf(out, "\t}\n")
+}
+
+func (b gomockBackend) writeMeta(out io.Writer, MOCK string) {
+	fmt.Fprintf(out, "func %s() *_meta {\n", MOCK)
+	fmt.Fprintf(out, "\treturn nil\n")
+	fmt.Fprintf(out, "}\n")
+
+	fmt.Fprintf(out, "func _ctrl() (ctrl *gomock.Controller) {\n")
+	fmt.Fprintf(out, "\t_read(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\tctrl = s.ctrl\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "\treturn\n")
+	fmt.Fprintf(out, "}\n")
+
+	fmt.Fprintf(out, "func (_ *_meta) SetController(controller *gomock.Controller) {\n")
+	if b.legacy() {
+		fmt.Fprintf(out, "\t_write(func(s *_scope) {\n")
+		fmt.Fprintf(out, "\t\ts.ctrl = controller\n")
+		fmt.Fprintf(out, "\t})\n")
+		fmt.Fprintf(out, "}\n")
+		return
+	}
+	fmt.Fprintf(out, "\tt, ok := controller.T.(interface{ Cleanup(func()) })\n")
+	fmt.Fprintf(out, "\tvar scope *_scope\n")
+	fmt.Fprintf(out, "\t_write(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\ts.ctrl = controller\n")
+	fmt.Fprintf(out, "\t\tif ok {\n")
+	fmt.Fprintf(out, "\t\t\ts.cleanup = t.Cleanup\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\tscope = s\n")
+	fmt.Fprintf(out, "\t})\n")
+	// Forget the controller when the test finishes, rather than let a later
+	// test use it by mistake.
+	fmt.Fprintf(out, "\tif ok {\n")
+	fmt.Fprintf(out, "\t\tt.Cleanup(func() {\n")
+	fmt.Fprintf(out, "\t\t\t_stateLock.Lock()\n")
+	fmt.Fprintf(out, "\t\t\tdefer _stateLock.Unlock()\n")
+	fmt.Fprintf(out, "\t\t\tif scope.ctrl == controller {\n")
+	fmt.Fprintf(out, "\t\t\t\tscope.ctrl = nil\n")
+	fmt.Fprintf(out, "\t\t\t\tscope.cleanup = nil\n")
+	fmt.Fprintf(out, "\t\t\t}\n")
+	fmt.Fprintf(out, "\t\t})\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "}\n")
+}
+
+func (b gomockBackend) writeExtState(out io.Writer) {
+	fmt.Fprintf(out, "var (\n")
+	fmt.Fprintf(out, "\t_controller *gomock.Controller\n")
+	fmt.Fprintf(out, "\t_ctrlLock _sync.Mutex\n")
+	fmt.Fprintf(out, ")\n\n")
+
+	fmt.Fprintf(out, "func _ctrl() *gomock.Controller {\n")
+	fmt.Fprintf(out, "\t_ctrlLock.Lock()\n")
+	fmt.Fprintf(out, "\tdefer _ctrlLock.Unlock()\n")
+	fmt.Fprintf(out, "\treturn _controller\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func SetController(controller *gomock.Controller) {\n")
+	fmt.Fprintf(out, "\t_ctrlLock.Lock()\n")
+	fmt.Fprintf(out, "\tdefer _ctrlLock.Unlock()\n")
+	fmt.Fprintf(out, "\t_controller = controller\n")
+	fmt.Fprintf(out, "}\n")
+}
+
+func (b gomockBackend) writeMockType(out io.Writer, tname, params string) {
+	fmt.Fprintf(out, "type Mock%s%s struct{int}\n", tname, params)
+}
+
+// writeCtrl writes the code to get the controller as _c, which fails clearly if
+// the test hasn't set one - rather than with a nil pointer dereference.
+func (b gomockBackend) writeCtrl(out io.Writer) {
+	fmt.Fprintf(out, "\t_c := _ctrl()\n")
+	fmt.Fprintf(out, "\tif _c == nil {\n")
+	fmt.Fprintf(out, "\t\tpanic(\"withmock: no gomock controller set, call SetController or withmock.T(t)\")\n")
+	fmt.Fprintf(out, "\t}\n")
+}
+
+func (b gomockBackend) writeCall(out io.Writer, fi *funcInfo, args int) {
+	fi.writeGuard(out, args)
+	params := fi.writeCallArgs(out, args)
+	b.writeCtrl(out)
+	if !b.legacy() {
+		fmt.Fprintf(out, "\t_c.T.Helper()\n")
+	}
+	fmt.Fprintf(out, "\t")
+	if len(fi.results) > 0 {
+		fmt.Fprintf(out, "ret := ")
+	}
+	fmt.Fprintf(out, "_c.Call(_m, \"%s\"", fi.name)
+	for _, param := range params {
+		fmt.Fprintf(out, ", %s", param)
+	}
+	if fi.varidic {
+		fmt.Fprintf(out, "...")
+	}
+	fmt.Fprintf(out, ")\n")
+	fi.writeResults(out, "ret[%d]")
+}
+
+// recorderParams returns the parameters of the recorder method for fi, which
+// accept any value (so that matchers can be used).
+func recorderParams(fi *funcInfo) string {
+	args := fi.countParams()
+	params := make([]string, args)
+	for i := range params {
+		params[i] = fmt.Sprintf("p%d", i)
+	}
+	if args == 0 {
+		return ""
+	}
+	if !fi.varidic {
+		return strings.Join(params, ", ") + " interface{}"
+	}
+	last := params[args-1] + " ...interface{}"
+	if args == 1 {
+		return last
+	}
+	return strings.Join(params[:args-1], ", ") + " interface{}, " + last
+}
+
+// recorderArgs returns the arguments to pass on the parameters given by
+// recorderParams.
+func recorderArgs(fi *funcInfo) string {
+	args := fi.countParams()
+	params := make([]string, args)
+	for i := range params {
+		params[i] = fmt.Sprintf("p%d", i)
+	}
+	if fi.varidic {
+		params[args-1] += "..."
+	}
+	return strings.Join(params, ", ")
+}
+
+func (b gomockBackend) writeRecorder(out io.Writer, fi *funcInfo, recorder string) {
+	args := fi.countParams()
+	fmt.Fprintf(out, "func (_mr *%s) %s(%s) *gomock.Call {\n", recorder, fi.name,
+		recorderParams(fi))
+	if fi.varidic {
+		fmt.Fprintf(out, "\targs := append([]interface{}{")
+		for i := 0; i < args-1; i++ {
+			if i > 0 {
+				fmt.Fprintf(out, ", ")
+			}
+			fmt.Fprintf(out, "p%d", i)
+		}
+		fmt.Fprintf(out, "}, p%d...)\n", args-1)
+	}
+	b.writeCtrl(out)
+	if b.legacy() {
+		fmt.Fprintf(out, "\treturn _c.RecordCall(_mr.mock, \"%s\"", fi.name)
+	} else {
+		// Passing the method type allows gomock to check the types used with
+		// Return, Do and DoAndReturn.
+		fmt.Fprintf(out, "\t_c.T.Helper()\n")
+		fmt.Fprintf(out, "\treturn _c.RecordCallWithMethodType(_mr.mock, "+
+			"\"%s\", _reflect.TypeOf(_mr.mock.%s)", fi.name, fi.name)
+	}
+	if fi.varidic {
+		fmt.Fprintf(out, ", args...")
+	} else {
+		for i := 0; i < args; i++ {
+			fmt.Fprintf(out, ", p%d", i)
+		}
+	}
+	fmt.Fprintf(out, ")\n")
+	fmt.Fprintf(out, "}\n")
+}
+
+func (b gomockBackend) writeMetaRecorder(out io.Writer, fi *funcInfo, EXPECT, ObjEXPECT string) {
+	params := recorderParams(fi)
+	if !fi.IsMethod() {
+		fmt.Fprintf(out, "func (_ *_meta) %s_%s(%s) *gomock.Call {\n", EXPECT,
+			fi.name, params)
+		fmt.Fprintf(out, "\treturn %s().%s(%s)\n", EXPECT, fi.name,
+			recorderArgs(fi))
+		fmt.Fprintf(out, "}\n")
+		return
+	}
+	// Methods get the receiver to set the expectation for
+	if params != "" {
+		params = ", " + params
+	}
+	fmt.Fprintf(out, "func (_ *_meta) %s_%s_%s(_m %s%s) *gomock.Call {\n",
+		EXPECT, baseTypeName(fi.recv.expr), fi.name, fi.recv.expr, params)
+	fmt.Fprintf(out, "\treturn _m.%s().%s(%s)\n", ObjEXPECT, fi.name,
+		recorderArgs(fi))
+	fmt.Fprintf(out, "}\n")
+}
+
+// writeExpect writes the recorder type for a generic function, along with the
+// function used to get a recorder for a particular instantiation (since a
+// method of the package recorder can't have type parameters).
+func (b gomockBackend) writeExpect(out io.Writer, fi *funcInfo, expect string) {
+	rec := "_" + fi.name + "_Rec"
+	fmt.Fprintf(out, "type %s%s struct {\n", rec, fi.typeParams)
+	fmt.Fprintf(out, "\tmock _%s_mock%s\n", fi.name, fi.typeArgs)
+	fmt.Fprintf(out, "}\n\n")
+	fmt.Fprintf(out, "func %s_%s%s() *%s%s {\n", expect, fi.name,
+		fi.typeParams, rec, fi.typeArgs)
+	fmt.Fprintf(out, "\treturn &%s%s{}\n", rec, fi.typeArgs)
+	fmt.Fprintf(out, "}\n\n")
+}
+
+func (b gomockBackend) writePkgRecorder(out io.Writer, EXPECT string) {
+	fmt.Fprintf(out, "type _package_Rec struct{\n")
+	fmt.Fprintf(out, "\tmock *_packageMock\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func %s() *_package_Rec {\n", EXPECT)
+	fmt.Fprintf(out, "\treturn &_package_Rec{_pkgMock}\n")
+	fmt.Fprintf(out, "}\n\n")
+}
+
+func (b gomockBackend) writeTypeRecorder(out io.Writer, base, rec, params, args, EXPECT string) {
+	fmt.Fprintf(out, "type %s%s struct {\n", rec, params)
+	fmt.Fprintf(out, "\tmock %s%s\n", base, args)
+	fmt.Fprintf(out, "}\n\n")
+	fmt.Fprintf(out, "func (_m %s%s) %s() *%s%s {\n", base, args,
+		EXPECT, rec, args)
+	fmt.Fprintf(out, "\treturn &%s%s{_m}\n", rec, args)
+	fmt.Fprintf(out, "}\n\n")
+}
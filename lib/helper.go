@@ -0,0 +1,180 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// testHelper gathers what is needed to write the withmock helper for one test
+// package.  The helper is only written if the test code uses withmock without
+// declaring it.
+type testHelper struct {
+	used     bool
+	declared bool
+	mocked   map[string]bool
+}
+
+// scanTestFile adds the test file src to the helper of its package in helpers.
+func scanTestFile(src string, helpers map[string]*testHelper) error {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, src, nil, parser.ParseComments)
+	if err != nil {
+		return err
+	}
+
+	h := helpers[file.Name.Name]
+	if h == nil {
+		h = &testHelper{mocked: make(map[string]bool)}
+		helpers[file.Name.Name] = h
+	}
+
+	for _, ident := range file.Unresolved {
+		if ident.Name == "withmock" {
+			h.used = true
+		}
+	}
+
+	if file.Scope.Lookup("withmock") != nil {
+		h.declared = true
+	}
+
+	for _, i := range file.Imports {
+		impPath := strings.Trim(i.Path.Value, "\"")
+		if (i.Name != nil && i.Name.Name == "withmock") ||
+			(i.Name == nil && path.Base(impPath) == "withmock") {
+			h.declared = true
+		}
+	}
+
+	mocked, err := GetMockedPackages(src)
+	if err != nil {
+		return err
+	}
+	for _, impPath := range mocked {
+		h.mocked[impPath] = true
+	}
+
+	return nil
+}
+
+// writeTestHelpers writes the helper for each test package in helpers into
+// dst.  The helper provides withmock.T(t), which gives the test its own scope
+// in each of the mocked packages - and a new gomock controller, shared by the
+// packages that use gomock, if needed.
+func writeTestHelpers(dst string, helpers map[string]*testHelper, change map[string]string, cfg *Config) error {
+	for name, h := range helpers {
+		if !h.used || h.declared || len(h.mocked) == 0 {
+			continue
+		}
+
+		filename := filepath.Join(dst, "withmock_"+name+"_helper_test.go")
+		if err := h.write(filename, name, change, cfg); err != nil {
+			return Cerr{"writeTestHelper", err}
+		}
+	}
+
+	return nil
+}
+
+func (h *testHelper) write(filename, name string, change map[string]string, cfg *Config) error {
+	mocked := make([]string, 0, len(h.mocked))
+	for impPath := range h.mocked {
+		mocked = append(mocked, impPath)
+	}
+	sort.Strings(mocked)
+
+	// The packages using gomock share a controller, which is given to the
+	// test - so they must all use the same gomock.
+	gomock := ""
+	for _, impPath := range mocked {
+		path := helperGomock(cfg, impPath)
+		if path == "" || path == gomock {
+			continue
+		}
+		if gomock != "" {
+			return fmt.Errorf("withmock.T can't set up a single controller "+
+				"for the mocked packages of %s, as they use both %s and %s",
+				name, gomock, path)
+		}
+		gomock = path
+	}
+
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	fmt.Fprintf(out, "package %s\n\n", name)
+
+	fmt.Fprintf(out, "import (\n")
+	fmt.Fprintf(out, "\t_testing \"testing\"\n")
+	if gomock != "" {
+		fmt.Fprintf(out, "\t_gomock %q\n", gomock)
+	}
+	for i, impPath := range mocked {
+		if newPath := change[impPath]; newPath != "" {
+			impPath = newPath
+		}
+		fmt.Fprintf(out, "\t_pkg%d %q\n", i, impPath)
+	}
+	fmt.Fprintf(out, ")\n\n")
+
+	fmt.Fprintf(out, "type _withmockHelper struct{}\n\n")
+	fmt.Fprintf(out, "var withmock _withmockHelper\n\n")
+
+	// What the test needs to use the mocks, beyond the functions of the
+	// mocked packages themselves
+	fmt.Fprintf(out, "type _withmockT struct {\n")
+	if gomock != "" {
+		fmt.Fprintf(out, "\tController *_gomock.Controller\n")
+	}
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func (_withmockHelper) T(t _testing.TB) *_withmockT {\n")
+	fmt.Fprintf(out, "\tt.Helper()\n")
+	fmt.Fprintf(out, "\tm := &_withmockT{}\n")
+	if gomock != "" {
+		fmt.Fprintf(out, "\tm.Controller = _gomock.NewController(t)\n")
+	}
+	for i, impPath := range mocked {
+		c := cfg.Mock(impPath)
+		fmt.Fprintf(out, "\t_pkg%d.%s().Scope(t)\n", i, c.MOCK)
+		if helperGomock(cfg, impPath) != "" {
+			fmt.Fprintf(out, "\t_pkg%d.%s().SetController(m.Controller)\n",
+				i, c.MOCK)
+		}
+	}
+	if gomock != "" {
+		// Older versions of gomock don't finish the controller themselves,
+		// and finishing twice is harmless for the newer versions.
+		fmt.Fprintf(out, "\tt.Cleanup(m.Controller.Finish)\n")
+	}
+	fmt.Fprintf(out, "\treturn m\n")
+	fmt.Fprintf(out, "}\n")
+
+	return nil
+}
+
+// helperGomock returns the gomock import path used by the mock of impPath, or
+// "" if it doesn't use gomock.
+func helperGomock(cfg *Config, impPath string) string {
+	c := cfg.Mock(impPath)
+	if c.Backend != "" && c.Backend != "gomock" {
+		return ""
+	}
+	if c.Gomock != "" {
+		return c.Gomock
+	}
+	return defaultGomock()
+}
@@ -0,0 +1,72 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHelperWrite(t *testing.T) {
+	cfg := &Config{
+		Mocks: map[string]*MockConfig{
+			"DEFAULT":        {Gomock: "go.uber.org/mock/gomock"},
+			"example.com/b":  {Backend: "testify"},
+			"example.com/c":  {Backend: "fake"},
+			"example.com/a2": {MOCK: "M"},
+		},
+	}
+	h := &testHelper{
+		used: true,
+		mocked: map[string]bool{
+			"example.com/a":  true,
+			"example.com/a2": true,
+			"example.com/b":  true,
+			"example.com/c":  true,
+		},
+	}
+
+	filename := filepath.Join(t.TempDir(), "helper_test.go")
+	if err := h.write(filename, "code", nil, cfg); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := string(data)
+
+	for _, want := range []string{
+		"_gomock \"go.uber.org/mock/gomock\"",
+		"Controller *_gomock.Controller",
+		"_pkg0.MOCK().Scope(t)",
+		"_pkg0.MOCK().SetController(m.Controller)",
+		"_pkg1.M().SetController(m.Controller)",
+		"_pkg2.MOCK().Scope(t)",
+		"_pkg3.MOCK().Scope(t)",
+	} {
+		if !strings.Contains(code, want) {
+			t.Errorf("Expected %q in:\n%s", want, code)
+		}
+	}
+	for _, unwanted := range []string{
+		"_pkg2.MOCK().SetController",
+		"_pkg3.MOCK().SetController",
+	} {
+		if strings.Contains(code, unwanted) {
+			t.Errorf("Unexpected %q in:\n%s", unwanted, code)
+		}
+	}
+
+	// A single controller can't be shared between different gomocks
+	cfg.Mocks["example.com/b"] = &MockConfig{Gomock: "github.com/golang/mock/gomock"}
+	err = h.write(filename, "code", nil, cfg)
+	if err == nil || !strings.Contains(err.Error(), "github.com/golang/mock/gomock") {
+		t.Errorf("Expected an error for two gomocks, got %v", err)
+	}
+}
@@ -5,19 +5,44 @@
 package lib
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"go/ast"
-	"os"
+	"io"
+	"sort"
 )
 
+// errConstraint is returned by getMethods for interfaces that can only be used
+// as type constraints, and so can't be mocked.
+var errConstraint = errors.New("interface is a type constraint")
+
 type external struct {
 	name, impPath, selector string
+	args                    []string
+}
+
+type local struct {
+	name string
+	args []string
 }
 
 type ifDetails struct {
 	methods   []*funcInfo
-	locals    []string
+	locals    []local
 	externals []external
+
+	// For generic interfaces, typeParams is the type parameter list as
+	// declared (e.g. "[T any]"), typeArgs is the list of names used to
+	// instantiate (e.g. "[T]"), and params is the list of names.
+	// paramScopes lists the packages used by the type parameter list.
+	typeParams, typeArgs string
+	params               []string
+	paramScopes          []string
+
+	// imports maps the packages used in the declaration of the interface to
+	// their import paths.
+	imports map[string]string
 }
 
 func (id *ifDetails) addMethod(name string, f *ast.FuncType) []string {
@@ -28,6 +53,7 @@ func (id *ifDetails) addMethod(name string, f *ast.FuncType) []string {
 	fi := &funcInfo{
 		name:         name,
 		realDisabled: true,
+		imports:      id.imports,
 	}
 	if f.Params != nil {
 		for _, param := range f.Params.List {
@@ -57,65 +83,161 @@ func (id *ifDetails) addMethod(name string, f *ast.FuncType) []string {
 	return m.getScopes()
 }
 
-func (id *ifDetails) addLocal(name string) {
-	id.locals = append(id.locals, name)
+func (id *ifDetails) addLocal(name string, args []string) {
+	id.locals = append(id.locals, local{
+		name: name,
+		args: args,
+	})
 }
 
-func (id *ifDetails) addExternal(name, importPath, selector string) {
+func (id *ifDetails) addExternal(name, importPath, selector string, args []string) {
 	id.externals = append(id.externals, external{
 		name:     name,
 		impPath:  importPath,
 		selector: selector,
+		args:     args,
 	})
 }
 
+// instantiate returns the methods with the type parameters of the interface
+// replaced by args, which use the packages in imports.
+func (id *ifDetails) instantiate(methods []*funcInfo, args []string, imports map[string]string) []*funcInfo {
+	if len(args) == 0 {
+		return methods
+	}
+
+	subst := make(map[string]string)
+	for i, param := range id.params {
+		if i < len(args) {
+			subst[param] = args[i]
+		}
+	}
+
+	instances := make([]*funcInfo, len(methods))
+	for i, method := range methods {
+		instances[i] = method.Subst(subst)
+		instances[i].imports = mergeImports(method.imports, imports)
+	}
+	return instances
+}
+
+// mergeImports returns the imports from both a and b.  A name that a and b
+// give different paths is mapped to "", as it can't be imported (see
+// addUsed).
+func mergeImports(a, b map[string]string) map[string]string {
+	imports := make(map[string]string)
+	for name, impPath := range a {
+		imports[name] = impPath
+	}
+	for name, impPath := range b {
+		if p, found := imports[name]; found && p != impPath {
+			impPath = ""
+		}
+		imports[name] = impPath
+	}
+	return imports
+}
+
+// addUsed adds the import of impPath as name to used, returning an error if
+// the name is already used for a different package.
+func addUsed(used map[string]string, name, impPath string) error {
+	if impPath == "" {
+		return fmt.Errorf("Package name %s refers to more than one package", name)
+	}
+	if p, found := used[name]; found && p != impPath {
+		return fmt.Errorf("Package name %s used for both %s and %s", name,
+			p, impPath)
+	}
+	used[name] = impPath
+	return nil
+}
+
 type ifInfo struct {
 	filename string
+	impPath  string
 	types    map[string]*ifDetails
-	imports  map[string]string
 	EXPECT   string
+	backend  backend
+
+	// constraints records the names of types that can only be embedded in
+	// interfaces used as type constraints (i.e. constraint interfaces, and
+	// anything that isn't an interface at all).
+	constraints map[string]bool
 }
 
-func (ii *ifInfo) addImport(name, path string) {
-	ii.imports[name] = path
+// typeNames returns the names of the interface types, in sorted order.
+func (ii *ifInfo) typeNames() []string {
+	names := make([]string, 0, len(ii.types))
+	for name := range ii.types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 func (ii *ifInfo) addType(t *ast.TypeSpec, imports map[string]string) {
 	i, ok := t.Type.(*ast.InterfaceType)
-	if !ok {
-		// Only care about interfaces
+	if !ok || isConstraint(i) {
+		// Only care about interfaces that can be used as values
+		ii.constraints[t.Name.String()] = true
 		return
 	}
 
-	id := &ifDetails{}
+	id := &ifDetails{
+		imports: make(map[string]string),
+	}
+
+	addImports := func(scopes []string) {
+		for _, scope := range scopes {
+			impPath, ok := imports[scope]
+			if !ok {
+				panic(fmt.Sprintf("Unkown package %s in interface %s",
+					scope, t.Name))
+			}
+			id.imports[scope] = impPath
+		}
+	}
+
+	if t.TypeParams != nil {
+		m := &mockGen{}
+		m.collectScopes()
+		id.typeParams, id.typeArgs = m.typeParamStrings(t.TypeParams)
+		for _, f := range t.TypeParams.List {
+			for _, name := range f.Names {
+				id.params = append(id.params, name.Name)
+			}
+		}
+		id.paramScopes = m.getScopes()
+		addImports(id.paramScopes)
+	}
 
 	for _, f := range i.Methods.List {
-		switch v := f.Type.(type) {
+		typ, args := f.Type, []string(nil)
+
+		// Embedded generic interfaces need to be instantiated with the
+		// type arguments given
+		switch v := typ.(type) {
+		case *ast.IndexExpr:
+			typ = v.X
+			args = typeArgs(addImports, v.Index)
+		case *ast.IndexListExpr:
+			typ = v.X
+			args = typeArgs(addImports, v.Indices...)
+		}
+
+		switch v := typ.(type) {
 		case *ast.FuncType:
-			scopes := id.addMethod(f.Names[0].Name, v)
-			for _, scope := range scopes {
-				impPath, ok := imports[scope]
-				if !ok {
-					panic(fmt.Sprintf("Unkown package %s in interface %s",
-						scope, t.Name))
-				}
-				ii.addImport(scope, impPath)
-			}
+			addImports(id.addMethod(f.Names[0].Name, v))
 		case *ast.Ident:
-			id.addLocal(v.String())
+			id.addLocal(v.String(), args)
 		case *ast.SelectorExpr:
 			p, ok := v.X.(*ast.Ident)
 			if !ok {
 				panic(fmt.Sprintf("Don't know how to handle selector of non"+
 					" Ident value: %T", v.X))
 			}
-			impPath, ok := imports[p.String()]
-			if !ok {
-				panic(fmt.Sprintf("Unkown package %s in interface %s",
-					p, t.Name))
-			}
-			ii.addImport(p.String(), impPath)
-			id.addExternal(p.String(), impPath, v.Sel.String())
+			addImports([]string{p.String()})
+			id.addExternal(p.String(), id.imports[p.String()], v.Sel.String(), args)
 		default:
 			panic(fmt.Sprintf("Don't expect %T in interface", f.Type))
 		}
@@ -124,13 +246,46 @@ func (ii *ifInfo) addType(t *ast.TypeSpec, imports map[string]string) {
 	ii.types[t.Name.String()] = id
 }
 
+// typeArgs returns the type arguments given by exprs, passing the packages
+// that they use to addImports.
+func typeArgs(addImports func([]string), exprs ...ast.Expr) []string {
+	m := &mockGen{}
+	m.collectScopes()
+
+	args := make([]string, len(exprs))
+	for i, expr := range exprs {
+		args[i] = m.exprString(expr)
+	}
+
+	addImports(m.getScopes())
+
+	return args
+}
+
+// isConstraint returns true if the interface includes type set elements (e.g.
+// "~int | ~uint"), and so can only be used as a type constraint.
+func isConstraint(i *ast.InterfaceType) bool {
+	for _, f := range i.Methods.List {
+		switch v := f.Type.(type) {
+		case *ast.Ident:
+			if v.Name == "comparable" {
+				return true
+			}
+		case *ast.FuncType, *ast.SelectorExpr, *ast.IndexExpr, *ast.IndexListExpr:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
 type Interfaces map[string]*ifInfo
 
 func newIfInfo(filename string) *ifInfo {
 	return &ifInfo{
-		filename: filename,
-		types:    make(map[string]*ifDetails),
-		imports:  make(map[string]string),
+		filename:    filename,
+		types:       make(map[string]*ifDetails),
+		constraints: make(map[string]bool),
 	}
 }
 
@@ -139,11 +294,24 @@ func (i Interfaces) getMethods(name string, tname string) ([]*funcInfo, error) {
 
 	methods := []*funcInfo{}
 
-	t := info.types[tname]
+	if info.constraints[tname] || !isLocalExpr(tname) {
+		// embedding a constraint, or a builtin type other than error
+		return nil, errConstraint
+	}
+
+	t, ok := info.types[tname]
+	if !ok {
+		return nil, fmt.Errorf("Unknown type %s in package %s", tname, name)
+	}
 
 	methods = append(methods, t.methods...)
 
-	for _, n := range t.locals {
+	for _, l := range t.locals {
+		n := l.name
+		// any is just an alias for interface{}, so adds nothing
+		if n == "any" {
+			continue
+		}
 		// Special case for error, which is a builtin interface type
 		if n == "error" {
 			methods = append(methods, &funcInfo{
@@ -154,14 +322,13 @@ func (i Interfaces) getMethods(name string, tname string) ([]*funcInfo, error) {
 			})
 			continue
 		}
-		if _, ok := info.types[n]; !ok {
-			return nil, fmt.Errorf("Unknown type %s in package %s", n, name)
-		}
 		m, err := i.getMethods(name, n)
-		if err != nil {
+		if err == errConstraint {
+			return nil, err
+		} else if err != nil {
 			return nil, Cerr{"i.getMethods", err}
 		}
-		methods = append(methods, m...)
+		methods = append(methods, info.types[n].instantiate(m, l.args, t.imports)...)
 	}
 
 	for _, e := range t.externals {
@@ -174,121 +341,175 @@ func (i Interfaces) getMethods(name string, tname string) ([]*funcInfo, error) {
 		}
 
 		m, err := i.getMethods(e.name, e.selector)
-		if err != nil {
+		if err == errConstraint {
+			return nil, err
+		} else if err != nil {
 			return nil, Cerr{"i.getMethods", err}
 		}
-		for _, method := range m {
-			methods = append(methods, method.AddScope(e.name))
+		ext := i[e.name].types[e.selector]
+		scoped := make([]*funcInfo, len(m))
+		for j, method := range m {
+			scoped[j] = method.AddScope(e.name, ext.params...)
+			scoped[j].imports = mergeImports(method.imports,
+				map[string]string{e.name: e.impPath})
 		}
+		methods = append(methods, ext.instantiate(scoped, e.args, t.imports)...)
 	}
 
 	return methods, nil
 }
 
-func (i Interfaces) genInterface(name string) error {
-	info := i[name]
-
-	out, err := os.Create(info.filename)
-	if err != nil {
-		return Cerr{"os.Create", err}
+// usedImports adds the imports used by the mock of the interface t, with the
+// given methods, to used.
+func usedImports(used map[string]string, t *ifDetails, methods []*funcInfo) error {
+	for _, scope := range t.paramScopes {
+		if err := addUsed(used, scope, t.imports[scope]); err != nil {
+			return err
+		}
 	}
-	defer out.Close()
 
-	fmt.Fprintf(out, "package %s\n\n", name)
-	fmt.Fprintf(out, "import (\n")
-	for name, impPath := range info.imports {
-		fmt.Fprintf(out, "\t%s \"%s\"\n", name, impPath)
+	for _, m := range methods {
+		if err := m.usedImports(used); err != nil {
+			return Cerr{"m.usedImports", err}
+		}
 	}
-	fmt.Fprintf(out, "\tgomock \"code.google.com/p/gomock/gomock\"\n")
-	fmt.Fprintf(out, ")\n\n")
-	for tname := range info.types {
-		fmt.Fprintf(out, "type Mock%s struct{int}\n", tname)
-		fmt.Fprintf(out, "type _mock_%s_rec struct{\n", tname)
-		fmt.Fprintf(out, "\tmock *Mock%s\n", tname)
-		fmt.Fprintf(out, "}\n\n")
 
-		// Make sure that our mock satisifies the interface
-		fmt.Fprintf(out, "var _ %s = &Mock%s{}\n", tname, tname)
+	return nil
+}
 
-		fmt.Fprintf(out, "func (_ *_meta) New%s() *Mock%s {\n", tname, tname)
-		fmt.Fprintf(out, "\treturn &Mock%s{}\n", tname)
-		fmt.Fprintf(out, "}\n")
-		fmt.Fprintf(out, "func (_m *Mock%s) %s() *_mock_%s_rec {\n",
-			tname, info.EXPECT, tname)
-		fmt.Fprintf(out, "\treturn &_mock_%s_rec{_m}\n", tname)
-		fmt.Fprintf(out, "}\n\n")
+func (i Interfaces) genInterface(name string) error {
+	info := i[name]
+
+	out := &bytes.Buffer{}
 
+	used := make(map[string]string)
+	types, hasMethods := false, false
+
+	for _, tname := range info.typeNames() {
+		t := info.types[tname]
 		methods, err := i.getMethods(name, tname)
-		if err != nil {
+		if err == errConstraint {
+			continue
+		} else if err != nil {
 			return Cerr{"getMethods", err}
 		}
 
-		for _, m := range methods {
-			m.recv.expr = "*Mock" + tname
-			m.writeMock(out)
-			m.writeRecorder(out, "_mock_"+tname+"_rec")
+		if err := usedImports(used, t, methods); err != nil {
+			return Cerr{"usedImports", err}
 		}
-	}
+		types, hasMethods = true, hasMethods || len(methods) > 0
 
-	return nil
-}
+		writeMockType(out, info.backend, tname, tname, t)
 
-func (i Interfaces) genExtInterface(name string, extPkg string) error {
-	info := i[name]
+		if t.typeParams == "" {
+			// (a method can't have type parameters, so we can't provide New
+			// for generic interfaces)
+			fmt.Fprintf(out, "func (_ *_meta) New%s() *Mock%s {\n", tname, tname)
+			fmt.Fprintf(out, "\treturn &Mock%s{}\n", tname)
+			fmt.Fprintf(out, "}\n\n")
+		}
 
-	out, err := os.Create(info.filename)
-	if err != nil {
-		return err
+		writeMockMethods(out, info.backend, tname, t, methods, info.EXPECT)
 	}
-	defer out.Close()
 
-	fmt.Fprintf(out, "package %s\n\n", name)
-	fmt.Fprintf(out, "import (\n")
-	fmt.Fprintf(out, "\t. \"%s\"\n", extPkg)
-	for name, impPath := range info.imports {
-		fmt.Fprintf(out, "\t%s \"%s\"\n", name, impPath)
-	}
-	fmt.Fprintf(out, "\tgomock \"code.google.com/p/gomock/gomock\"\n")
-	fmt.Fprintf(out, ")\n\n")
+	info.backend.addIfImports(used, types, hasMethods, false)
 
-	fmt.Fprintf(out, "var (\n")
-	fmt.Fprintf(out, "\t_ctrl *gomock.Controller\n")
-	fmt.Fprintf(out, ")\n\n")
+	return writeGenerated(info.filename, name, out.Bytes(), used)
+}
 
-	fmt.Fprintf(out, "func SetController(controller *gomock.Controller) {\n")
-	fmt.Fprintf(out, "\t_ctrl = controller\n")
-	fmt.Fprintf(out, "}\n")
+// genExtInterface writes mocks of the interfaces of the package extPkg.  The
+// interfaces are accessed using a dot import, unless scope is set - in which
+// case the package is imported as scope.
+func (i Interfaces) genExtInterface(name, extPkg, scope string) error {
+	info := i[name]
 
-	for tname := range info.types {
-		fmt.Fprintf(out, "type Mock%s struct{int}\n", tname)
-		fmt.Fprintf(out, "type _mock_%s_rec struct{\n", tname)
-		fmt.Fprintf(out, "\tmock *Mock%s\n", tname)
-		fmt.Fprintf(out, "}\n\n")
+	out := &bytes.Buffer{}
 
-		// Make sure that our mock satisifies the interface
-		fmt.Fprintf(out, "var _ %s = &Mock%s{}\n", tname, tname)
+	info.backend.writeExtState(out)
 
-		fmt.Fprintf(out, "func New%s() *Mock%s {\n", tname, tname)
-		fmt.Fprintf(out, "\treturn &Mock%s{}\n", tname)
-		fmt.Fprintf(out, "}\n")
-		fmt.Fprintf(out, "func (_m *Mock%s) %s() *_mock_%s_rec {\n",
-			tname, info.EXPECT, tname)
-		fmt.Fprintf(out, "\treturn &_mock_%s_rec{_m}\n", tname)
-		fmt.Fprintf(out, "}\n\n")
+	dot := []string{}
+
+	used := make(map[string]string)
+	types, hasMethods := false, false
 
+	for _, tname := range info.typeNames() {
+		t := info.types[tname]
 		methods, err := i.getMethods(name, tname)
-		if err != nil {
+		if err == errConstraint {
+			continue
+		} else if err != nil {
 			return err
 		}
 
-		for _, m := range methods {
-			m.recv.expr = "*Mock" + tname
-			m.writeMock(out)
-			m.writeRecorder(out, "_mock_"+tname+"_rec")
+		iface := tname
+		if scope == "" {
+			// The interfaces are accessed from the package under test via a
+			// dot import, which we need once we have used one.
+			dot = []string{extPkg}
+		} else {
+			iface = scope + "." + tname
+			for j, m := range methods {
+				methods[j] = m.AddScope(scope, t.params...)
+				methods[j].imports = mergeImports(m.imports,
+					map[string]string{scope: extPkg})
+			}
+			if err := addUsed(used, scope, extPkg); err != nil {
+				return err
+			}
+		}
+
+		if err := usedImports(used, t, methods); err != nil {
+			return Cerr{"usedImports", err}
 		}
+		types, hasMethods = true, hasMethods || len(methods) > 0
+
+		writeMockType(out, info.backend, tname, iface, t)
+
+		fmt.Fprintf(out, "func New%s%s() *Mock%s%s {\n", tname, t.typeParams,
+			tname, t.typeArgs)
+		fmt.Fprintf(out, "\treturn &Mock%s%s{}\n", tname, t.typeArgs)
+		fmt.Fprintf(out, "}\n\n")
+
+		writeMockMethods(out, info.backend, tname, t, methods, info.EXPECT)
 	}
 
-	return nil
+	info.backend.addIfImports(used, types, hasMethods, true)
+
+	return writeGenerated(info.filename, name, out.Bytes(), used, dot...)
+}
+
+// writeMockType writes out the declaration of the mock type for the interface
+// tname (which is referred to as iface).
+func writeMockType(out io.Writer, b backend, tname, iface string, t *ifDetails) {
+	params, args := t.typeParams, t.typeArgs
+
+	b.writeMockType(out, tname, params)
+
+	// Make sure that our mock satisifies the interface
+	if params == "" {
+		fmt.Fprintf(out, "var _ %s = &Mock%s{}\n\n", iface, tname)
+	} else {
+		fmt.Fprintf(out, "func _%s() {\n", params)
+		fmt.Fprintf(out, "\tvar _ %s%s = &Mock%s%s{}\n", iface, args, tname,
+			args)
+		fmt.Fprintf(out, "}\n\n")
+	}
+}
+
+// writeMockMethods writes out the methods of the mock type for the interface
+// tname, along with the recorder type and EXPECT method.
+func writeMockMethods(out io.Writer, b backend, tname string, t *ifDetails, methods []*funcInfo, EXPECT string) {
+	rec := "_mock_" + tname + "_rec"
+	for _, m := range methods {
+		m.recv.expr = "*Mock" + tname + t.typeArgs
+		m.writeMock(out, b)
+		b.writeRecorder(out, m, rec+t.typeArgs)
+	}
+
+	// (the recorder type comes last, as a backend may need to have seen all
+	// the methods before it can be written)
+	b.writeTypeRecorder(out, "*Mock"+tname, rec, t.typeParams, t.typeArgs,
+		EXPECT)
 }
 
 func genInterfaces(interfaces Interfaces) error {
@@ -302,12 +523,6 @@ func genInterfaces(interfaces Interfaces) error {
 		if err := interfaces.genInterface(name); err != nil {
 			return Cerr{"genInterface", err}
 		}
-
-		// TODO: currently we need to use goimports to add missing imports, we
-		// need to sort out our own imports, then we can switch to gofmt.
-		if err := fixup(i.filename); err != nil {
-			return Cerr{"fixup", err}
-		}
 	}
 
 	return nil
@@ -9,10 +9,12 @@ import (
 	"fmt"
 	"go/parser"
 	"go/token"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 func LookupImportPath(impPath string) (string, error) {
@@ -33,11 +35,65 @@ func LookupImportPath(impPath string) (string, error) {
 	return path, nil
 }
 
+var (
+	importMaps     = map[string]map[string]string{}
+	importMapsLock sync.Mutex
+)
+
+// vendoredImport returns the import path that the package in srcDir actually
+// uses when it imports impPath.  This will only differ from impPath when the
+// go tool picks a vendored copy from a GOPATH vendor directory (when using
+// modules the go tool already reports the vendored location for impPath).
+func vendoredImport(impPath, srcDir string) (string, error) {
+	if srcDir == "" || strings.HasPrefix(impPath, ".") {
+		return impPath, nil
+	}
+
+	importMapsLock.Lock()
+	importMap, found := importMaps[srcDir]
+	importMapsLock.Unlock()
+	if !found {
+		// We include the tests, so that we also get the mapping for any
+		// imports only used by tests.
+		cmd := exec.Command("go", "list", "-e", "-test", "-f",
+			"{{range $from, $to := .ImportMap}}{{$from}} {{$to}}\n{{end}}", ".")
+		cmd.Dir = srcDir
+		out, err := GetCmdOutput(cmd)
+		if err != nil {
+			return "", err
+		}
+
+		importMap = make(map[string]string)
+		for _, line := range strings.Split(out, "\n") {
+			parts := strings.SplitN(strings.TrimSpace(line), " ", 2)
+			if len(parts) != 2 || strings.Contains(parts[1], " ") {
+				// Ignore the test variants of packages
+				continue
+			}
+			importMap[parts[0]] = parts[1]
+		}
+
+		importMapsLock.Lock()
+		importMaps[srcDir] = importMap
+		importMapsLock.Unlock()
+	}
+
+	if vendored, found := importMap[impPath]; found {
+		return vendored, nil
+	}
+
+	return impPath, nil
+}
+
 func GetOutput(name string, args ...string) (string, error) {
 	return GetCmdOutput(exec.Command(name, args...))
 }
 
 func GetCmdOutput(cmd *exec.Cmd) (string, error) {
+	if cmd.Env == nil {
+		cmd.Env = goEnv()
+	}
+
 	buf := &bytes.Buffer{}
 	cmd.Stderr = buf
 	out, err := cmd.Output()
@@ -84,6 +140,7 @@ func hasNonGoCode(impPath string) (bool, error) {
 
 func GetImports(path string, tests bool) (importSet, error) {
 	imports := make(importSet)
+	dir := path
 
 	isGoFile := func(info os.FileInfo) bool {
 		if info.IsDir() {
@@ -92,7 +149,10 @@ func GetImports(path string, tests bool) (importSet, error) {
 		if !tests && strings.HasSuffix(info.Name(), "_test.go") {
 			return false
 		}
-		return strings.HasSuffix(info.Name(), ".go")
+		if !strings.HasSuffix(info.Name(), ".go") {
+			return false
+		}
+		return includeFile(path, info.Name())
 	}
 
 	fset := token.NewFileSet()
@@ -123,7 +183,7 @@ func GetImports(path string, tests bool) (importSet, error) {
 					path2 = comment[8:len(comment)-1]
 				}
 
-				err := imports.Set(path, mode, path2)
+				err := imports.Set(path, dir, mode, path2)
 				if err != nil {
 					return nil, err
 				}
@@ -190,17 +250,17 @@ func getStdlibImports(path string) (map[string]bool, error) {
 
 // Import "marks":
 //
-//  _ : mock
-//  + : normal (no mark actually applied)
-//  @ : test
-//  = : replace
+//  _       : mock
+//  +       : normal (no mark actually applied)
+//  _test_/ : test (a prefix, as the go tool rejects "@" in module mode)
+//  =       : replace
 type mark string
 
 const (
 	noMark      mark = ""
 	normalMark  mark = "+"
 	mockMark    mark = "_"
-	testMark    mark = "@"
+	testMark    mark = testModule + "/"
 	replaceMark mark = "="
 )
 
@@ -208,7 +268,9 @@ func markImport(name string, m mark) string {
 	switch m {
 	case noMark, normalMark:
 		return name
-	case mockMark, testMark, replaceMark:
+	case testMark:
+		return string(m) + name
+	case mockMark, replaceMark:
 		return string(m) + name[1:]
 	default:
 		panic(fmt.Sprintf("Unknown import mark: %s", m))
@@ -216,11 +278,12 @@ func markImport(name string, m mark) string {
 }
 
 func getMark(label string) mark {
+	if strings.HasPrefix(label, string(testMark)) {
+		return testMark
+	}
 	switch label[0] {
 	case mockMark[0]:
 		return mockMark
-	case testMark[0]:
-		return testMark
 	case replaceMark[0]:
 		return replaceMark
 	default:
@@ -228,24 +291,22 @@ func getMark(label string) mark {
 	}
 }
 
-func GenPkg(srcPath, dstRoot, name string, mock bool, cfg *MockConfig) (importSet, error) {
-	// Find the package source, it may be in any entry in srcPath
-	srcRoot := ""
-	for _, src := range filepath.SplitList(srcPath) {
-		if exists(filepath.Join(src, "src", name)) {
-			srcRoot = src
-			break
-		}
+func GenPkg(srcPath, dstRoot, from, name string, mock bool, cfg *MockConfig) (importSet, error) {
+	// Find the package source
+	src, err := findPackage(srcPath, from)
+	if err != nil {
+		return nil, err
 	}
-	if srcRoot == "" {
-		return nil, fmt.Errorf("Package '%s' not found in any of '%s'.", name,
-			srcPath)
+
+	// Mocks written by "withmock gen" are already mocks, so unless we have
+	// been asked to mock them again we just use them as they are.
+	dst := filepath.Join(dstRoot, "src", name)
+	if !mock && isStaticMock(src) {
+		return linkStaticMock(src, dst)
 	}
 
 	// Write a mock version of the package
-	src := filepath.Join(srcRoot, "src", name)
-	dst := filepath.Join(dstRoot, "src", name)
-	err := os.MkdirAll(dst, 0700)
+	err = os.MkdirAll(dst, 0700)
 	if err != nil {
 		return nil, err
 	}
@@ -258,9 +319,19 @@ func GenPkg(srcPath, dstRoot, name string, mock bool, cfg *MockConfig) (importSe
 	return imports, nil
 }
 
+// standardSource returns the source directory of the standard package name.
+func standardSource(srcRoot, name string) string {
+	src := filepath.Join(srcRoot, "src/pkg", name)
+	if !exists(src) {
+		// Go 1.4 moved the standard library out of src/pkg
+		src = filepath.Join(srcRoot, "src", name)
+	}
+	return src
+}
+
 func MockStandard(srcRoot, dstRoot, name string, cfg *MockConfig) error {
 	// Write a mock version of the package
-	src := filepath.Join(srcRoot, "src/pkg", name)
+	src := standardSource(srcRoot, name)
 	dst := filepath.Join(dstRoot, "src", markImport(name, mockMark))
 	err := os.MkdirAll(dst, 0700)
 	if err != nil {
@@ -268,7 +339,6 @@ func MockStandard(srcRoot, dstRoot, name string, cfg *MockConfig) error {
 	}
 	cfg.MockPrototypes = true
 	cfg.IgnoreInits = true
-	cfg.MatchOSArch = true
 	cfg.IgnoreNonGoFiles = true
 	_, err = MakePkg(src, dst, name, true, cfg)
 	if err != nil {
@@ -280,23 +350,15 @@ func MockStandard(srcRoot, dstRoot, name string, cfg *MockConfig) error {
 }
 
 func ReplacePkg(srcPath, dstRoot, from, as string) (importSet, error) {
-	// Find the package source, it may be in any entry in srcPath
-	srcRoot := ""
-	for _, src := range filepath.SplitList(srcPath) {
-		if exists(filepath.Join(src, "src", from)) {
-			srcRoot = src
-			break
-		}
-	}
-	if srcRoot == "" {
-		return nil, fmt.Errorf("Package '%s' not found in any of '%s'.", from,
-			srcPath)
+	// Find the package source
+	src, err := findPackage(srcPath, from)
+	if err != nil {
+		return nil, err
 	}
 
 	// Copy the package source
-	src := filepath.Join(srcRoot, "src", from)
 	dst := filepath.Join(dstRoot, "src", as)
-	err := symlinkPackage(src, dst)
+	err = symlinkPackage(src, dst)
 	if err != nil {
 		return nil, Cerr{"symlinkPackage", err}
 	}
@@ -311,24 +373,16 @@ func ReplacePkg(srcPath, dstRoot, from, as string) (importSet, error) {
 	return imports, nil
 }
 
-func LinkPkg(srcPath, dstRoot, name string) (importSet, error) {
-	// Find the package source, it may be in any entry in srcPath
-	srcRoot := ""
-	for _, src := range filepath.SplitList(srcPath) {
-		if exists(filepath.Join(src, "src", name)) {
-			srcRoot = src
-			break
-		}
-	}
-	if srcRoot == "" {
-		return nil, fmt.Errorf("Package '%s' not found in any of '%s'.", name,
-			srcPath)
+func LinkPkg(srcPath, dstRoot, from, name string) (importSet, error) {
+	// Find the package source
+	src, err := findPackage(srcPath, from)
+	if err != nil {
+		return nil, err
 	}
 
 	// Copy the package source
-	src := filepath.Join(srcRoot, "src", name)
 	dst := filepath.Join(dstRoot, "src", name)
-	err := symlinkPackage(src, dst)
+	err = symlinkPackage(src, dst)
 	if err != nil {
 		return nil, Cerr{"symlinkPackage", err}
 	}
@@ -343,6 +397,25 @@ func LinkPkg(srcPath, dstRoot, name string) (importSet, error) {
 	return imports, nil
 }
 
+// findPackage returns the directory holding the source of the named package.
+// The package is searched for in each entry of srcPath (i.e. a GOPATH), an
+// empty srcPath means that we are using modules - in which case we ask the go
+// tool where the package lives.
+func findPackage(srcPath, name string) (string, error) {
+	if srcPath == "" {
+		return LookupImportPath(name)
+	}
+
+	for _, src := range filepath.SplitList(srcPath) {
+		if exists(filepath.Join(src, "src", name)) {
+			return filepath.Join(src, "src", name), nil
+		}
+	}
+
+	return "", fmt.Errorf("Package '%s' not found in any of '%s'.", name,
+		srcPath)
+}
+
 func exists(path string) bool {
 	_, err := os.Stat(path)
 	if err == nil {
@@ -354,7 +427,15 @@ func exists(path string) bool {
 	panic(err)
 }
 
-func MockImports(src, dst string, names map[string]string, cfg *Config) error {
+func MockImports(src, dst, pkgName string, self bool, names map[string]string, cfg *Config) error {
+	helpers := make(map[string]*testHelper)
+
+	if self {
+		if err := mockSelf(src, dst, pkgName, names, cfg); err != nil {
+			return Cerr{"mockSelf", err}
+		}
+	}
+
 	fn := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -367,25 +448,135 @@ func MockImports(src, dst string, names map[string]string, cfg *Config) error {
 
 		target := filepath.Join(dst, rel)
 
-		// Ignore every directory except src (which we need to mirror)
+		// Ignore every directory except src (which we need to mirror), and
+		// testdata - which we link to, so that tests can write to it too.
 		if info.Mode().IsDir() {
 			if path == src {
 				return os.MkdirAll(target, 0700)
+			} else if rel == "testdata" {
+				if err := os.Symlink(path, target); err != nil {
+					return err
+				}
+				return filepath.SkipDir
 			} else {
 				return filepath.SkipDir
 			}
 		}
 
+		// Module files would change which module the mirrored code belongs
+		// to, so they are left behind
+		if isModuleFile(info.Name()) {
+			return nil
+		}
+
+		// When mocking the code under test, anything already written by
+		// mockSelf is left as it is
+		if self && !strings.HasSuffix(path, "_test.go") {
+			if _, err := os.Lstat(target); err == nil {
+				return nil
+			}
+		}
+
 		// Non-code we leave alone, code may need modification
 		if !strings.HasSuffix(path, ".go") {
 			return os.Symlink(path, target)
-		} else {
-			return mockFileImports(path, target, names, cfg)
 		}
+		if strings.HasSuffix(path, "_test.go") {
+			if err := scanTestFile(path, helpers); err != nil {
+				return err
+			}
+		}
+		return mockFileImports(path, target, names, cfg)
 	}
 
 	// Now use walk to process the files in src
-	return filepath.Walk(src, fn)
+	if err := filepath.Walk(src, fn); err != nil {
+		return err
+	}
+
+	return writeTestHelpers(dst, helpers, names, cfg)
+}
+
+// selfMocked returns true if the code under test in src should be mocked too,
+// either because the config says so or because one of the test files contains
+// a "// mock self" comment.
+func selfMocked(src string, cfg *MockConfig) (bool, error) {
+	if cfg.Self {
+		return true, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(src, "*_test.go"))
+	if err != nil {
+		return false, err
+	}
+
+	for _, path := range paths {
+		if !includeFile(src, filepath.Base(path)) {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+
+		// Only parse the files that might have the comment, leaving any
+		// errors in the others for the compiler to report.  If a file that
+		// might ask for mocking can't be parsed, then we can't tell if it
+		// does - and guessing would just cause confusing errors later.
+		if !bytes.Contains(bytes.ToLower(data), []byte("mock self")) {
+			continue
+		}
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, path, data, parser.ParseComments)
+		if err != nil {
+			return false, err
+		}
+
+		for _, group := range file.Comments {
+			for _, c := range group.List {
+				text := strings.TrimPrefix(c.Text, "//")
+				if strings.HasPrefix(text, "/*") {
+					text = strings.TrimSuffix(text[2:], "*/")
+				}
+				if strings.ToLower(strings.TrimSpace(text)) == "mock self" {
+					return true, nil
+				}
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// mockSelf writes a mock version of the code under test into dst, with
+// mocking disabled until the tests ask for it.  The generated code is then
+// given the same import changes as the rest of the code under test.
+func mockSelf(src, dst, pkgName string, names map[string]string, cfg *Config) error {
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return Cerr{"MkdirAll", err}
+	}
+
+	if _, err := MakePkg(src, dst, pkgName, false, cfg.Mock(pkgName)); err != nil {
+		return Cerr{"MakePkg", err}
+	}
+
+	files, err := ioutil.ReadDir(dst)
+	if err != nil {
+		return Cerr{"ReadDir", err}
+	}
+
+	for _, info := range files {
+		if info.Mode()&os.ModeSymlink != 0 || !strings.HasSuffix(info.Name(), ".go") {
+			continue
+		}
+		path := filepath.Join(dst, info.Name())
+		if err := mockFileImports(path, path, names, cfg); err != nil {
+			return Cerr{"mockFileImports", err}
+		}
+	}
+
+	return nil
 }
 
 func symlinkPackage(src, dst string) error {
@@ -406,9 +597,24 @@ func symlinkPackage(src, dst string) error {
 			return os.MkdirAll(target, 0700)
 		}
 
+		if isModuleFile(info.Name()) {
+			return nil
+		}
+
 		return os.Symlink(path, target)
 	}
 
 	// Now use walk to process the files in src
 	return filepath.Walk(src, fn)
 }
+
+// isModuleFile returns true if name is one of the files used by the go tool to
+// define a module or workspace.  We never want to mirror these into the work
+// area, as that would change which module the mirrored code belongs to.
+func isModuleFile(name string) bool {
+	switch name {
+	case "go.mod", "go.sum", "go.work", "go.work.sum":
+		return true
+	}
+	return false
+}
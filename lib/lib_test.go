@@ -0,0 +1,107 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSelfMocked(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		self  bool
+		want  bool
+		err   bool
+	}{
+		{
+			name:  "config",
+			files: map[string]string{"a_test.go": "package a\n"},
+			self:  true,
+			want:  true,
+		},
+		{
+			name:  "none",
+			files: map[string]string{"a_test.go": "package a\n\n// mock\n"},
+		},
+		{
+			name: "comment",
+			files: map[string]string{
+				"a_test.go": "package a\n\n// Mock Self\n",
+			},
+			want: true,
+		},
+		{
+			name: "group",
+			files: map[string]string{
+				"a_test.go": "// Tests of a.\n//\n// mock self\npackage a\n",
+			},
+			want: true,
+		},
+		{
+			name: "block",
+			files: map[string]string{
+				"a_test.go": "package a\n\n/* mock self */\n",
+			},
+			want: true,
+		},
+		{
+			name: "text",
+			files: map[string]string{
+				"a_test.go": "package a\n\n// Don't mock self here\n",
+			},
+		},
+		{
+			name:  "code",
+			files: map[string]string{"a.go": "package a\n\n// mock self\n"},
+		},
+		{
+			name: "excluded",
+			files: map[string]string{
+				"a_test.go": "//go:build ignore\n\npackage a\n\n// mock self\n",
+			},
+		},
+		{
+			name: "broken",
+			files: map[string]string{
+				"a_test.go": "package a\n\n// mock self\nfunc {\n",
+				"b_test.go": "package a\n",
+			},
+			err: true,
+		},
+		{
+			name: "later",
+			files: map[string]string{
+				"a_test.go": "package a\n\nfunc {\n",
+				"b_test.go": "package a\n\n// mock self\n",
+			},
+			want: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range test.files {
+				writeFile(t, filepath.Join(dir, name), data)
+			}
+
+			got, err := selfMocked(dir, &MockConfig{Self: test.self})
+			if test.err {
+				if err == nil {
+					t.Errorf("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if got != test.want {
+				t.Errorf("Expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
@@ -5,15 +5,19 @@
 package lib
 
 import (
+	"bytes"
 	"fmt"
 	"go/ast"
+	"go/format"
 	"go/parser"
 	"go/token"
 	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"unicode"
 )
 
 func isLocalExpr(expr string) bool {
@@ -30,22 +34,101 @@ func isLocalExpr(expr string) bool {
 	return !strings.Contains(expr, ".")
 }
 
-func scopeName(name, scope string) string {
-	if strings.HasPrefix(name, "[]") {
-		return "[]" + scopeName(name[2:], scope)
+// scopeName adds scope to the identifiers in name that refer to local types,
+// unless they are one of the type parameters in keep.
+func scopeName(name, scope string, keep ...string) string {
+	prefix := ""
+	if strings.HasPrefix(name, "...") {
+		prefix, name = "...", name[3:]
 	}
-	if isLocalExpr(name) {
-		return scope + "." + name
+
+	expr, err := parser.ParseExpr(name)
+	if err != nil {
+		return prefix + name
+	}
+
+	skip := map[string]bool{
+		"any": true, "comparable": true, "nil": true, "true": true,
+		"false": true, "iota": true,
+	}
+	for _, k := range keep {
+		skip[k] = true
+	}
+
+	var fn func(n ast.Node) bool
+	fn = func(n ast.Node) bool {
+		switch v := n.(type) {
+		case *ast.SelectorExpr:
+			// already scoped
+			return false
+		case *ast.Field:
+			// only the type needs scoping, not the names
+			ast.Inspect(v.Type, fn)
+			return false
+		case *ast.Ident:
+			if !skip[v.Name] && isLocalExpr(v.Name) {
+				v.Name = scope + "." + v.Name
+			}
+		}
+		return true
 	}
-	return name
+	ast.Inspect(expr, fn)
+
+	buf := &bytes.Buffer{}
+	if err := format.Node(buf, token.NewFileSet(), expr); err != nil {
+		return prefix + name
+	}
+	return prefix + buf.String()
 }
 
-func scopeFields(fields []field, scope string) []field {
+func scopeFields(fields []field, scope string, keep ...string) []field {
 	newFields := make([]field, len(fields))
 	for i, f := range fields {
 		newFields[i] = field{
 			names: f.names,
-			expr: scopeName(f.expr, scope),
+			expr: scopeName(f.expr, scope, keep...),
+		}
+	}
+	return newFields
+}
+
+// substIdents returns expr with any identifiers found in subst replaced.
+// Selectors (i.e. the Name of pkg.Name) are left alone.
+func substIdents(expr string, subst map[string]string) string {
+	isIdent := func(r rune) bool {
+		return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+	}
+
+	out := ""
+	for len(expr) > 0 {
+		i := strings.IndexFunc(expr, isIdent)
+		if i < 0 {
+			break
+		}
+		out += expr[:i]
+		expr = expr[i:]
+
+		j := strings.IndexFunc(expr, func(r rune) bool { return !isIdent(r) })
+		if j < 0 {
+			j = len(expr)
+		}
+		ident := expr[:j]
+		expr = expr[j:]
+
+		if repl, ok := subst[ident]; ok && !strings.HasSuffix(out, ".") {
+			ident = repl
+		}
+		out += ident
+	}
+	return out + expr
+}
+
+func substFields(fields []field, subst map[string]string) []field {
+	newFields := make([]field, len(fields))
+	for i, f := range fields {
+		newFields[i] = field{
+			names: f.names,
+			expr: substIdents(f.expr, subst),
 		}
 	}
 	return newFields
@@ -61,32 +144,107 @@ type funcInfo struct {
 	export       string
 	varidic      bool
 	realDisabled bool
+	mocked       bool // the real version is renamed, to make way for the mock
 	recv         struct {
 		name, expr string
 	}
 	params, results []field
 	body            []byte
+
+	// For generic functions, typeParams is the type parameter list as
+	// declared (e.g. "[T any]"), and typeArgs is the list of names used to
+	// instantiate (e.g. "[T]").
+	typeParams, typeArgs string
+
+	// imports maps the packages that the types may use to their import
+	// paths (only set for the methods of interfaces).
+	imports map[string]string
 }
 
-func (fi *funcInfo) AddScope(scope string) *funcInfo {
+// AddScope returns a copy of fi with local types scoped to the package scope,
+// apart from the type parameters listed in keep.
+func (fi *funcInfo) AddScope(scope string, keep ...string) *funcInfo {
 	return &funcInfo{
 		name: fi.name,
 		varidic: fi.varidic,
 		realDisabled: fi.realDisabled,
 		recv: struct{name, expr string}{
 			fi.recv.name,
-			scopeName(fi.recv.expr, scope),
+			scopeName(fi.recv.expr, scope, keep...),
 		},
-		params: scopeFields(fi.params, scope),
-		results: scopeFields(fi.results, scope),
+		params: scopeFields(fi.params, scope, keep...),
+		results: scopeFields(fi.results, scope, keep...),
 		body: fi.body,
+		imports: fi.imports,
 	}
 }
 
+// Subst returns a copy of fi with the types in subst replaced, used to
+// instantiate the methods of a generic interface.
+func (fi *funcInfo) Subst(subst map[string]string) *funcInfo {
+	return &funcInfo{
+		name: fi.name,
+		varidic: fi.varidic,
+		realDisabled: fi.realDisabled,
+		recv: fi.recv,
+		params: substFields(fi.params, subst),
+		results: substFields(fi.results, subst),
+		body: fi.body,
+		imports: fi.imports,
+	}
+}
+
+// usedImports adds the imports needed by the types used by fi to used.
+func (fi *funcInfo) usedImports(used map[string]string) error {
+	m := &mockGen{}
+	m.collectScopes()
+
+	exprs := []string{fi.recv.expr}
+	for _, f := range append(fi.params, fi.results...) {
+		exprs = append(exprs, strings.TrimPrefix(f.expr, "..."))
+	}
+	for _, e := range exprs {
+		if e == "" {
+			continue
+		}
+		expr, err := parser.ParseExpr(e)
+		if err != nil {
+			return Cerr{"parser.ParseExpr", err}
+		}
+		m.exprString(expr)
+	}
+
+	for _, scope := range m.getScopes() {
+		impPath, found := fi.imports[scope]
+		if !found {
+			return fmt.Errorf("Unknown package %s used by %s", scope, fi.name)
+		}
+		if err := addUsed(used, scope, impPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (fi *funcInfo) IsMethod() bool {
 	return fi.recv.expr != ""
 }
 
+func (fi *funcInfo) IsGeneric() bool {
+	return fi.typeParams != ""
+}
+
+// baseTypeName returns the name of the type in a receiver expression, i.e.
+// without any pointer or type arguments ("*List[T]" gives "List").
+func baseTypeName(expr string) string {
+	expr = strings.TrimPrefix(expr, "*")
+	if i := strings.Index(expr, "["); i >= 0 {
+		expr = expr[:i]
+	}
+	return expr
+}
+
 func (fi *funcInfo) writeReal(out io.Writer) {
 	if fi.export != "" {
 		fmt.Fprintf(out, "//export %s\n", fi.export)
@@ -95,10 +253,10 @@ func (fi *funcInfo) writeReal(out io.Writer) {
 	if fi.IsMethod() {
 		fmt.Fprintf(out, "(%s %s) ", fi.recv.name, fi.recv.expr)
 	}
-	if ast.IsExported(fi.name) {
+	if fi.mocked {
 		fmt.Fprintf(out, "_real_")
 	}
-	fmt.Fprintf(out, "%s(", fi.name)
+	fmt.Fprintf(out, "%s%s(", fi.name, fi.typeParams)
 	for i, param := range fi.params {
 		if i > 0 {
 			fmt.Fprintf(out, ", ")
@@ -127,7 +285,7 @@ func (fi *funcInfo) writeStub(out io.Writer) {
 	if fi.IsMethod() {
 		fmt.Fprintf(out, "(%s %s) ", fi.recv.name, fi.recv.expr)
 	}
-	if ast.IsExported(fi.name) {
+	if fi.mocked {
 		fmt.Fprintf(out, "_real_")
 	}
 	fmt.Fprintf(out, "%s(", fi.name)
@@ -205,18 +363,23 @@ func (fi *funcInfo) retTypes() []string {
 	return results
 }
 
-func (fi *funcInfo) writeMock(out io.Writer) {
-	scopedName := fi.name
+func (fi *funcInfo) writeMock(out io.Writer, b backend) {
+	// A generic function can't be a method of _packageMock, so instead each
+	// instantiation gets it's own mock type.
+	pkgMock := "_pkgMock"
+	mockType := "*_packageMock"
+	if fi.IsGeneric() && !fi.IsMethod() {
+		mockType = "_" + fi.name + "_mock" + fi.typeArgs
+		pkgMock = mockType + "{}"
+		fmt.Fprintf(out, "type _%s_mock%s struct{int}\n\n", fi.name,
+			fi.typeParams)
+	}
+
 	fmt.Fprintf(out, "func ")
 	if fi.IsMethod() {
 		fmt.Fprintf(out, "(_m %s) ", fi.recv.expr)
-		if fi.recv.expr[0] == '*' {
-			scopedName = fi.recv.expr[1:] + "." + scopedName
-		} else {
-			scopedName = fi.recv.expr + "." + scopedName
-		}
 	}
-	fmt.Fprintf(out, "%s(", fi.name)
+	fmt.Fprintf(out, "%s%s(", fi.name, fi.typeParams)
 	args := fi.writeParams(out)
 	fmt.Fprintf(out, ") ")
 	returns := fi.retTypes()
@@ -229,7 +392,7 @@ func (fi *funcInfo) writeMock(out io.Writer) {
 		if len(fi.results) > 0 {
 			fmt.Fprintf(out, "return ")
 		}
-		fmt.Fprintf(out, "_pkgMock.%s(", fi.name)
+		fmt.Fprintf(out, "%s.%s(", pkgMock, fi.name)
 		for i := 0; i < args; i++ {
 			if i > 0 {
 				fmt.Fprintf(out, ", ")
@@ -241,7 +404,7 @@ func (fi *funcInfo) writeMock(out io.Writer) {
 		}
 		fmt.Fprintf(out, ")\n")
 		fmt.Fprintf(out, "}\n")
-		fmt.Fprintf(out, "func (_m *_packageMock) %s(", fi.name)
+		fmt.Fprintf(out, "func (_m %s) %s(", mockType, fi.name)
 		fi.writeParams(out)
 		fmt.Fprintf(out, ") ")
 		if len(returns) > 0 {
@@ -249,80 +412,135 @@ func (fi *funcInfo) writeMock(out io.Writer) {
 		}
 		fmt.Fprintf(out, "{\n")
 	}
+	b.writeCall(out, fi, args)
+	fmt.Fprintf(out, "}\n")
+}
+
+// callArgs returns the arguments to pass on the args parameters of fi to
+// another function with the same signature.
+func (fi *funcInfo) callArgs(args int) string {
+	params := make([]string, args)
+	for i := range params {
+		params[i] = fmt.Sprintf("p%d", i)
+	}
 	if fi.varidic {
-		if !fi.realDisabled {
-			fmt.Fprintf(out, "\tif (!_allMocked && !_enabledMocks[\"%s\"]) "+
-				"|| _disabledMocks[\"%s\"] {\n", scopedName, scopedName)
-			fmt.Fprintf(out, "\t\t")
-			if len(fi.results) > 0 {
-				fmt.Fprintf(out, "return ")
-			}
-			if fi.IsMethod() {
-				fmt.Fprintf(out, "_m.")
-			}
-			fmt.Fprintf(out, "_real_%s(", fi.name)
-			for i := 0; i < args-1; i++ {
-				fmt.Fprintf(out, "p%d, ", i)
-			}
-			fmt.Fprintf(out, "p%d...", args-1)
-			fmt.Fprintf(out, ")\n")
-			if len(fi.results) == 0 {
-				fmt.Fprintf(out, "\treturn")
-			}
-			fmt.Fprintf(out, "\t}\n")
-		}
-		fmt.Fprintf(out, "\targs := []interface{}{")
-		for i := 0; i < args-1; i++ {
-			if i > 0 {
-				fmt.Fprintf(out, ", ")
-			}
-			fmt.Fprintf(out, "p%d", i)
-		}
-		fmt.Fprintf(out, "}\n")
-		fmt.Fprintf(out, "\tfor _, v := range p%d {\n", args-1)
-		fmt.Fprintf(out, "\t\targs = append(args, v)\n")
-		fmt.Fprintf(out, "\t}\n")
-		fmt.Fprintf(out, "\t")
-		if len(fi.results) > 0 {
-			fmt.Fprintf(out, "ret := ")
-		}
-		fmt.Fprintf(out, "_ctrl.Call(_m, \"%s\", args...)\n", fi.name)
+		params[args-1] += "..."
+	}
+	return strings.Join(params, ", ")
+}
+
+// realCall returns the call of the real version of fi, with args parameters.
+func (fi *funcInfo) realCall(args int) string {
+	call := ""
+	if fi.IsMethod() {
+		call = "_m."
+	}
+	return call + fmt.Sprintf("_real_%s%s(%s)", fi.name, fi.typeArgs,
+		fi.callArgs(args))
+}
+
+// writeReturn writes a statement that returns the result of call from the mock
+// of fi.
+func (fi *funcInfo) writeReturn(out io.Writer, indent, call string) {
+	if len(fi.results) > 0 {
+		fmt.Fprintf(out, "%sreturn %s\n", indent, call)
 	} else {
-		if !fi.realDisabled {
-			fmt.Fprintf(out, "\tif (!_allMocked && !_enabledMocks[\"%s\"]) "+
-				"||  _disabledMocks[\"%s\"] {\n", scopedName, scopedName)
-			fmt.Fprintf(out, "\t\t")
-			if len(fi.results) > 0 {
-				fmt.Fprintf(out, "return ")
-			}
-			if fi.IsMethod() {
-				fmt.Fprintf(out, "_m.")
-			}
-			fmt.Fprintf(out, "_real_%s(", fi.name)
-			for i := 0; i < args; i++ {
-				if i > 0 {
-					fmt.Fprintf(out, ", ")
-				}
-				fmt.Fprintf(out, "p%d", i)
-			}
-			fmt.Fprintf(out, ")\n")
-			if len(fi.results) == 0 {
-				fmt.Fprintf(out, "\treturn")
-			}
-			fmt.Fprintf(out, "\t}\n")
-		}
-		fmt.Fprintf(out, "\t")
-		if len(fi.results) > 0 {
-			fmt.Fprintf(out, "ret := ")
+		fmt.Fprintf(out, "%s%s\n", indent, call)
+		fmt.Fprintf(out, "%sreturn\n", indent)
+	}
+}
+
+// writeGuard writes the check that calls the real version of fi, unless it has
+// been mocked.
+func (fi *funcInfo) writeGuard(out io.Writer, args int) {
+	if fi.realDisabled {
+		return
+	}
+	scopedName := fi.name
+	if fi.IsMethod() {
+		scopedName = baseTypeName(fi.recv.expr) + "." + scopedName
+	}
+	fi.writeSpy(out, args)
+	fmt.Fprintf(out, "\tif !_isMocked(\"%s\") {\n", scopedName)
+	fi.writeReturn(out, "\t\t", fi.realCall(args))
+	fmt.Fprintf(out, "\t}\n")
+	fi.writeTape(out, args)
+}
+
+// writeSpy writes the check that calls the real version of fi, recording the
+// call, if it is being spied on.
+func (fi *funcInfo) writeSpy(out io.Writer, args int) {
+	if fi.realDisabled {
+		return
+	}
+	scopedName := fi.name
+	recv := "nil"
+	if fi.IsMethod() {
+		scopedName = baseTypeName(fi.recv.expr) + "." + scopedName
+		recv = "_m"
+	}
+	fmt.Fprintf(out, "\tif _spying(\"%s\") {\n", scopedName)
+	fmt.Fprintf(out, "\t\t_c := _spyStart(%s", recv)
+	for i := 0; i < args; i++ {
+		fmt.Fprintf(out, ", p%d", i)
+	}
+	fmt.Fprintf(out, ")\n")
+	// recover has to be called by the deferred function itself
+	fmt.Fprintf(out, "\t\tdefer func() {\n")
+	fmt.Fprintf(out, "\t\t\t_spyEnd(\"%s\", _c, recover())\n", scopedName)
+	fmt.Fprintf(out, "\t\t}()\n")
+	returns := fi.retTypes()
+	if len(returns) == 0 {
+		fmt.Fprintf(out, "\t\t%s\n", fi.realCall(args))
+		fmt.Fprintf(out, "\t\treturn\n")
+		fmt.Fprintf(out, "\t}\n")
+		return
+	}
+	rets := make([]string, len(returns))
+	for i := range rets {
+		rets[i] = fmt.Sprintf("ret%d", i)
+	}
+	fmt.Fprintf(out, "\t\t%s := %s\n", strings.Join(rets, ", "),
+		fi.realCall(args))
+	fmt.Fprintf(out, "\t\t_c.Results = []interface{}{%s}\n",
+		strings.Join(rets, ", "))
+	fmt.Fprintf(out, "\t\treturn %s\n", strings.Join(rets, ", "))
+	fmt.Fprintf(out, "\t}\n")
+}
+
+// writeCallArgs writes the setup of the arguments for a call to a mocking
+// library that takes the arguments as interface{} values.  The arguments are
+// returned, and if fi is varidic then the last one needs to be expanded.
+func (fi *funcInfo) writeCallArgs(out io.Writer, args int) []string {
+	if !fi.varidic {
+		params := make([]string, args)
+		for i := range params {
+			params[i] = fmt.Sprintf("p%d", i)
 		}
-		fmt.Fprintf(out, "_ctrl.Call(_m, \"%s\"", fi.name)
-		for i := 0; i < args; i++ {
-			fmt.Fprintf(out, ", p%d", i)
+		return params
+	}
+	fmt.Fprintf(out, "\targs := []interface{}{")
+	for i := 0; i < args-1; i++ {
+		if i > 0 {
+			fmt.Fprintf(out, ", ")
 		}
-		fmt.Fprintf(out, ")\n")
+		fmt.Fprintf(out, "p%d", i)
 	}
+	fmt.Fprintf(out, "}\n")
+	fmt.Fprintf(out, "\tfor _, v := range p%d {\n", args-1)
+	fmt.Fprintf(out, "\t\targs = append(args, v)\n")
+	fmt.Fprintf(out, "\t}\n")
+	return []string{"args"}
+}
+
+// writeResults writes the conversion of the results stored in ret by a call to
+// a mocking library, where result is the format to get the i'th one, and then
+// returns them.
+func (fi *funcInfo) writeResults(out io.Writer, result string) {
+	returns := fi.retTypes()
 	for i, ret := range returns {
-		fmt.Fprintf(out, "\tret%d, _ := ret[%d].(%s)\n", i, i, ret)
+		fmt.Fprintf(out, "\tret%d, _ := %s.(%s)\n", i, fmt.Sprintf(result, i),
+			ret)
 	}
 	if len(returns) > 0 {
 		fmt.Fprintf(out, "\treturn ")
@@ -334,55 +552,6 @@ func (fi *funcInfo) writeMock(out io.Writer) {
 		}
 		fmt.Fprintf(out, "\n")
 	}
-	fmt.Fprintf(out, "}\n")
-}
-
-func (fi *funcInfo) writeRecorder(out io.Writer, recorder string) {
-	args := fi.countParams()
-	fmt.Fprintf(out, "func (_mr *%s) %s(", recorder, fi.name)
-	if args > 0 {
-		if fi.varidic {
-			if args > 1 {
-				for i := 0; i < args-1; i++ {
-					if i > 0 {
-						fmt.Fprintf(out, ", ")
-					}
-					fmt.Fprintf(out, "p%d", i)
-				}
-				fmt.Fprintf(out, " interface{}, ")
-			}
-			fmt.Fprintf(out, "p%d ...interface{}", args-1)
-		} else {
-			for i := 0; i < args; i++ {
-				if i > 0 {
-					fmt.Fprintf(out, ", ")
-				}
-				fmt.Fprintf(out, "p%d", i)
-			}
-			fmt.Fprintf(out, " interface{}")
-		}
-	}
-	fmt.Fprintf(out, ") *gomock.Call {\n")
-	if fi.varidic {
-		fmt.Fprintf(out, "\targs := append([]interface{}{")
-		for i := 0; i < args-1; i++ {
-			if i > 0 {
-				fmt.Fprintf(out, ", ")
-			}
-			fmt.Fprintf(out, "p%d", i)
-		}
-		fmt.Fprintf(out, "}, p%d...)\n", args-1)
-	}
-	fmt.Fprintf(out, "\treturn _ctrl.RecordCall(_mr.mock, \"%s\"", fi.name)
-	if fi.varidic {
-		fmt.Fprintf(out, ", args...")
-	} else {
-		for i := 0; i < args; i++ {
-			fmt.Fprintf(out, ", p%d", i)
-		}
-	}
-	fmt.Fprintf(out, ")\n")
-	fmt.Fprintf(out, "}\n")
 }
 
 type mockGen struct {
@@ -390,18 +559,23 @@ type mockGen struct {
 	srcPath        string
 	mockByDefault  bool
 	mockPrototypes bool
+	unexported     bool
 	extFunctions   []string
 	callInits      bool
-	matchOS        bool
 	types          map[string]ast.Expr
+	typeParams     map[string]*ast.FieldList
 	recorders      map[string]string
 	data           io.ReaderAt
 	ifInfo         *ifInfo
 	scopes         map[string]bool
 	initCount      int
+	files          []*ast.File
+	checked        *pkgTypes
+	noSetters      []string
 	MOCK           string
 	EXPECT         string
 	ObjEXPECT      string
+	backend        backend
 }
 
 // MakePkg writes a mock version of the package found at srcPath into dstPath.
@@ -414,7 +588,12 @@ func MakePkg(srcPath, dstPath, pkgName string, mock bool, cfg *MockConfig) (impo
 		if strings.HasSuffix(info.Name(), "_test.go") {
 			return false
 		}
-		return strings.HasSuffix(info.Name(), ".go")
+		if !strings.HasSuffix(info.Name(), ".go") {
+			return false
+		}
+		// Reject files that the go command wouldn't build (based on both
+		// filename and build constraints).
+		return includeFile(srcPath, info.Name())
 	}
 
 	fset := token.NewFileSet()
@@ -444,12 +623,15 @@ func MakePkg(srcPath, dstPath, pkgName string, mock bool, cfg *MockConfig) (impo
 			continue
 		}
 		if entry.IsDir() {
-			imports.Set(filepath.Join(pkgName, name), importNoInstall, "")
+			imports.Set(filepath.Join(pkgName, name), srcPath, importNoInstall, "")
 			continue
 		}
 		if entry.IsDir() || strings.HasSuffix(name, ".go") {
 			continue
 		}
+		if isModuleFile(name) {
+			continue
+		}
 		if !strings.HasSuffix(name, ".s") && !strings.HasSuffix(name, ".c") {
 			nonGoFiles = append(nonGoFiles, name)
 			continue
@@ -462,46 +644,51 @@ func MakePkg(srcPath, dstPath, pkgName string, mock bool, cfg *MockConfig) (impo
 	interfaces := make(Interfaces)
 
 	for name, pkg := range pkgs {
+		// Each package needs a backend of it's own, as a backend may collect
+		// information about the package as it goes.
+		b, err := newBackend(cfg)
+		if err != nil {
+			return nil, Cerr{"newBackend", err}
+		}
+
 		m := &mockGen{
 			fset:           fset,
 			srcPath:        srcPath,
 			mockByDefault:  mock,
 			mockPrototypes: cfg.MockPrototypes,
+			unexported:     cfg.Unexported,
 			callInits:      !cfg.IgnoreInits,
-			matchOS:        cfg.MatchOSArch,
 			types:          make(map[string]ast.Expr),
+			typeParams:     make(map[string]*ast.FieldList),
 			recorders:      make(map[string]string),
 			ifInfo:         newIfInfo(filepath.Join(dstPath, name+"_ifmocks.go")),
 			MOCK:           cfg.MOCK,
 			EXPECT:         cfg.EXPECT,
 			ObjEXPECT:      cfg.ObjEXPECT,
+			backend:        b,
 		}
 
 		m.ifInfo.EXPECT = m.EXPECT
+		m.ifInfo.backend = m.backend
+
+		paths := make([]string, 0, len(pkg.Files))
+		for path := range pkg.Files {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
 
-		processed := 0
+		// The files are kept for type checking, if it turns out to be needed
+		for _, path := range paths {
+			m.files = append(m.files, pkg.Files[path])
+		}
 
-		for path, file := range pkg.Files {
+		for _, path := range paths {
+			file := pkg.Files[path]
 			base := filepath.Base(path)
 
 			srcFile := filepath.Join(srcPath, base)
 			filename := filepath.Join(dstPath, base)
 
-			// If only considering files for this OS/Arch, then reject files
-			// that aren't for this OS/Arch based on filename.
-			if cfg.MatchOSArch && !goodOSArchFile(base, nil) {
-				continue
-			}
-
-			// If only considering files for this OS/Arch, then reject files
-			// that aren't for this OS/Arch based on build constraint (also
-			// excludes files with an ignore build constraint).
-			if cfg.MatchOSArch && !goodOSArchConstraints(file) {
-				continue
-			}
-
-			processed++
-
 			out, err := os.Create(filename)
 			if err != nil {
 				return nil, Cerr{"os.Create", err}
@@ -514,22 +701,9 @@ func MakePkg(srcPath, dstPath, pkgName string, mock bool, cfg *MockConfig) (impo
 			}
 
 			for path := range i {
-				imports.Set(path, importNormal, "")
+				imports.Set(path, srcPath, importNormal, "")
 			}
 
-			/*
-				// TODO: we want to gofmt, goimports can break things ...
-				err = fixup(filename)
-				if err != nil {
-					return err
-				}
-			*/
-		}
-
-		// If we skipped over all the files for this package, then ignore it
-		// entirely.
-		if processed == 0 {
-			continue
 		}
 
 		filename := filepath.Join(dstPath, name+"_mock.go")
@@ -545,11 +719,9 @@ func MakePkg(srcPath, dstPath, pkgName string, mock bool, cfg *MockConfig) (impo
 			return nil, Cerr{"m.pkg", err}
 		}
 
-		// TODO: currently we need to use goimports to add missing imports, we
-		// need to sort out our own imports, then we can switch to gofmt.
-		err = fixup(filename)
+		err = formatFile(filename)
 		if err != nil {
-			return nil, Cerr{"fixup", err}
+			return nil, Cerr{"formatFile", err}
 		}
 
 		externalFunctions = append(externalFunctions, m.extFunctions...)
@@ -701,6 +873,12 @@ func (m *mockGen) exprString(exp ast.Expr) string {
 		return s
 	case *ast.IndexExpr:
 		return m.exprString(v.X) + "[" + m.exprString(v.Index) + "]"
+	case *ast.IndexListExpr:
+		indices := make([]string, len(v.Indices))
+		for i := range v.Indices {
+			indices[i] = m.exprString(v.Indices[i])
+		}
+		return m.exprString(v.X) + "[" + strings.Join(indices, ", ") + "]"
 	case *ast.InterfaceType:
 		if len(v.Methods.List) == 0 {
 			return "interface{}"
@@ -710,6 +888,11 @@ func (m *mockGen) exprString(exp ast.Expr) string {
 				s += "\t"
 				switch v := field.Type.(type) {
 				case *ast.FuncType:
+					if len(field.Names) == 0 {
+						// type set element
+						s += m.exprString(v)
+						break
+					}
 					s += field.Names[0].Name + "("
 					if v.Params != nil {
 						for i, param := range v.Params.List {
@@ -759,6 +942,12 @@ func (m *mockGen) exprString(exp ast.Expr) string {
 					s += m.exprString(v)
 				case *ast.Ident:
 					s += m.exprString(v)
+				case *ast.IndexExpr, *ast.IndexListExpr, *ast.UnaryExpr,
+					*ast.BinaryExpr, *ast.ArrayType, *ast.MapType,
+					*ast.ChanType, *ast.StructType, *ast.StarExpr,
+					*ast.ParenExpr, *ast.InterfaceType:
+					// embedded generic interface, or type set element
+					s += m.exprString(v)
 				default:
 					panic(fmt.Sprintf("Don't expect %T in interface", field.Type))
 				}
@@ -827,6 +1016,28 @@ func (m *mockGen) exprString(exp ast.Expr) string {
 	}
 }
 
+// typeParamStrings returns the type parameter list from fl as declared (e.g.
+// "[K comparable, V any]"), and as used to instantiate (e.g. "[K, V]").  Both
+// are empty if there are no type parameters.
+func (m *mockGen) typeParamStrings(fl *ast.FieldList) (string, string) {
+	if fl == nil || len(fl.List) == 0 {
+		return "", ""
+	}
+
+	params := make([]string, 0, len(fl.List))
+	args := []string{}
+	for _, f := range fl.List {
+		names := make([]string, len(f.Names))
+		for i, name := range f.Names {
+			names[i] = name.Name
+		}
+		params = append(params, strings.Join(names, ", ")+" "+m.exprString(f.Type))
+		args = append(args, names...)
+	}
+
+	return "[" + strings.Join(params, ", ") + "]", "[" + strings.Join(args, ", ") + "]"
+}
+
 func (m *mockGen) registerScope(scope string) {
 	if m.scopes != nil {
 		m.scopes[scope] = true
@@ -842,84 +1053,212 @@ func (m *mockGen) getScopes() []string {
 	for scope := range m.scopes {
 		scopes = append(scopes, scope)
 	}
+	sort.Strings(scopes)
 	m.scopes = nil
 	return scopes
 }
 
-func fixup(filename string) error {
-	cmd := exec.Command("goimports", "-w", filename)
-	out, err := cmd.CombinedOutput()
+// formatFile runs the contents of filename through gofmt.
+func formatFile(filename string) error {
+	src, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return fmt.Errorf("Failed to run gofmt on '%s': %s\noutput:\n%s",
-			filename, err, out)
+		return Cerr{"ReadFile", err}
 	}
-	return nil
+
+	out, err := format.Source(src)
+	if err != nil {
+		return fmt.Errorf("Failed to run gofmt on '%s': %s", filename, err)
+	}
+
+	return ioutil.WriteFile(filename, out, 0600)
 }
 
-func (m *mockGen) pkg(out io.Writer, name string) error {
+// writeGenerated writes the generated code in body to filename, as package
+// name.  body uses the packages in imports (name to import path), and the
+// packages in dot using dot imports.  The result is run through gofmt.
+func writeGenerated(filename, name string, body []byte, imports map[string]string, dot ...string) error {
+	names := make([]string, 0, len(imports))
+	for n := range imports {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	out := &bytes.Buffer{}
 	fmt.Fprintf(out, "package %s\n\n", name)
+	if len(names)+len(dot) > 0 {
+		fmt.Fprintf(out, "import (\n")
+		for _, impPath := range dot {
+			fmt.Fprintf(out, "\t. %q\n", impPath)
+		}
+		for _, n := range names {
+			fmt.Fprintf(out, "\t%s %q\n", n, imports[n])
+		}
+		fmt.Fprintf(out, ")\n\n")
+	}
+	out.Write(body)
+
+	code, err := format.Source(out.Bytes())
+	if err != nil {
+		return fmt.Errorf("Failed to run gofmt on '%s': %s", filename, err)
+	}
 
-	fmt.Fprintf(out, "import \"code.google.com/p/gomock/gomock\"\n\n")
+	return ioutil.WriteFile(filename, code, 0600)
+}
 
-	fmt.Fprintf(out, "type _meta struct{}\n")
-	fmt.Fprintf(out, "type _packageMock struct{int}\n")
-	fmt.Fprintf(out, "type _package_Rec struct{\n")
-	fmt.Fprintf(out, "\tmock *_packageMock\n")
+// spy writes the methods of the meta type used to spy on functions, and the
+// functions used by the generated code to record the calls.
+func (m *mockGen) spy(out io.Writer) {
+	// A spied function calls the real version, even if mocking is enabled for
+	// the package - unless it has been enabled for that function.
+	fmt.Fprintf(out, "func _spying(name string) (spying bool) {\n")
+	fmt.Fprintf(out, "\t_read(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\tspying = s.spiedMocks[name] || (s.spyAll && "+
+		"!s.enabledMocks[name] && !s.disabledMocks[name])\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "\treturn\n")
 	fmt.Fprintf(out, "}\n\n")
 
-	fmt.Fprintf(out, "var (\n")
-	fmt.Fprintf(out, "\t_allMocked = false\n")
-	fmt.Fprintf(out, "\t_enabledMocks = make(map[string]bool)\n")
-	fmt.Fprintf(out, "\t_disabledMocks = make(map[string]bool)\n")
-	fmt.Fprintf(out, "\t_ctrl *gomock.Controller\n")
-	fmt.Fprintf(out, "\t_pkgMock = &_packageMock{}\n")
-	fmt.Fprintf(out, ")\n\n")
+	fmt.Fprintf(out, "func _spyStart(recv interface{}, args ...interface{}) *_spyCall {\n")
+	fmt.Fprintf(out, "\treturn &_spyCall{Recv: recv, Args: args, Start: _time.Now()}\n")
+	fmt.Fprintf(out, "}\n\n")
 
-	fmt.Fprintf(out, "func callInits(inits ...func()) {\n")
-	fmt.Fprintf(out, "\tmocked := _allMocked\n")
-	fmt.Fprintf(out, "\tenabledMocks := _enabledMocks\n")
-	fmt.Fprintf(out, "\t_allMocked = false\n")
-	fmt.Fprintf(out, "\t_enabledMocks = nil\n")
-	fmt.Fprintf(out, "\tfor _, f := range inits {\n")
-	fmt.Fprintf(out, "\t\tf()\n")
+	// The call is only recorded once it's finished, so that the results can't
+	// change once Calls has returned it.
+	fmt.Fprintf(out, "func _spyEnd(name string, c *_spyCall, p interface{}) {\n")
+	fmt.Fprintf(out, "\tc.Duration = _time.Since(c.Start)\n")
+	fmt.Fprintf(out, "\tc.Panic = p\n")
+	fmt.Fprintf(out, "\t_write(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\ts.calls[name] = append(s.calls[name], c)\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "\tif p != nil {\n")
+	fmt.Fprintf(out, "\t\tpanic(p)\n")
 	fmt.Fprintf(out, "\t}\n")
-	fmt.Fprintf(out, "\t_allMocked = mocked\n")
-	fmt.Fprintf(out, "\t_enabledMocks = enabledMocks\n")
 	fmt.Fprintf(out, "}\n\n")
 
-	fmt.Fprintf(out, "func %s() *_meta {\n", m.MOCK)
-	fmt.Fprintf(out, "\treturn nil\n")
-	fmt.Fprintf(out, "}\n")
-
-	fmt.Fprintf(out, "func (_ *_meta) SetController(controller *gomock.Controller) {\n")
-	fmt.Fprintf(out, "\t_ctrl = controller\n")
-	fmt.Fprintf(out, "}\n")
+	fmt.Fprintf(out, "func (_ *_meta) SpyAll(enabled bool) {\n")
+	fmt.Fprintf(out, "\t_write(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\ts.spyAll = enabled\n")
+	fmt.Fprintf(out, "\t\ts.spiedMocks = make(map[string]bool)\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "}\n\n")
 
-	fmt.Fprintf(out, "func (_ *_meta) MockAll(enabled bool) {\n")
-	fmt.Fprintf(out, "\t_allMocked = enabled\n")
-	fmt.Fprintf(out, "\t_enabledMocks = make(map[string]bool)\n")
-	fmt.Fprintf(out, "\t_disabledMocks = make(map[string]bool)\n")
-	fmt.Fprintf(out, "}\n")
+	fmt.Fprintf(out, "func (_ *_meta) Spy(names ...string) {\n")
+	fmt.Fprintf(out, "\t_write(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\tfor _, name := range names {\n")
+	fmt.Fprintf(out, "\t\t\ts.spiedMocks[name] = true\n")
+	fmt.Fprintf(out, "\t\t\tdelete(s.enabledMocks, name)\n")
+	fmt.Fprintf(out, "\t\t\tdelete(s.disabledMocks, name)\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "}\n\n")
 
-	fmt.Fprintf(out, "func (_ *_meta) EnableMock(names ...string) {\n")
-	fmt.Fprintf(out, "\tfor _, name := range names {\n")
-	fmt.Fprintf(out, "\t\t_enabledMocks[name] = true\n")
-	fmt.Fprintf(out, "\t\tdelete(_disabledMocks, name)\n")
-	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "func (_ *_meta) Calls(name string) (calls []*_spyCall) {\n")
+	fmt.Fprintf(out, "\t_read(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\tcalls = append(calls, s.calls[name]...)\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "\treturn\n")
 	fmt.Fprintf(out, "}\n\n")
 
-	fmt.Fprintf(out, "func (_ *_meta) DisableMock(names ...string) {\n")
-	fmt.Fprintf(out, "\tfor _, name := range names {\n")
-	fmt.Fprintf(out, "\t\t_disabledMocks[name] = true\n")
-	fmt.Fprintf(out, "\t\tdelete(_enabledMocks, name)\n")
-	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "func (_ *_meta) ClearCalls() {\n")
+	fmt.Fprintf(out, "\t_write(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\ts.calls = make(map[string][]*_spyCall)\n")
+	fmt.Fprintf(out, "\t})\n")
 	fmt.Fprintf(out, "}\n\n")
+}
+
+// pkgImports are the imports used by the package file, given names that won't
+// clash with the package's own imports.
+var pkgImports = [][2]string{
+	{"_bytes", "bytes"},
+	{"_json", "encoding/json"},
+	{"_errors", "errors"},
+	{"_fmt", "fmt"},
+	{"_os", "os"},
+	{"_filepath", "path/filepath"},
+	{"_reflect", "reflect"},
+	{"_runtime", "runtime"},
+	{"_sort", "sort"},
+	{"_strconv", "strconv"},
+	{"_strings", "strings"},
+	{"_sync", "sync"},
+	{"_time", "time"},
+	{"_unsafe", "unsafe"},
+}
+
+func (m *mockGen) pkg(out io.Writer, name string) error {
+	fmt.Fprintf(out, "package %s\n\n", name)
+
+	// The backend may already import some of the packages that we need
+	imports := &bytes.Buffer{}
+	m.backend.writeImports(imports)
+	out.Write(imports.Bytes())
+
+	for _, imp := range pkgImports {
+		line := fmt.Sprintf("import %s %q\n\n", imp[0], imp[1])
+		if !strings.Contains(imports.String(), line) {
+			fmt.Fprint(out, line)
+		}
+	}
+
+	used := make(map[string]string)
+	if err := m.backend.addPkgImports(used); err != nil {
+		return Cerr{"addPkgImports", err}
+	}
+	names := make([]string, 0, len(used))
+	for name := range used {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "import %s %q\n\n", name, used[name])
+	}
+
+	// Explain why the test can't set some variables, rather than leaving the
+	// setters to just be missing
+	if len(m.noSetters) > 0 {
+		fmt.Fprintf(out, "// Variables without setters:\n")
+		for _, reason := range m.noSetters {
+			fmt.Fprintf(out, "//\t%s\n", reason)
+		}
+		fmt.Fprintf(out, "\n")
+	}
 
-	fmt.Fprintf(out, "func %s() *_package_Rec {\n", m.EXPECT)
-	fmt.Fprintf(out, "\treturn &_package_Rec{_pkgMock}\n")
+	fmt.Fprintf(out, "type _meta %s\n", m.backend.metaType())
+	fmt.Fprintf(out, "type _packageMock struct{int}\n\n")
+
+	// A call to a function (or method) that was spied on
+	fmt.Fprintf(out, "type _spyCall struct {\n")
+	fmt.Fprintf(out, "\tRecv interface{}\n")
+	fmt.Fprintf(out, "\tArgs []interface{}\n")
+	fmt.Fprintf(out, "\tResults []interface{}\n")
+	fmt.Fprintf(out, "\tPanic interface{}\n")
+	fmt.Fprintf(out, "\tStart _time.Time\n")
+	fmt.Fprintf(out, "\tDuration _time.Duration\n")
 	fmt.Fprintf(out, "}\n\n")
 
-	for base, rec := range m.recorders {
+	fmt.Fprintf(out, "var (\n")
+	m.backend.writeState(out)
+	fmt.Fprintf(out, "\t_pkgMock = &_packageMock{}\n")
+	fmt.Fprintf(out, ")\n\n")
+
+	m.scope(out)
+
+	m.backend.writeMeta(out, m.MOCK)
+
+	m.spy(out)
+	m.tape(out)
+	m.snapshot(out)
+
+	m.backend.writePkgRecorder(out, m.EXPECT)
+
+	bases := make([]string, 0, len(m.recorders))
+	for base := range m.recorders {
+		bases = append(bases, base)
+	}
+	sort.Strings(bases)
+
+	for _, base := range bases {
+		rec := m.recorders[base]
 		if _, found := m.recorders[base[1:]]; base[0] == '*' && found {
 			// If pointer and non-pointer receiver, just use the non-pointer
 			continue
@@ -934,8 +1273,11 @@ func (m *mockGen) pkg(out io.Writer, name string) error {
 			retType = "*" + mock
 			mod = "&"
 		}
+		params, args := m.typeParamStrings(m.typeParams[name])
 		_, isInterface := m.types[name].(*ast.InterfaceType)
-		if !isInterface && !ast.IsExported(name) {
+		if !isInterface && !ast.IsExported(name) && params == "" {
+			// (a method can't have type parameters, so we can't provide
+			// New for generic types)
 			fmt.Fprintf(out, "type %s struct {\n", mock)
 			fmt.Fprintf(out, "\t%s\n", name)
 			fmt.Fprintf(out, "}\n")
@@ -944,18 +1286,18 @@ func (m *mockGen) pkg(out io.Writer, name string) error {
 			fmt.Fprintf(out, "\treturn %s%s{}\n", mod, mock)
 			fmt.Fprintf(out, "}\n\n")
 		}
-		fmt.Fprintf(out, "type %s struct {\n", rec)
-		fmt.Fprintf(out, "\tmock %s\n", base)
-		fmt.Fprintf(out, "}\n\n")
-		fmt.Fprintf(out, "func (_m %s) %s() *%s {\n", base, m.ObjEXPECT, rec)
-		fmt.Fprintf(out, "\treturn &%s{_m}\n", rec)
-		fmt.Fprintf(out, "}\n\n")
+		m.backend.writeTypeRecorder(out, base, rec, params, args, m.ObjEXPECT)
 	}
 
+	m.backend.writeUsed(out)
+
 	return nil
 }
 
-var pkgNames = map[string]string{}
+var (
+	pkgNames = map[string]string{}
+	pkgDirs  = map[string]string{}
+)
 
 func getPackageName(impPath, srcPath string) (string, error) {
 	// Special case for the magic "C" package
@@ -965,11 +1307,19 @@ func getPackageName(impPath, srcPath string) (string, error) {
 
 	name, found := pkgNames[impPath]
 	if found {
+		recordDep(pkgDirs[impPath])
 		return name, nil
 	}
 
 	cache := true
-	lookupPath := impPath
+	lookupPath, err := vendoredImport(impPath, srcPath)
+	if err != nil {
+		return "", err
+	}
+	if lookupPath != impPath {
+		// vendored copy, which may not match other imports of impPath
+		cache = false
+	}
 
 	if strings.HasPrefix(impPath, "./") {
 		// relative import, no caching, need to change directory
@@ -997,18 +1347,106 @@ func getPackageName(impPath, srcPath string) (string, error) {
 		lookupPath = "."
 	}
 
-	name, err := GetOutput("go", "list", "-f", "{{.Name}}", lookupPath)
+	out, err := GetOutput("go", "list", "-f", "{{.Name}} {{.Dir}}", lookupPath)
 	if err != nil {
 		return "", fmt.Errorf("Failed to get name for '%s': %s", impPath, err)
 	}
 
+	name, dir := out, ""
+	if i := strings.Index(out, " "); i >= 0 {
+		name, dir = out[:i], out[i+1:]
+	}
+
+	recordDep(dir)
+
 	if cache {
 		pkgNames[impPath] = name
+		pkgDirs[impPath] = dir
 	}
 
 	return name, nil
 }
 
+// metaSetters are the names that can't be given a setter, as the meta type
+// already has a method called Set<name>.
+var metaSetters = map[string]bool{
+	"Codec":      true,
+	"Controller": true,
+}
+
+// writeSetters writes the methods of the meta type used to set the exported
+// variables declared by d, which put the old value back when the test
+// finishes.  A variable whose type can't be found doesn't get a setter, which
+// is noted in the package file - but doesn't stop the mock being generated.
+func (m *mockGen) writeSetters(out io.Writer, d *ast.GenDecl, imports map[string]string) {
+	for _, spec := range d.Specs {
+		s := spec.(*ast.ValueSpec)
+		for _, ident := range s.Names {
+			if !ident.IsExported() || metaSetters[ident.Name] {
+				continue
+			}
+			t, err := m.varType(s, ident, imports)
+			if err != nil {
+				m.noSetters = append(m.noSetters,
+					fmt.Sprintf("%s: %s", ident.Name, err))
+				continue
+			}
+			fmt.Fprintf(out, "func (_ *_meta) Set%s(_v %s) {\n", ident.Name, t)
+			fmt.Fprintf(out, "\t_old := %s\n", ident.Name)
+			fmt.Fprintf(out, "\t_cleanup(\"Set%s\")(func() {\n", ident.Name)
+			fmt.Fprintf(out, "\t\t%s = _old\n", ident.Name)
+			fmt.Fprintf(out, "\t})\n")
+			fmt.Fprintf(out, "\t%s = _v\n", ident.Name)
+			fmt.Fprintf(out, "}\n\n")
+		}
+	}
+}
+
+// mockUnexported returns true if the unexported function (or method) fi,
+// declared by d, should be mocked.  As the test code can only set expectations
+// through the meta type, generic functions (and methods of generic types) are
+// left alone - along with init, and functions without bodies.
+func (m *mockGen) mockUnexported(fi *funcInfo, d *ast.FuncDecl) bool {
+	if !m.unexported || d.Body == nil || fi.IsGeneric() {
+		return false
+	}
+	if fi.name == "init" && !fi.IsMethod() {
+		return false
+	}
+	return fi.name != "_" && !strings.Contains(fi.recv.expr, "[")
+}
+
+// writeVars adds the variables declared by d to the variables saved by
+// MOCK().Snapshot().
+func (m *mockGen) writeVars(out io.Writer, d *ast.GenDecl) {
+	vars := []string{}
+	for _, spec := range d.Specs {
+		for _, ident := range spec.(*ast.ValueSpec).Names {
+			if ident.Name != "_" {
+				vars = append(vars, "&"+ident.Name)
+			}
+		}
+	}
+	if len(vars) > 0 {
+		fmt.Fprintf(out, "var _ = _addVars(%s)\n\n", strings.Join(vars, ", "))
+	}
+}
+
+// varType returns the type of the variable ident declared by s, as it can be
+// written in a file with the given imports.  If the type isn't given by the
+// declaration, then the package is type checked to find it.
+func (m *mockGen) varType(s *ast.ValueSpec, ident *ast.Ident, imports map[string]string) (string, error) {
+	if s.Type != nil {
+		return m.exprString(s.Type), nil
+	}
+
+	if m.checked == nil {
+		m.checked = checkTypes(m.fset, m.srcPath, m.files)
+	}
+
+	return m.checked.typeString(ident, imports)
+}
+
 func (m *mockGen) file(out io.Writer, f *ast.File, filename string) (map[string]bool, error) {
 	data, err := os.Open(filename)
 	if err != nil {
@@ -1021,16 +1459,12 @@ func (m *mockGen) file(out io.Writer, f *ast.File, filename string) (map[string]
 
 	buildTags := false
 
-	if len(f.Comments) > 0 {
-		for _, cg := range f.Comments {
-			if strings.HasPrefix(cg.Text(), "+build") {
-				buildTags = true
-				for _, c := range cg.List {
-					fmt.Fprintf(out, "%s\n", c.Text)
-				}
-				fmt.Fprintf(out, "\n")
-			}
+	if lines := buildConstraints(f); len(lines) > 0 {
+		buildTags = true
+		for _, line := range lines {
+			fmt.Fprintf(out, "%s\n", line)
 		}
+		fmt.Fprintf(out, "\n")
 	}
 
 	if f.Doc != nil {
@@ -1044,7 +1478,7 @@ func (m *mockGen) file(out io.Writer, f *ast.File, filename string) (map[string]
 
 	fmt.Fprintf(out, "package %s\n\n", f.Name)
 
-	fmt.Fprintf(out, "import \"code.google.com/p/gomock/gomock\"\n\n")
+	m.backend.writeImports(out)
 
 	for _, decl := range f.Decls {
 		switch d := decl.(type) {
@@ -1057,7 +1491,7 @@ func (m *mockGen) file(out io.Writer, f *ast.File, filename string) (map[string]
 				if len(d.Specs) == 1 {
 					s := d.Specs[0].(*ast.ImportSpec)
 					impPath := strings.Trim(s.Path.Value, "\"")
-					if impPath == "code.google.com/p/gomock/gomock" {
+					if m.backend.skipImport(impPath) {
 						continue
 					}
 					if s.Doc != nil {
@@ -1087,7 +1521,7 @@ func (m *mockGen) file(out io.Writer, f *ast.File, filename string) (map[string]
 				for _, spec := range d.Specs {
 					s := spec.(*ast.ImportSpec)
 					impPath := strings.Trim(s.Path.Value, "\"")
-					if impPath == "code.google.com/p/gomock/gomock" {
+					if m.backend.skipImport(impPath) {
 						continue
 					}
 					fmt.Fprintf(out, "\t")
@@ -1114,15 +1548,19 @@ func (m *mockGen) file(out io.Writer, f *ast.File, filename string) (map[string]
 				// We can't ignore private types, as we might be using them.
 				if len(d.Specs) == 1 {
 					t := d.Specs[0].(*ast.TypeSpec)
-					fmt.Fprintf(out, "type %s %s\n\n", t.Name, m.exprString(t.Type))
+					params, _ := m.typeParamStrings(t.TypeParams)
+					fmt.Fprintf(out, "type %s%s %s\n\n", t.Name, params, m.exprString(t.Type))
 					m.types[t.Name.String()] = t.Type
+					m.typeParams[t.Name.String()] = t.TypeParams
 					m.ifInfo.addType(t, imports)
 				} else {
 					fmt.Fprintf(out, "type (\n")
 					for i := range d.Specs {
 						t := d.Specs[i].(*ast.TypeSpec)
-						fmt.Fprintf(out, "\t%s %s\n", t.Name, m.exprString(t.Type))
+						params, _ := m.typeParamStrings(t.TypeParams)
+						fmt.Fprintf(out, "\t%s%s %s\n", t.Name, params, m.exprString(t.Type))
 						m.types[t.Name.String()] = t.Type
+						m.typeParams[t.Name.String()] = t.TypeParams
 						m.ifInfo.addType(t, imports)
 					}
 					fmt.Fprintf(out, ")\n\n")
@@ -1149,6 +1587,8 @@ func (m *mockGen) file(out io.Writer, f *ast.File, filename string) (map[string]
 					fmt.Fprintf(out, "\n")
 				}
 				fmt.Fprintf(out, ")\n\n")
+				m.writeSetters(out, d, imports)
+				m.writeVars(out, d)
 			case token.CONST:
 				fmt.Fprintf(out, "const (\n")
 				for _, spec := range d.Specs {
@@ -1174,23 +1614,34 @@ func (m *mockGen) file(out io.Writer, f *ast.File, filename string) (map[string]
 				fmt.Fprintf(out, "--- unknown GenDecl Token: %v\n", d.Tok)
 			}
 		case *ast.FuncDecl:
-			fi := &funcInfo{name: d.Name.String()}
+			fi := &funcInfo{name: d.Name.String(), imports: imports}
 			docstring := d.Doc.Text()
 			if strings.HasPrefix(docstring, "export ") {
 				fi.export = strings.TrimSpace(docstring[7:])
 			}
+			fi.typeParams, fi.typeArgs = m.typeParamStrings(d.Type.TypeParams)
 			recorder := "_package_Rec"
+			if fi.IsGeneric() {
+				recorder = fmt.Sprintf("_%s_Rec%s", fi.name, fi.typeArgs)
+			}
 			if d.Recv != nil {
 				if len(d.Recv.List[0].Names) > 0 {
 					fi.recv.name = d.Recv.List[0].Names[0].String()
 				}
 				t := m.exprString(d.Recv.List[0].Type)
 				fi.recv.expr = t
-				recorder = fmt.Sprintf("_%s_Rec", t)
-				if s, ok := d.Recv.List[0].Type.(*ast.StarExpr); ok {
-					recorder = fmt.Sprintf("_%s_Rec", m.exprString(s.X))
+
+				// The recorder is shared by all the methods of the type, so
+				// we key it without the type arguments - which can be named
+				// differently by each method.
+				base := baseTypeName(t)
+				key := base
+				if t[0] == '*' {
+					key = "*" + base
 				}
-				m.recorders[t] = recorder
+				recorder = fmt.Sprintf("_%s_Rec", base)
+				m.recorders[key] = recorder
+				recorder += strings.TrimPrefix(t, key)
 			}
 			for _, param := range d.Type.Params.List {
 				p := field{
@@ -1225,6 +1676,8 @@ func (m *mockGen) file(out io.Writer, f *ast.File, filename string) (map[string]
 				}
 			}
 
+			fi.mocked = d.Name.IsExported() || m.mockUnexported(fi, d)
+
 			if fi.name == "init" && !fi.IsMethod() {
 				fi.name = fmt.Sprintf("_real_init_%d", m.initCount)
 				fi.writeReal(out)
@@ -1237,12 +1690,18 @@ func (m *mockGen) file(out io.Writer, f *ast.File, filename string) (map[string]
 			} else {
 				fi.writeReal(out)
 			}
-			if d.Name.IsExported() {
+			if fi.mocked {
 				if d.Body == nil {
 					m.extFunctions = append(m.extFunctions, d.Name.Name)
 				}
-				fi.writeMock(out)
-				fi.writeRecorder(out, recorder)
+				fi.writeMock(out, m.backend)
+				if fi.IsGeneric() {
+					m.backend.writeExpect(out, fi, m.EXPECT)
+				}
+				m.backend.writeRecorder(out, fi, recorder)
+				if !d.Name.IsExported() {
+					m.backend.writeMetaRecorder(out, fi, m.EXPECT, m.ObjEXPECT)
+				}
 			}
 			fmt.Fprintf(out, "\n")
 		default:
@@ -1250,16 +1709,16 @@ func (m *mockGen) file(out io.Writer, f *ast.File, filename string) (map[string]
 		}
 	}
 
-	fmt.Fprintf(out, "\n// Make sure gomock is used\n")
-	fmt.Fprintf(out, "var _ = gomock.Any()\n")
+	m.backend.writeUsed(out)
 
 	fmt.Fprintf(out, "\n// Make sure inits are called\n")
 	fmt.Fprintf(out, "func init() {\n")
 	fmt.Fprintf(out, "\tcallInits(%s)\n", strings.Join(inits, ", "))
 	fmt.Fprintf(out, "}\n")
 
-	i := map[string]bool{
-		"code.google.com/p/gomock/gomock": false,
+	i := make(map[string]bool)
+	if path := m.backend.importPath(); path != "" {
+		i[path] = false
 	}
 
 	for _, impPath := range imports {
@@ -1277,6 +1736,7 @@ func loadInterfaceInfo(impPath string) (*ifInfo, error) {
 
 	imports := make(map[string]string)
 	ifInfo := newIfInfo("")
+	ifInfo.impPath = impPath
 
 	isGoFile := func(info os.FileInfo) bool {
 		if info.IsDir() {
@@ -1285,9 +1745,14 @@ func loadInterfaceInfo(impPath string) (*ifInfo, error) {
 		if strings.HasSuffix(info.Name(), "_test.go") {
 			return false
 		}
-		return strings.HasSuffix(info.Name(), ".go")
+		if !strings.HasSuffix(info.Name(), ".go") {
+			return false
+		}
+		return includeFile(path, info.Name())
 	}
 
+	recordDep(path)
+
 	fset := token.NewFileSet()
 	pkgs, err := parser.ParseDir(fset, path, isGoFile, 0)
 	if err != nil {
@@ -1325,10 +1790,33 @@ func loadInterfaceInfo(impPath string) (*ifInfo, error) {
 	return ifInfo, nil
 }
 
-func MockInterfaces(tmpPath, pkgName string, cfg *MockConfig) error {
+// MockInterfaces writes mock implementations of the interfaces in pkgName into
+// a _mocks_ package inside tmpPath.  The mocks access the package as extPkg.
+func MockInterfaces(tmpPath, pkgName, extPkg string, self bool, cfg *MockConfig) error {
+	dst := filepath.Join(tmpPath, "src", pkgName, "_mocks_")
+
+	// A dot import would clash with the mock types in the package, if the
+	// code under test has been mocked too.
+	scope := ""
+	if self {
+		path, err := LookupImportPath(pkgName)
+		if err != nil {
+			return err
+		}
+		scope, err = getPackageName(pkgName, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return mockInterfaces(dst, pkgName, extPkg, scope, cfg)
+}
+
+// mockInterfaces writes mock implementations of the interfaces in pkgName into
+// dst, using scope to access the package (or a dot import if scope is empty).
+func mockInterfaces(dst, pkgName, extPkg, scope string, cfg *MockConfig) error {
 	i := make(Interfaces)
 
-	dst := filepath.Join(tmpPath, "src", pkgName, "_mocks_")
 	err := os.MkdirAll(dst, 0700)
 	if err != nil {
 		return err
@@ -1353,16 +1841,14 @@ func MockInterfaces(tmpPath, pkgName string, cfg *MockConfig) error {
 
 	info.EXPECT = cfg.EXPECT
 
-	i[name+"_mocks"] = info
-	extPkg := markImport(pkgName, testMark)
-
-	if err := i.genExtInterface(name+"_mocks", extPkg); err != nil {
+	info.backend, err = newBackend(cfg)
+	if err != nil {
 		return err
 	}
 
-	// TODO: currently we need to use goimports to add missing imports, we
-	// need to sort out our own imports, then we can switch to gofmt.
-	if err := fixup(info.filename); err != nil {
+	i[name+"_mocks"] = info
+
+	if err := i.genExtInterface(name+"_mocks", extPkg, scope); err != nil {
 		return err
 	}
 
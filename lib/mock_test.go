@@ -54,11 +54,14 @@ func process(filename, goPath string) error {
 	}
 
 	m := &mockGen{
-		fset:      fset,
-		srcPath:   filepath.Dir(filename),
-		types:     make(map[string]ast.Expr),
-		recorders: make(map[string]string),
-		ifInfo:    newIfInfo("_ifmocks.go"),
+		fset:       fset,
+		srcPath:    filepath.Dir(filename),
+		files:      []*ast.File{file},
+		types:      make(map[string]ast.Expr),
+		typeParams: make(map[string]*ast.FieldList),
+		recorders:  make(map[string]string),
+		ifInfo:     newIfInfo("_ifmocks.go"),
+		backend:    gomockBackend{gomockPaths[0]},
 	}
 	data := &bytes.Buffer{}
 
@@ -142,3 +145,285 @@ func TestMockFile(t *testing.T) {
 
 	os.Setenv("GOPATH", goPath)
 }
+
+const deterministicSrc = `package ext
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+type Alpha struct{}
+type Beta struct{}
+type Gamma struct{}
+type Delta[T any] struct{ v T }
+
+func (a Alpha) A() int             { return 0 }
+func (b *Beta) B(w io.Writer) error { return nil }
+func (g Gamma) G() time.Duration    { return 0 }
+func (g *Gamma) H()                 {}
+func (d *Delta[T]) D() T            { return d.v }
+
+type Reader interface {
+	io.Reader
+	Wait(time.Duration)
+}
+
+type Handler interface {
+	Handle(http.ResponseWriter, *http.Request) error
+}
+
+type Closer interface {
+	io.Closer
+	error
+}
+
+func Open(name string) (Reader, error) { return nil, nil }
+func Map[T, U any](in []T, f func(T) U) []U { return nil }
+`
+
+func readTree(t *testing.T, dir string) map[string][]byte {
+	files := make(map[string][]byte)
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %s", dir, err)
+	}
+
+	for _, entry := range entries {
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %s", entry.Name(), err)
+		}
+		files[entry.Name()] = data
+	}
+
+	return files
+}
+
+func TestMakePkgDeterministic(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "withmock-test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcPath := filepath.Join(tmpDir, "src", "ext")
+	if err := os.MkdirAll(srcPath, 0700); err != nil {
+		t.Fatalf("Failed to create source directory: %s", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(srcPath, "ext.go"),
+		[]byte(deterministicSrc), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write source: %s", err)
+	}
+
+	// Resolve imports using GOPATH, with the temp directory as GOPATH
+	defer os.Setenv("GOPATH", os.Getenv("GOPATH"))
+	defer os.Setenv("GO111MODULE", os.Getenv("GO111MODULE"))
+	os.Setenv("GOPATH", tmpDir)
+	os.Setenv("GO111MODULE", "off")
+
+	cfg := (&Config{}).Mock("ext")
+
+	// Generate the package several times, the output should be identical
+	// every time.
+	var first map[string][]byte
+	for i := 0; i < 5; i++ {
+		dstPath := filepath.Join(tmpDir, "dst")
+		if err := os.MkdirAll(dstPath, 0700); err != nil {
+			t.Fatalf("Failed to create output directory: %s", err)
+		}
+
+		if _, err := MakePkg(srcPath, dstPath, "ext", true, cfg); err != nil {
+			t.Fatalf("MakePkg failed: %s", err)
+		}
+
+		files := readTree(t, dstPath)
+		if first == nil {
+			first = files
+		} else if len(files) != len(first) {
+			t.Fatalf("Got %d files, expected %d", len(files), len(first))
+		}
+
+		for name, data := range files {
+			if !bytes.Equal(data, first[name]) {
+				t.Errorf("Output for %s differs on run %d:\n%s\n---\n%s",
+					name, i+1, first[name], data)
+			}
+		}
+
+		if err := os.RemoveAll(dstPath); err != nil {
+			t.Fatalf("Failed to remove output directory: %s", err)
+		}
+	}
+}
+
+func TestMakePkgImports(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// other embeds an interface that uses b/rand, while ext has it's own
+	// rand package.
+	files := map[string]string{
+		"a/rand/rand.go": "package rand\n\ntype T int\n",
+		"b/rand/rand.go": "package rand\n\ntype T string\n",
+		"other/other.go": "package other\n\nimport \"b/rand\"\n\n" +
+			"type I interface {\n\tGet() rand.T\n}\n",
+		"ext/ext.go": "package ext\n\nimport (\n\t\"a/rand\"\n\t\"other\"\n)\n\n" +
+			"type X interface {\n\tother.I\n}\n\n" +
+			"func F() rand.T { return 0 }\n",
+		"clash/clash.go": "package clash\n\nimport (\n\t\"a/rand\"\n\t\"other\"\n)\n\n" +
+			"type X interface {\n\tother.I\n\tPut(rand.T)\n}\n",
+	}
+	for name, src := range files {
+		path := filepath.Join(tmpDir, "src", name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer os.Setenv("GOPATH", os.Getenv("GOPATH"))
+	defer os.Setenv("GO111MODULE", os.Getenv("GO111MODULE"))
+	os.Setenv("GOPATH", tmpDir)
+	os.Setenv("GO111MODULE", "off")
+
+	makePkg := func(name string) (string, error) {
+		dstPath := filepath.Join(tmpDir, "dst", name)
+		if err := os.MkdirAll(dstPath, 0700); err != nil {
+			t.Fatal(err)
+		}
+		srcPath := filepath.Join(tmpDir, "src", name)
+		_, err := MakePkg(srcPath, dstPath, name, true, (&Config{}).Mock(name))
+		if err != nil {
+			return "", err
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dstPath, name+"_ifmocks.go"))
+		return string(data), err
+	}
+
+	code, err := makePkg("ext")
+	if err != nil {
+		t.Fatalf("MakePkg failed: %s", err)
+	}
+	if !strings.Contains(code, "rand \"b/rand\"") || strings.Contains(code, "\"a/rand\"") {
+		t.Errorf("Expected only b/rand to be imported:\n%s", code)
+	}
+	if strings.Contains(code, "\"other\"") {
+		t.Errorf("Unused import of other:\n%s", code)
+	}
+
+	if _, err := makePkg("clash"); err == nil || !strings.Contains(err.Error(), "rand") {
+		t.Errorf("Expected an error for rand, got: %v", err)
+	}
+}
+
+func TestMakePkgVarSetters(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	files := map[string]string{
+		"other/other.go": "package other\n\ntype T struct{ N int }\n\n" +
+			"type hidden int\n\n" +
+			"func New() *T { return &T{} }\n\n" +
+			"func Hidden() hidden { return 0 }\n",
+		"vars/vars.go": "package vars\n\nimport (\n\t\"errors\"\n\t\"other\"\n)\n\n" +
+			"var (\n\tA = other.New()\n\tB = A\n\tC = other.T{N: 1}\n" +
+			"\tD = errors.New(\"d\")\n\tE = other.Hidden()\n)\n",
+	}
+	for name, src := range files {
+		path := filepath.Join(tmpDir, "src", name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer os.Setenv("GOPATH", os.Getenv("GOPATH"))
+	defer os.Setenv("GO111MODULE", os.Getenv("GO111MODULE"))
+	os.Setenv("GOPATH", tmpDir)
+	os.Setenv("GO111MODULE", "off")
+
+	dstPath := filepath.Join(tmpDir, "dst", "vars")
+	if err := os.MkdirAll(dstPath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	srcPath := filepath.Join(tmpDir, "src", "vars")
+	if _, err := MakePkg(srcPath, dstPath, "vars", true, (&Config{}).Mock("vars")); err != nil {
+		t.Fatalf("MakePkg failed: %s", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dstPath, "vars.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := string(data)
+
+	for _, setter := range []string{"SetA(_v *other.T)", "SetB(_v *other.T)",
+		"SetC(_v other.T)", "SetD(_v error)"} {
+		if !strings.Contains(code, setter) {
+			t.Errorf("Expected %s:\n%s", setter, code)
+		}
+	}
+	if strings.Contains(code, "SetE(") {
+		t.Errorf("Unexpected setter for E:\n%s", code)
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(dstPath, "vars_mock.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "//\tE: type other.hidden isn't exported\n") {
+		t.Errorf("Expected the missing setter for E to be explained:\n%s", data)
+	}
+}
+
+func TestMakePkgNoController(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	srcPath := filepath.Join(tmpDir, "src", "ext")
+	if err := os.MkdirAll(srcPath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	src := "package ext\n\ntype T struct{}\n\n" +
+		"func F(n int) int { return n }\n\n" +
+		"func (t *T) M(s ...string) {}\n"
+	if err := ioutil.WriteFile(filepath.Join(srcPath, "ext.go"), []byte(src), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Setenv("GOPATH", os.Getenv("GOPATH"))
+	defer os.Setenv("GO111MODULE", os.Getenv("GO111MODULE"))
+	os.Setenv("GOPATH", tmpDir)
+	os.Setenv("GO111MODULE", "off")
+
+	// Every use of the controller should check that there is one first, with
+	// either version of the gomock API
+	for _, gomock := range []string{gomockPaths[0], legacyGomock} {
+		dstPath := filepath.Join(tmpDir, "dst", filepath.Base(filepath.Dir(gomock)))
+		if err := os.MkdirAll(dstPath, 0700); err != nil {
+			t.Fatal(err)
+		}
+		cfg := (&Config{}).Mock("ext")
+		cfg.Gomock = gomock
+		if _, err := MakePkg(srcPath, dstPath, "ext", true, cfg); err != nil {
+			t.Fatalf("MakePkg failed: %s", err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dstPath, "ext.go"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := string(data)
+
+		uses := strings.Count(code, "_c := _ctrl()\n")
+		checks := strings.Count(code, "if _c == nil {\n\t\tpanic(\"withmock: no gomock controller set")
+		if uses != 4 || checks != uses {
+			t.Errorf("%s: expected 4 checked uses of the controller, got %d uses and %d checks:\n%s",
+				gomock, uses, checks, code)
+		}
+	}
+}
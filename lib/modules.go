@@ -0,0 +1,559 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// testModule is the path of the synthetic module that holds the code under
+// test when working with modules.  It also forms the test mark, so all the
+// test labelled packages end up inside it.
+const testModule = "_test_"
+
+// module is the information about a module reported by "go list".
+type module struct {
+	Path      string
+	Version   string
+	Dir       string
+	GoMod     string
+	GoVersion string
+	Main      bool
+}
+
+// modFile is the subset of a go.mod file that we care about, as reported by
+// "go mod edit -json".
+type modFile struct {
+	Module    modVersion
+	Go        string
+	Toolchain string
+	GoDebug   []modGoDebug
+	Require   []modRequire
+	Exclude   []modVersion
+	Replace   []modReplace
+	Retract   []modRetract
+}
+
+type modVersion struct {
+	Path    string
+	Version string
+}
+
+type modRequire struct {
+	Path     string
+	Version  string
+	Indirect bool
+}
+
+type modReplace struct {
+	Old, New modVersion
+}
+
+type modGoDebug struct {
+	Key, Value string
+}
+
+type modRetract struct {
+	Low, High string
+	Rationale string
+}
+
+// getMainModules returns the main modules for the current directory, or nil if
+// the go tool isn't using modules.  There will only be one main module, unless
+// a workspace (i.e. go.work file) is in use.
+func getMainModules(workFile string) ([]*module, error) {
+	goMod, err := GetOutput("go", "env", "GOMOD")
+	if err != nil {
+		return nil, err
+	}
+
+	if (goMod == "" || goMod == os.DevNull) && workFile == "" {
+		return nil, nil
+	}
+
+	out, err := GetOutput("go", "list", "-m", "-json")
+	if err != nil {
+		return nil, err
+	}
+
+	mods := []*module{}
+	dec := json.NewDecoder(strings.NewReader(out))
+	for dec.More() {
+		mod := &module{}
+		if err := dec.Decode(mod); err != nil {
+			return nil, Cerr{"json.Decode", err}
+		}
+		mods = append(mods, mod)
+	}
+
+	return mods, nil
+}
+
+var (
+	pkgModules     = map[string]*module{}
+	pkgModulesLock sync.Mutex
+)
+
+// lookupModule returns the module that provides the package impPath, or nil
+// if the package is part of the standard library.
+func lookupModule(impPath string) (*module, error) {
+	pkgModulesLock.Lock()
+	mod, found := pkgModules[impPath]
+	pkgModulesLock.Unlock()
+	if found {
+		return mod, nil
+	}
+
+	out, err := GetOutput("go", "list", "-e", "-json", impPath)
+	if err != nil {
+		return nil, err
+	}
+
+	info := struct {
+		Standard bool
+		Module   *module
+	}{}
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		return nil, Cerr{"json.Unmarshal", err}
+	}
+
+	if info.Module == nil && !info.Standard {
+		return nil, fmt.Errorf("Unable to find module for package: %s", impPath)
+	}
+
+	pkgModulesLock.Lock()
+	pkgModules[impPath] = info.Module
+	pkgModulesLock.Unlock()
+
+	return info.Module, nil
+}
+
+// readModFile parses the go.mod file found at path.
+func readModFile(path string) (*modFile, error) {
+	out, err := GetOutput("go", "mod", "edit", "-json", path)
+	if err != nil {
+		return nil, err
+	}
+
+	mf := &modFile{}
+	if err := json.Unmarshal([]byte(out), mf); err != nil {
+		return nil, Cerr{"json.Unmarshal", err}
+	}
+
+	return mf, nil
+}
+
+func (mf *modFile) write(path string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	fmt.Fprintf(out, "module %s\n", mf.Module.Path)
+
+	if mf.Go != "" {
+		fmt.Fprintf(out, "\ngo %s\n", mf.Go)
+	}
+
+	if mf.Toolchain != "" {
+		fmt.Fprintf(out, "\ntoolchain %s\n", mf.Toolchain)
+	}
+
+	if len(mf.GoDebug) > 0 {
+		fmt.Fprintf(out, "\ngodebug (\n")
+		for _, d := range mf.GoDebug {
+			fmt.Fprintf(out, "\t%s=%s\n", d.Key, d.Value)
+		}
+		fmt.Fprintf(out, ")\n")
+	}
+
+	if len(mf.Require) > 0 {
+		fmt.Fprintf(out, "\nrequire (\n")
+		for _, r := range mf.Require {
+			fmt.Fprintf(out, "\t%s %s", r.Path, r.Version)
+			if r.Indirect {
+				fmt.Fprintf(out, " // indirect")
+			}
+			fmt.Fprintf(out, "\n")
+		}
+		fmt.Fprintf(out, ")\n")
+	}
+
+	if len(mf.Exclude) > 0 {
+		fmt.Fprintf(out, "\nexclude (\n")
+		for _, e := range mf.Exclude {
+			fmt.Fprintf(out, "\t%s %s\n", e.Path, e.Version)
+		}
+		fmt.Fprintf(out, ")\n")
+	}
+
+	if len(mf.Replace) > 0 {
+		fmt.Fprintf(out, "\nreplace (\n")
+		for _, r := range mf.Replace {
+			fmt.Fprintf(out, "\t%s => %s\n", r.Old, r.New)
+		}
+		fmt.Fprintf(out, ")\n")
+	}
+
+	if len(mf.Retract) > 0 {
+		fmt.Fprintf(out, "\nretract (\n")
+		for _, r := range mf.Retract {
+			if r.Low == r.High {
+				fmt.Fprintf(out, "\t%s", r.Low)
+			} else {
+				fmt.Fprintf(out, "\t[%s, %s]", r.Low, r.High)
+			}
+			if r.Rationale != "" {
+				fmt.Fprintf(out, " // %s", r.Rationale)
+			}
+			fmt.Fprintf(out, "\n")
+		}
+		fmt.Fprintf(out, ")\n")
+	}
+
+	return nil
+}
+
+func (v modVersion) String() string {
+	if v.Version == "" {
+		return v.Path
+	}
+	return v.Path + " " + v.Version
+}
+
+// moduleSet keeps track of the modules that have packages written into the
+// work area, so that they can all be wired together with go.mod files once we
+// have finished writing packages.
+type moduleSet struct {
+	main *module
+	root string
+	mods map[string]*module
+
+	// When using a workspace, work is the original go.work file and
+	// workMods are the modules that it uses.  main is nil in this case.
+	work     string
+	workMods []*module
+
+	// When inPlace is set packages are used from their original location
+	// (i.e. via an overlay), so only the packages that only exist in the
+	// work area need modules.  The original main module is then used, with
+	// a replacement go.mod.
+	inPlace bool
+}
+
+func newModuleSet(mains []*module, work, root string) *moduleSet {
+	s := &moduleSet{
+		root: root,
+		mods: make(map[string]*module),
+	}
+
+	if work != "" {
+		s.work = work
+		s.workMods = mains
+	} else {
+		s.main = mains[0]
+	}
+
+	return s
+}
+
+// mainDir returns the directory of the main module used inside the work area,
+// which is the module holding the code under test.
+func (s *moduleSet) mainDir() string {
+	return filepath.Join(s.root, testModule)
+}
+
+// modFile returns the path of the go.mod file to be used for the main module.
+func (s *moduleSet) modFile() string {
+	if s.inPlace {
+		return filepath.Join(filepath.Dir(s.root), "go.mod")
+	}
+	return filepath.Join(s.mainDir(), "go.mod")
+}
+
+// add records the module that owns the package being written to the work area
+// as label.
+func (s *moduleSet) add(name, label string) error {
+	switch getMark(label) {
+	case testMark:
+		// The code under test lives in the main module, which is always
+		// written.
+		return nil
+	case mockMark:
+		// A mocked stdlib package doesn't belong to a module, so we give it
+		// one of it's own.
+		s.mods[label] = &module{Path: label}
+		return nil
+	}
+
+	if strings.HasSuffix(label, "/_mocks_") {
+		if s.inPlace {
+			// There is nowhere to put the interface mocks in the original
+			// module, so they get a module of their own too.
+			s.mods[label] = &module{Path: label}
+			return nil
+		}
+		name = strings.TrimSuffix(name, "/_mocks_")
+	} else if s.inPlace {
+		inPlace, err := s.usedInPlace(name)
+		if err != nil || inPlace {
+			return err
+		}
+	}
+
+	mod, err := lookupModule(name)
+	if err != nil {
+		return Cerr{"lookupModule", err}
+	}
+
+	if mod == nil {
+		// stdlib packages don't need a module
+		return nil
+	}
+
+	s.mods[mod.Path] = mod
+
+	return nil
+}
+
+// usedInPlace returns true if the named package can be used from it's original
+// location when inPlace is set.  Only packages from the main module(s) can be,
+// as the go tool won't overlay files in the module cache, and the work area
+// doesn't use the vendor directory - so others need a module in the work area.
+func (s *moduleSet) usedInPlace(name string) (bool, error) {
+	if !s.inPlace {
+		return false, nil
+	}
+
+	mod, err := lookupModule(name)
+	if err != nil {
+		return false, Cerr{"lookupModule", err}
+	}
+
+	return mod == nil || mod.Main, nil
+}
+
+// sameModule returns the packages in imports that are provided by the same
+// module as the package name.
+func sameModule(name string, imports importSet) (importSet, error) {
+	same := make(importSet)
+
+	mod, err := lookupModule(name)
+	if err != nil {
+		return nil, Cerr{"lookupModule", err}
+	}
+
+	if mod == nil {
+		return same, nil
+	}
+
+	for path, i := range imports {
+		m, err := lookupModule(path)
+		if err != nil {
+			return nil, Cerr{"lookupModule", err}
+		}
+		if m != nil && m.Path == mod.Path {
+			same[path] = i
+		}
+	}
+
+	return same, nil
+}
+
+// write creates the go.mod files for all the modules in the work area.  The
+// main module requires every other module, and replaces them with the copies
+// in the work area.
+func (s *moduleSet) write() error {
+	if s.work != "" {
+		return s.writeWork()
+	}
+
+	orig, err := readModFile(s.main.GoMod)
+	if err != nil {
+		return Cerr{"readModFile", err}
+	}
+
+	main := &modFile{
+		Module:    modVersion{Path: testModule},
+		Go:        orig.Go,
+		Toolchain: orig.Toolchain,
+		GoDebug:   orig.GoDebug,
+		Exclude:   orig.Exclude,
+	}
+
+	// Retractions only make sense for the original module path
+	if s.inPlace {
+		main.Module.Path = s.main.Path
+		main.Retract = orig.Retract
+	}
+
+	paths := make([]string, 0, len(s.mods))
+	for path := range s.mods {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	required := make(map[string]bool)
+	for _, r := range orig.Require {
+		main.Require = append(main.Require, r)
+		required[r.Path] = true
+	}
+
+	// Keep the original replacements, unless we are replacing the module
+	// ourselves.  Local replacements need to be made absolute, as they will
+	// no longer be relative to the right directory.
+	for _, r := range orig.Replace {
+		if _, found := s.mods[r.Old.Path]; found {
+			continue
+		}
+		if r.New.Version == "" && !filepath.IsAbs(r.New.Path) {
+			r.New.Path = filepath.Join(s.main.Dir, r.New.Path)
+		}
+		main.Replace = append(main.Replace, r)
+	}
+
+	for _, path := range paths {
+		dir, _, err := s.writeModule(path, orig.Go)
+		if err != nil {
+			return err
+		}
+
+		if !required[path] {
+			main.Require = append(main.Require, modRequire{
+				Path:    path,
+				Version: "v0.0.0",
+			})
+		}
+
+		main.Replace = append(main.Replace, modReplace{
+			Old: modVersion{Path: path},
+			New: modVersion{Path: dir},
+		})
+	}
+
+	modFile := s.modFile()
+	if err := os.MkdirAll(filepath.Dir(modFile), 0700); err != nil {
+		return Cerr{"MkdirAll", err}
+	}
+
+	if err := main.write(modFile); err != nil {
+		return Cerr{"main.write", err}
+	}
+
+	// The main module still needs the checksums for any modules that we
+	// haven't replaced.
+	goSum := filepath.Join(s.main.Dir, "go.sum")
+	if exists(goSum) {
+		sumFile := strings.TrimSuffix(modFile, ".mod") + ".sum"
+		if err := copyFile(goSum, sumFile); err != nil {
+			return Cerr{"copyFile", err}
+		}
+	}
+
+	return nil
+}
+
+// writeModule writes the go.mod file for the copy of the module path in the
+// work area, returning the directory of the copy and the go version that it
+// uses.  goVersion is used if the original doesn't have a go.mod file.
+func (s *moduleSet) writeModule(path, goVersion string) (string, string, error) {
+	mod := s.mods[path]
+	dir := filepath.Join(s.root, path)
+
+	mf := &modFile{
+		Module: modVersion{Path: path},
+		Go:     goVersion,
+	}
+
+	if mod.GoMod != "" {
+		modOrig, err := readModFile(mod.GoMod)
+		if err != nil {
+			return "", "", Cerr{"readModFile", err}
+		}
+		mf.Go = modOrig.Go
+		mf.Toolchain = modOrig.Toolchain
+		mf.GoDebug = modOrig.GoDebug
+		mf.Require = modOrig.Require
+		mf.Retract = modOrig.Retract
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", Cerr{"MkdirAll", err}
+	}
+
+	if err := mf.write(filepath.Join(dir, "go.mod")); err != nil {
+		return "", "", Cerr{"mf.write", err}
+	}
+
+	return dir, mf.Go, nil
+}
+
+// goFlags returns the flags that the go tool needs to use the modules.
+func (s *moduleSet) goFlags() []string {
+	if s.work != "" {
+		// The go tool won't accept -mod=mod with a workspace, so the files
+		// we write for a workspace have to be complete.
+		return []string{"-mod=readonly"}
+	}
+
+	// The go.mod files we write don't have to be tidy, so we need to let
+	// the go tool fix them up as required.
+	flags := []string{"-mod=mod"}
+
+	if s.inPlace {
+		flags = append(flags, "-modfile="+s.modFile())
+	}
+
+	return flags
+}
+
+// setupCommand configures cmd to run inside the work area.
+func (s *moduleSet) setupCommand(cmd *exec.Cmd) {
+	if s.inPlace {
+		// The original main module is still in use
+		return
+	}
+
+	// If we haven't been moved into the work area, then we need to run from
+	// the main module - otherwise the go tool will find the original go.mod.
+	cwd, err := os.Getwd()
+	if err != nil || !isInside(cwd, s.root) {
+		cmd.Dir = s.mainDir()
+	}
+}
+
+func isInside(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func copyFile(src, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	_, err = io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,50 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestModFileWrite(t *testing.T) {
+	mf := &modFile{
+		Module:    modVersion{Path: "example.com/m"},
+		Go:        "1.23",
+		Toolchain: "go1.23.4",
+		GoDebug: []modGoDebug{
+			{Key: "panicnil", Value: "1"},
+		},
+		Require: []modRequire{
+			{Path: "example.com/a", Version: "v1.0.0"},
+			{Path: "example.com/b", Version: "v1.2.0", Indirect: true},
+		},
+		Exclude: []modVersion{
+			{Path: "example.com/a", Version: "v0.9.0"},
+		},
+		Replace: []modReplace{
+			{Old: modVersion{Path: "example.com/b"}, New: modVersion{Path: "/tmp/b"}},
+		},
+		Retract: []modRetract{
+			{Low: "v1.0.0", High: "v1.0.0", Rationale: "broken"},
+			{Low: "v1.1.0", High: "v1.1.5"},
+		},
+	}
+
+	path := filepath.Join(t.TempDir(), "go.mod")
+	if err := mf.write(path); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+
+	got, err := readModFile(path)
+	if err != nil {
+		t.Fatalf("readModFile failed: %s", err)
+	}
+
+	if !reflect.DeepEqual(got, mf) {
+		t.Errorf("Expected %+v, got %+v", mf, got)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// overlay collects replacement files for use with "go build -overlay".  This
+// allows the go tool to use generated code in place of the original files,
+// without having to mirror package directories into the work area.
+type overlay struct {
+	path    string
+	Replace map[string]string
+	pinned  map[string]bool
+}
+
+func newOverlay(path string) *overlay {
+	return &overlay{
+		path:    path,
+		Replace: make(map[string]string),
+		pinned:  make(map[string]bool),
+	}
+}
+
+// addPackage arranges for the package in dir to be built using the files
+// found in genDir.  Symlinks in genDir are followed (relative targets being
+// resolved against genDir), unless they point back into dir (in which case
+// the original file is simply used in place), and any go files in dir without
+// a replacement are hidden.  Once a directory has been
+// added with pin set, any further attempts to add it are ignored.
+func (o *overlay) addPackage(dir, genDir string, pin bool) error {
+	if o.pinned[dir] {
+		return nil
+	}
+
+	if pin {
+		o.pinned[dir] = true
+	}
+
+	// Remove anything from a previous attempt to add this directory
+	for path := range o.Replace {
+		if filepath.Dir(path) == dir {
+			delete(o.Replace, path)
+		}
+	}
+
+	generated, err := ioutil.ReadDir(genDir)
+	if err != nil {
+		return Cerr{"ReadDir", err}
+	}
+
+	inPlace := make(map[string]bool)
+
+	for _, info := range generated {
+		name := info.Name()
+		path := filepath.Join(genDir, name)
+
+		if info.IsDir() {
+			continue
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return Cerr{"Readlink", err}
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(genDir, target)
+			}
+			if filepath.Dir(target) == dir {
+				inPlace[name] = true
+				continue
+			}
+			path = target
+		}
+
+		o.Replace[filepath.Join(dir, name)] = path
+	}
+
+	original, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return Cerr{"ReadDir", err}
+	}
+
+	for _, info := range original {
+		name := info.Name()
+
+		if info.IsDir() || !strings.HasSuffix(name, ".go") || inPlace[name] {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		if _, found := o.Replace[path]; !found {
+			o.Replace[path] = ""
+		}
+	}
+
+	return nil
+}
+
+func (o *overlay) write() error {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return Cerr{"json.Marshal", err}
+	}
+
+	if err := ioutil.WriteFile(o.path, data, 0600); err != nil {
+		return Cerr{"WriteFile", err}
+	}
+
+	return nil
+}
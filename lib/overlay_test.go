@@ -0,0 +1,116 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOverlayWrite(t *testing.T) {
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "pkg")
+	gen := filepath.Join(tmp, "gen")
+	data := filepath.Join(tmp, "data")
+
+	writeFiles(t, dir, "a.go", "b.go", "c.go", "a_test.go", "notes.txt")
+	writeFiles(t, gen, "a.go", "a_test.go", "pkg_mock.go")
+	writeFiles(t, data, "d.go")
+
+	// b.go is used in place, and d.go comes from elsewhere
+	if err := os.Symlink(filepath.Join(dir, "b.go"), filepath.Join(gen, "b.go")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(data, "d.go"), filepath.Join(gen, "d.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	o := newOverlay(filepath.Join(tmp, "overlay.json"))
+	if err := o.addPackage(dir, gen, true); err != nil {
+		t.Fatalf("addPackage failed: %s", err)
+	}
+
+	// Once pinned, the package can't be replaced
+	if err := o.addPackage(dir, data, false); err != nil {
+		t.Fatalf("addPackage failed: %s", err)
+	}
+
+	if err := o.write(); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+
+	raw, err := ioutil.ReadFile(o.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := struct {
+		Replace map[string]string
+	}{}
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatalf("Unable to decode overlay: %s", err)
+	}
+
+	expected := map[string]string{
+		filepath.Join(dir, "a.go"):        filepath.Join(gen, "a.go"),
+		filepath.Join(dir, "a_test.go"):   filepath.Join(gen, "a_test.go"),
+		filepath.Join(dir, "pkg_mock.go"): filepath.Join(gen, "pkg_mock.go"),
+		filepath.Join(dir, "d.go"):        filepath.Join(data, "d.go"),
+		filepath.Join(dir, "c.go"):        "",
+	}
+
+	if !reflect.DeepEqual(got.Replace, expected) {
+		t.Errorf("Expected %v, got %v", expected, got.Replace)
+	}
+}
+
+func TestOverlayRelativeSymlinks(t *testing.T) {
+	tmp := t.TempDir()
+	dir := filepath.Join(tmp, "pkg")
+	gen := filepath.Join(tmp, "gen")
+	data := filepath.Join(tmp, "data")
+
+	writeFiles(t, dir, "a.go", "b.go")
+	writeFiles(t, gen, "a.go")
+	writeFiles(t, data, "d.go")
+
+	// Relative links are resolved against gen, not the current directory
+	if err := os.Symlink(filepath.Join("..", "pkg", "b.go"), filepath.Join(gen, "b.go")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..", "data", "d.go"), filepath.Join(gen, "d.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	o := newOverlay(filepath.Join(tmp, "overlay.json"))
+	if err := o.addPackage(dir, gen, false); err != nil {
+		t.Fatalf("addPackage failed: %s", err)
+	}
+
+	expected := map[string]string{
+		filepath.Join(dir, "a.go"): filepath.Join(gen, "a.go"),
+		filepath.Join(dir, "d.go"): filepath.Join(data, "d.go"),
+	}
+
+	if !reflect.DeepEqual(o.Replace, expected) {
+		t.Errorf("Expected %v, got %v", expected, o.Replace)
+	}
+}
@@ -22,7 +22,7 @@ type Package interface {
 	DisableInstall()
 
 	GetImports() (importSet, error)
-	MockImports(map[string]string, *Config) error
+	MockImports(map[string]string, bool, *Config) error
 
 	Link() (importSet, error)
 	Gen(mock bool, cfg *MockConfig) (importSet, error)
@@ -31,6 +31,7 @@ type Package interface {
 
 type realPackage struct {
 	name string
+	impPath string
 	label string
 	install bool
 	path string
@@ -40,8 +41,16 @@ type realPackage struct {
 	goPath string
 }
 
-func NewPackage(pkgName, label, tmpDir, goPath string) (Package, error) {
-	path, err := LookupImportPath(pkgName)
+// NewPackage creates a Package for pkgName as imported by the package in
+// srcDir, so that the right copy is found if it is vendored.  An empty srcDir
+// will just look for pkgName itself.
+func NewPackage(pkgName, label, srcDir, tmpDir, goPath string) (Package, error) {
+	impPath, err := vendoredImport(pkgName, srcDir)
+	if err != nil {
+		return nil, Cerr{"vendoredImport", err}
+	}
+
+	path, err := LookupImportPath(impPath)
 	if err != nil {
 		return nil, Cerr{"LookupImportPath", err}
 	}
@@ -55,6 +64,7 @@ func NewPackage(pkgName, label, tmpDir, goPath string) (Package, error) {
 
 	return &realPackage{
 		name: pkgName,
+		impPath: impPath,
 		label: label,
 		install: true,
 		path: path,
@@ -83,7 +93,7 @@ func (p *realPackage) Loc() codeLoc {
 }
 
 func (p *realPackage) HasNonGoCode() (bool, error) {
-	return hasNonGoCode(p.name)
+	return hasNonGoCode(p.impPath)
 }
 
 func (p *realPackage) DisableInstall() {
@@ -94,20 +104,20 @@ func (p *realPackage) GetImports() (importSet, error) {
 	return GetImports(p.path, true)
 }
 
-func (p *realPackage) MockImports(importNames map[string]string, cfg *Config) error {
-	return MockImports(p.src, p.dst, importNames, cfg)
+func (p *realPackage) MockImports(importNames map[string]string, self bool, cfg *Config) error {
+	return MockImports(p.src, p.dst, p.name, self, importNames, cfg)
 }
 
 func (p *realPackage) Link() (importSet, error) {
-	return LinkPkg(p.goPath, p.tmpPath, p.name)
+	return LinkPkg(p.goPath, p.tmpPath, p.impPath, p.name)
 }
 
 func (p *realPackage) Gen(mock bool, cfg *MockConfig) (importSet, error) {
-	return GenPkg(p.goPath, p.tmpPath, p.name, mock, cfg)
+	return GenPkg(p.goPath, p.tmpPath, p.impPath, p.name, mock, cfg)
 }
 
 func (p *realPackage) insideCommand(command string, args ...string) *exec.Cmd {
-	env := os.Environ()
+	env := goEnv()
 
 	// remove any current GOPATH from the environment
 	for i := range env {
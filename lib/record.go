@@ -0,0 +1,293 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// writeTape writes the code to record a call of fi to the real version, or to
+// replay it from an earlier recording, when a test has asked for it.  It
+// should be written once the mock has decided that the call is to be mocked.
+// The call is added to the recording when it's made, so that the calls are in
+// the order they were made - and the results (or a panic) are added once the
+// real version returns.
+func (fi *funcInfo) writeTape(out io.Writer, args int) {
+	scopedName := fi.name
+	if fi.IsMethod() {
+		scopedName = baseTypeName(fi.recv.expr) + "." + scopedName
+	}
+	params := ""
+	for i := 0; i < args; i++ {
+		params += fmt.Sprintf(", p%d", i)
+	}
+	returns := fi.retTypes()
+	rets := make([]string, len(returns))
+	for i := range rets {
+		rets[i] = fmt.Sprintf("ret%d", i)
+	}
+
+	// Without results, there is nothing to do with a replayed call once it's
+	// made
+	call := "_c := "
+	if len(returns) == 0 {
+		call = ""
+	}
+
+	fmt.Fprintf(out, "\tif _tp := _currentTape(); _tp != nil {\n")
+	fmt.Fprintf(out, "\t\tif _tp.replay {\n")
+	fmt.Fprintf(out, "\t\t\t%s_tp.replayCall(\"%s\"%s)\n", call, scopedName,
+		params)
+	for i, ret := range returns {
+		fmt.Fprintf(out, "\t\t\tvar ret%d %s\n", i, ret)
+		fmt.Fprintf(out, "\t\t\t_tp.decode(_c, %d, &ret%d)\n", i, i)
+	}
+	fmt.Fprintf(out, "\t\t\treturn %s\n", strings.Join(rets, ", "))
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\t_c := _tp.recordCall(\"%s\"%s)\n", scopedName,
+		params)
+	fmt.Fprintf(out, "\t\tdefer func() {\n")
+	fmt.Fprintf(out, "\t\t\t_tp.recordPanic(_c, recover())\n")
+	fmt.Fprintf(out, "\t\t}()\n")
+	if len(returns) == 0 {
+		fmt.Fprintf(out, "\t\t%s\n", fi.realCall(args))
+		fmt.Fprintf(out, "\t\t_tp.encode(_c)\n")
+		fmt.Fprintf(out, "\t\treturn\n")
+		fmt.Fprintf(out, "\t}\n")
+		return
+	}
+	fmt.Fprintf(out, "\t\t%s := %s\n", strings.Join(rets, ", "),
+		fi.realCall(args))
+	fmt.Fprintf(out, "\t\t_tp.encode(_c, %s)\n", strings.Join(rets, ", "))
+	fmt.Fprintf(out, "\t\treturn %s\n", strings.Join(rets, ", "))
+	fmt.Fprintf(out, "\t}\n")
+}
+
+// tape writes the methods of the meta type used to record and replay calls,
+// and the types and functions used by the generated code to do it.
+func (m *mockGen) tape(out io.Writer) {
+	// A codec converts values to and from JSON, for storing in a recording
+	fmt.Fprintf(out, "type _codec interface {\n")
+	fmt.Fprintf(out, "\tEncode(v interface{}) ([]byte, error)\n")
+	fmt.Fprintf(out, "\tDecode(data []byte, v interface{}) error\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// The default codec is plain JSON, except that errors are stored using
+	// their message - as they can't be decoded otherwise.
+	fmt.Fprintf(out, "type _jsonCodec struct{}\n\n")
+	fmt.Fprintf(out, "func (_jsonCodec) Encode(v interface{}) ([]byte, error) {\n")
+	fmt.Fprintf(out, "\tif err, ok := v.(error); ok {\n")
+	fmt.Fprintf(out, "\t\tv = err.Error()\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\treturn _json.Marshal(v)\n")
+	fmt.Fprintf(out, "}\n\n")
+	fmt.Fprintf(out, "func (_jsonCodec) Decode(data []byte, v interface{}) error {\n")
+	fmt.Fprintf(out, "\tif err, ok := v.(*error); ok {\n")
+	fmt.Fprintf(out, "\t\tvar msg *string\n")
+	fmt.Fprintf(out, "\t\tif e := _json.Unmarshal(data, &msg); e != nil {\n")
+	fmt.Fprintf(out, "\t\t\treturn e\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\tif msg != nil {\n")
+	fmt.Fprintf(out, "\t\t\t*err = _errors.New(*msg)\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\treturn nil\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\treturn _json.Unmarshal(data, v)\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "type _tapeCall struct {\n")
+	fmt.Fprintf(out, "\tName string `json:\"name\"`\n")
+	fmt.Fprintf(out, "\tArgs []_json.RawMessage `json:\"args\"`\n")
+	fmt.Fprintf(out, "\tResults []_json.RawMessage `json:\"results\"`\n")
+	fmt.Fprintf(out, "\tPanic *string `json:\"panic,omitempty\"`\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// The recording is indented when written, so compact the values before
+	// comparing them.
+	fmt.Fprintf(out, "func (c *_tapeCall) String() string {\n")
+	fmt.Fprintf(out, "\tbuf := &_bytes.Buffer{}\n")
+	fmt.Fprintf(out, "\tbuf.WriteString(c.Name + \"(\")\n")
+	fmt.Fprintf(out, "\tfor i, arg := range c.Args {\n")
+	fmt.Fprintf(out, "\t\tif i > 0 {\n")
+	fmt.Fprintf(out, "\t\t\tbuf.WriteString(\", \")\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\tif _json.Compact(buf, arg) != nil {\n")
+	fmt.Fprintf(out, "\t\t\tbuf.Write(arg)\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tbuf.WriteString(\")\")\n")
+	fmt.Fprintf(out, "\treturn buf.String()\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "type _tape struct {\n")
+	fmt.Fprintf(out, "\tt _testingT\n")
+	fmt.Fprintf(out, "\tfile string\n")
+	fmt.Fprintf(out, "\tcodec _codec\n")
+	fmt.Fprintf(out, "\treplay bool\n")
+	fmt.Fprintf(out, "\tcalls []*_tapeCall\n")
+	fmt.Fprintf(out, "\tnext int\n")
+	fmt.Fprintf(out, "\tlock _sync.Mutex\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func _currentTape() (tp *_tape) {\n")
+	fmt.Fprintf(out, "\t_read(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\ttp = s.tape\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "\treturn\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// Start using tp in the current scope, returning a function to stop using
+	// it again (unless it has already been replaced)
+	fmt.Fprintf(out, "func _setTape(tp *_tape) func() {\n")
+	fmt.Fprintf(out, "\tvar scope *_scope\n")
+	fmt.Fprintf(out, "\t_write(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\tscope = s\n")
+	fmt.Fprintf(out, "\t\ts.tape = tp\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "\treturn func() {\n")
+	fmt.Fprintf(out, "\t\t_stateLock.Lock()\n")
+	fmt.Fprintf(out, "\t\tdefer _stateLock.Unlock()\n")
+	fmt.Fprintf(out, "\t\tif scope.tape == tp {\n")
+	fmt.Fprintf(out, "\t\t\tscope.tape = nil\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func _currentCodec() (codec _codec) {\n")
+	fmt.Fprintf(out, "\t_read(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\tcodec = s.codec\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "\treturn\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// The call may not be on the test's goroutine, so we can't use Fatalf -
+	// instead we report the error, and then panic.
+	fmt.Fprintf(out, "func (tp *_tape) fail(format string, args ...interface{}) {\n")
+	fmt.Fprintf(out, "\tmsg := _fmt.Sprintf(format, args...)\n")
+	fmt.Fprintf(out, "\ttp.t.Errorf(\"%%s\", msg)\n")
+	fmt.Fprintf(out, "\tpanic(msg)\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func (tp *_tape) encodeAll(values []interface{}) []_json.RawMessage {\n")
+	fmt.Fprintf(out, "\tencoded := make([]_json.RawMessage, len(values))\n")
+	fmt.Fprintf(out, "\tfor i, v := range values {\n")
+	fmt.Fprintf(out, "\t\tdata, err := tp.codec.Encode(v)\n")
+	fmt.Fprintf(out, "\t\tif err != nil {\n")
+	fmt.Fprintf(out, "\t\t\ttp.fail(\"%%s: can't encode %%T: %%s\", tp.file, v, err)\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\tencoded[i] = data\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\treturn encoded\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func (tp *_tape) recordCall(name string, args ...interface{}) *_tapeCall {\n")
+	fmt.Fprintf(out, "\tc := &_tapeCall{Name: name, Args: tp.encodeAll(args)}\n")
+	fmt.Fprintf(out, "\ttp.lock.Lock()\n")
+	fmt.Fprintf(out, "\tdefer tp.lock.Unlock()\n")
+	fmt.Fprintf(out, "\ttp.calls = append(tp.calls, c)\n")
+	fmt.Fprintf(out, "\treturn c\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func (tp *_tape) encode(c *_tapeCall, results ...interface{}) {\n")
+	fmt.Fprintf(out, "\tencoded := tp.encodeAll(results)\n")
+	fmt.Fprintf(out, "\ttp.lock.Lock()\n")
+	fmt.Fprintf(out, "\tdefer tp.lock.Unlock()\n")
+	fmt.Fprintf(out, "\tc.Results = encoded\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// A call that panics is recorded with the panic's message, which is used
+	// to panic again when the call is replayed.
+	fmt.Fprintf(out, "func (tp *_tape) recordPanic(c *_tapeCall, p interface{}) {\n")
+	fmt.Fprintf(out, "\tif p == nil {\n")
+	fmt.Fprintf(out, "\t\treturn\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tmsg := _fmt.Sprint(p)\n")
+	fmt.Fprintf(out, "\ttp.lock.Lock()\n")
+	fmt.Fprintf(out, "\tc.Results = nil\n")
+	fmt.Fprintf(out, "\tc.Panic = &msg\n")
+	fmt.Fprintf(out, "\ttp.lock.Unlock()\n")
+	fmt.Fprintf(out, "\tpanic(p)\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func (tp *_tape) replayCall(name string, args ...interface{}) *_tapeCall {\n")
+	fmt.Fprintf(out, "\tc := &_tapeCall{Name: name, Args: tp.encodeAll(args)}\n")
+	fmt.Fprintf(out, "\ttp.lock.Lock()\n")
+	fmt.Fprintf(out, "\tdefer tp.lock.Unlock()\n")
+	fmt.Fprintf(out, "\tif tp.next >= len(tp.calls) {\n")
+	fmt.Fprintf(out, "\t\ttp.fail(\"replaying %%s: unexpected call %%s, after all %%d recorded calls\", tp.file, c, len(tp.calls))\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\twant := tp.calls[tp.next]\n")
+	fmt.Fprintf(out, "\ttp.next++\n")
+	fmt.Fprintf(out, "\tif want.String() != c.String() {\n")
+	fmt.Fprintf(out, "\t\ttp.fail(\"replaying %%s: call %%d doesn't match the recording:\\n\\texpected: %%s\\n\\tgot:      %%s\", tp.file, tp.next, want, c)\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tif want.Panic != nil {\n")
+	fmt.Fprintf(out, "\t\tpanic(*want.Panic)\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\treturn want\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func (tp *_tape) decode(c *_tapeCall, i int, v interface{}) {\n")
+	fmt.Fprintf(out, "\tif i >= len(c.Results) {\n")
+	fmt.Fprintf(out, "\t\ttp.fail(\"replaying %%s: %%s has no result %%d\", tp.file, c, i)\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tif err := tp.codec.Decode(c.Results[i], v); err != nil {\n")
+	fmt.Fprintf(out, "\t\ttp.fail(\"replaying %%s: can't decode result %%d of %%s: %%s\", tp.file, i, c, err)\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func (_ *_meta) SetCodec(codec _codec) {\n")
+	fmt.Fprintf(out, "\tif codec == nil {\n")
+	fmt.Fprintf(out, "\t\tcodec = _jsonCodec{}\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\t_write(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\ts.codec = codec\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func (_ *_meta) Record(t _testingT, file string) {\n")
+	fmt.Fprintf(out, "\tt.Helper()\n")
+	fmt.Fprintf(out, "\ttp := &_tape{t: t, file: file, codec: _currentCodec()}\n")
+	fmt.Fprintf(out, "\tstop := _setTape(tp)\n")
+	fmt.Fprintf(out, "\tt.Cleanup(func() {\n")
+	fmt.Fprintf(out, "\t\tstop()\n")
+	fmt.Fprintf(out, "\t\ttp.lock.Lock()\n")
+	fmt.Fprintf(out, "\t\tdata, err := _json.MarshalIndent(tp.calls, \"\", \"\\t\")\n")
+	fmt.Fprintf(out, "\t\ttp.lock.Unlock()\n")
+	fmt.Fprintf(out, "\t\tif err == nil {\n")
+	fmt.Fprintf(out, "\t\t\terr = _os.MkdirAll(_filepath.Dir(file), 0777)\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\tif err == nil {\n")
+	fmt.Fprintf(out, "\t\t\terr = _os.WriteFile(file, append(data, '\\n'), 0666)\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\tif err != nil {\n")
+	fmt.Fprintf(out, "\t\t\tt.Errorf(\"Failed to write recording %%s: %%s\", file, err)\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func (_ *_meta) Replay(t _testingT, file string) {\n")
+	fmt.Fprintf(out, "\tt.Helper()\n")
+	fmt.Fprintf(out, "\ttp := &_tape{t: t, file: file, codec: _currentCodec(), replay: true}\n")
+	fmt.Fprintf(out, "\tdata, err := _os.ReadFile(file)\n")
+	fmt.Fprintf(out, "\tif err == nil {\n")
+	fmt.Fprintf(out, "\t\terr = _json.Unmarshal(data, &tp.calls)\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tif err != nil {\n")
+	fmt.Fprintf(out, "\t\tt.Fatalf(\"Failed to read recording %%s: %%s\", file, err)\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tstop := _setTape(tp)\n")
+	fmt.Fprintf(out, "\tt.Cleanup(func() {\n")
+	fmt.Fprintf(out, "\t\tstop()\n")
+	fmt.Fprintf(out, "\t\ttp.lock.Lock()\n")
+	fmt.Fprintf(out, "\t\tdefer tp.lock.Unlock()\n")
+	fmt.Fprintf(out, "\t\tif tp.next < len(tp.calls) {\n")
+	fmt.Fprintf(out, "\t\t\tt.Errorf(\"replaying %%s: %%d recorded calls were not made, starting with %%s\", file, len(tp.calls)-tp.next, tp.calls[tp.next])\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "}\n\n")
+}
@@ -0,0 +1,330 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"fmt"
+	"io"
+)
+
+// scope writes the runtime state of the mocked package, which decides what is
+// mocked (and holds any state of the backend).  The state can be scoped to a
+// test, and is found using the goroutine making the call - so that tests
+// running in parallel each see their own state.
+func (m *mockGen) scope(out io.Writer) {
+	// We don't want to import testing into the package, so we just describe
+	// the parts of *testing.T that we need.
+	fmt.Fprintf(out, "type _testingT interface {\n")
+	fmt.Fprintf(out, "\tHelper()\n")
+	fmt.Fprintf(out, "\tErrorf(format string, args ...interface{})\n")
+	fmt.Fprintf(out, "\tFatalf(format string, args ...interface{})\n")
+	fmt.Fprintf(out, "\tCleanup(f func())\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "type _scope struct {\n")
+	fmt.Fprintf(out, "\tallMocked bool\n")
+	fmt.Fprintf(out, "\tenabledMocks map[string]bool\n")
+	fmt.Fprintf(out, "\tdisabledMocks map[string]bool\n")
+	fmt.Fprintf(out, "\tspyAll bool\n")
+	fmt.Fprintf(out, "\tspiedMocks map[string]bool\n")
+	fmt.Fprintf(out, "\tcalls map[string][]*_spyCall\n")
+	fmt.Fprintf(out, "\ttape *_tape\n")
+	fmt.Fprintf(out, "\tcodec _codec\n")
+	// cleanup registers a function to be run when the test finishes (the
+	// test owning the scope, or the test of the controller)
+	fmt.Fprintf(out, "\tcleanup func(func())\n")
+	// goroutines has the ids of the goroutines found to be using the scope
+	// by _current, so that they can be forgotten along with the scope
+	fmt.Fprintf(out, "\tgoroutines _sync.Map\n")
+	m.backend.writeScope(out)
+	fmt.Fprintf(out, "}\n\n")
+
+	// A new scope starts as a copy of it's parent, but without the calls it
+	// has spied on
+	fmt.Fprintf(out, "func _newScope(parent *_scope) *_scope {\n")
+	fmt.Fprintf(out, "\ts := &_scope{\n")
+	fmt.Fprintf(out, "\t\tenabledMocks: make(map[string]bool),\n")
+	fmt.Fprintf(out, "\t\tdisabledMocks: make(map[string]bool),\n")
+	fmt.Fprintf(out, "\t\tspiedMocks: make(map[string]bool),\n")
+	fmt.Fprintf(out, "\t\tcalls: make(map[string][]*_spyCall),\n")
+	fmt.Fprintf(out, "\t\tcodec: _jsonCodec{},\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tif parent != nil {\n")
+	fmt.Fprintf(out, "\t\ts.allMocked = parent.allMocked\n")
+	fmt.Fprintf(out, "\t\ts.spyAll = parent.spyAll\n")
+	fmt.Fprintf(out, "\t\ts.tape = parent.tape\n")
+	fmt.Fprintf(out, "\t\ts.codec = parent.codec\n")
+	fmt.Fprintf(out, "\t\tfor name := range parent.enabledMocks {\n")
+	fmt.Fprintf(out, "\t\t\ts.enabledMocks[name] = true\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\tfor name := range parent.disabledMocks {\n")
+	fmt.Fprintf(out, "\t\t\ts.disabledMocks[name] = true\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\tfor name := range parent.spiedMocks {\n")
+	fmt.Fprintf(out, "\t\t\ts.spiedMocks[name] = true\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t}\n")
+	m.backend.writeNewScope(out)
+	fmt.Fprintf(out, "\treturn s\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// describe is used to spot (and report) changes to a scope
+	fmt.Fprintf(out, "func (s *_scope) describe() string {\n")
+	fmt.Fprintf(out, "\tnames := func(set map[string]bool) []string {\n")
+	fmt.Fprintf(out, "\t\tnames := []string{}\n")
+	fmt.Fprintf(out, "\t\tfor name := range set {\n")
+	fmt.Fprintf(out, "\t\t\tnames = append(names, name)\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\t_sort.Strings(names)\n")
+	fmt.Fprintf(out, "\t\treturn names\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\treturn _fmt.Sprintf(\"MockAll(%%v) EnableMock%%q DisableMock%%q SpyAll(%%v) Spy%%q\",\n")
+	fmt.Fprintf(out, "\t\ts.allMocked, names(s.enabledMocks), names(s.disabledMocks),\n")
+	fmt.Fprintf(out, "\t\ts.spyAll, names(s.spiedMocks))\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "var (\n")
+	fmt.Fprintf(out, "\t_base = _newScope(nil)\n")
+	fmt.Fprintf(out, "\t_scopes []*_scope\n")
+	fmt.Fprintf(out, "\t_scopeOf _sync.Map\n")
+	fmt.Fprintf(out, "\t_stateLock _sync.RWMutex\n")
+	fmt.Fprintf(out, ")\n\n")
+
+	// There is no goroutine id API, so we get the id of a goroutine (and of
+	// the goroutine that created it, and the function that did so) from it's
+	// stack trace.
+	fmt.Fprintf(out, "func _goroutine(trace string) (id, parent int64, creator string) {\n")
+	fmt.Fprintf(out, "\tparse := func(s string) int64 {\n")
+	fmt.Fprintf(out, "\t\tif i := _strings.IndexAny(s, \" \\n\"); i >= 0 {\n")
+	fmt.Fprintf(out, "\t\t\ts = s[:i]\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\tid, _ := _strconv.ParseInt(s, 10, 64)\n")
+	fmt.Fprintf(out, "\t\treturn id\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tid = parse(_strings.TrimPrefix(trace, \"goroutine \"))\n")
+	fmt.Fprintf(out, "\tconst createdBy = \"\\ncreated by \"\n")
+	fmt.Fprintf(out, "\tif i := _strings.LastIndex(trace, createdBy); i >= 0 {\n")
+	fmt.Fprintf(out, "\t\tcreator = trace[i+len(createdBy):]\n")
+	fmt.Fprintf(out, "\t\tif i = _strings.Index(creator, \"\\n\"); i >= 0 {\n")
+	fmt.Fprintf(out, "\t\t\tcreator = creator[:i]\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\tif i = _strings.Index(creator, \" in goroutine \"); i >= 0 {\n")
+	fmt.Fprintf(out, "\t\t\tparent = parse(creator[i+len(\" in goroutine \"):])\n")
+	fmt.Fprintf(out, "\t\t\tcreator = creator[:i]\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\treturn\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// Only the first line is needed to get the id of the current goroutine
+	fmt.Fprintf(out, "func _goid() int64 {\n")
+	fmt.Fprintf(out, "\tbuf := make([]byte, 64)\n")
+	fmt.Fprintf(out, "\tn := _runtime.Stack(buf, false)\n")
+	fmt.Fprintf(out, "\tid, _, _ := _goroutine(string(buf[:n]))\n")
+	fmt.Fprintf(out, "\treturn id\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// _ancestors returns the ids of the current goroutine and the goroutines
+	// that started it (as far back as they are still running), and the id of
+	// the top level test they belong to (the outermost one started by
+	// testing.(*T).Run) - or 0 if there isn't one.  Following the chain needs
+	// the stack trace of every goroutine, which stops the world - so the
+	// results should be remembered.
+	fmt.Fprintf(out, "func _ancestors() (ids []int64, test int64) {\n")
+	fmt.Fprintf(out, "\tstack := func(all bool) string {\n")
+	fmt.Fprintf(out, "\t\tbuf := make([]byte, 4096)\n")
+	fmt.Fprintf(out, "\t\tfor {\n")
+	fmt.Fprintf(out, "\t\t\tif n := _runtime.Stack(buf, all); n < len(buf) {\n")
+	fmt.Fprintf(out, "\t\t\t\treturn string(buf[:n])\n")
+	fmt.Fprintf(out, "\t\t\t}\n")
+	fmt.Fprintf(out, "\t\t\tbuf = make([]byte, 2*len(buf))\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tconst testRun = \"testing.(*T).Run\"\n")
+	fmt.Fprintf(out, "\tid, parent, creator := _goroutine(stack(false))\n")
+	fmt.Fprintf(out, "\tids = append(ids, id)\n")
+	fmt.Fprintf(out, "\tif creator == testRun {\n")
+	fmt.Fprintf(out, "\t\ttest = id\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tif parent == 0 {\n")
+	fmt.Fprintf(out, "\t\treturn\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tparents := make(map[int64]int64)\n")
+	fmt.Fprintf(out, "\tcreators := make(map[int64]string)\n")
+	fmt.Fprintf(out, "\tfor _, trace := range _strings.Split(stack(true), \"\\n\\n\") {\n")
+	fmt.Fprintf(out, "\t\tid, parent, creator := _goroutine(trace)\n")
+	fmt.Fprintf(out, "\t\tparents[id], creators[id] = parent, creator\n")
+	fmt.Fprintf(out, "\t}\n")
+	// A goroutine is always created by one with a lower id, so this ends
+	fmt.Fprintf(out, "\tfor parent != 0 {\n")
+	fmt.Fprintf(out, "\t\tcreator, running := creators[parent]\n")
+	fmt.Fprintf(out, "\t\tif !running || parent >= ids[len(ids)-1] {\n")
+	fmt.Fprintf(out, "\t\t\tbreak\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\tids = append(ids, parent)\n")
+	fmt.Fprintf(out, "\t\tif creator == testRun {\n")
+	fmt.Fprintf(out, "\t\t\ttest = parent\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\tparent = parents[parent]\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\treturn\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// The scope of a goroutine is the scope it created, or the scope of the
+	// nearest goroutine that started it - which we remember (until the scope
+	// is thrown away), so that we don't need to look again.  If the goroutine
+	// can't be traced to a scope, then we can only guess if there is just the
+	// one.
+	fmt.Fprintf(out, "func _current() *_scope {\n")
+	fmt.Fprintf(out, "\tif len(_scopes) == 0 {\n")
+	fmt.Fprintf(out, "\t\treturn _base\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tid := _goid()\n")
+	fmt.Fprintf(out, "\tif s, ok := _scopeOf.Load(id); ok {\n")
+	fmt.Fprintf(out, "\t\treturn s.(*_scope)\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tids, _ := _ancestors()\n")
+	fmt.Fprintf(out, "\tfor _, parent := range ids[1:] {\n")
+	fmt.Fprintf(out, "\t\tif s, ok := _scopeOf.Load(parent); ok {\n")
+	fmt.Fprintf(out, "\t\t\ts.(*_scope).goroutines.Store(id, true)\n")
+	fmt.Fprintf(out, "\t\t\t_scopeOf.Store(id, s)\n")
+	fmt.Fprintf(out, "\t\t\treturn s.(*_scope)\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tif len(_scopes) > 1 {\n")
+	fmt.Fprintf(out, "\t\tpanic(_fmt.Sprintf(\"mock: goroutine %%d can't be traced to a test with a scope, \"+\n")
+	fmt.Fprintf(out, "\t\t\t\"and there are %%d scopes to choose from\", id, len(_scopes)))\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\treturn _scopes[0]\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// _read and _write call f with the current scope, holding the lock
+	fmt.Fprintf(out, "func _read(f func(s *_scope)) {\n")
+	fmt.Fprintf(out, "\t_stateLock.RLock()\n")
+	fmt.Fprintf(out, "\tdefer _stateLock.RUnlock()\n")
+	fmt.Fprintf(out, "\tf(_current())\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func _write(f func(s *_scope)) {\n")
+	fmt.Fprintf(out, "\t_stateLock.Lock()\n")
+	fmt.Fprintf(out, "\tdefer _stateLock.Unlock()\n")
+	fmt.Fprintf(out, "\tf(_current())\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func _isMocked(name string) (mocked bool) {\n")
+	fmt.Fprintf(out, "\t_read(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\tmocked = (s.allMocked || s.enabledMocks[name]) && !s.disabledMocks[name]\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "\treturn\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// _cleanup returns the function used to undo a change made by name at the
+	// end of the current test.
+	fmt.Fprintf(out, "func _cleanup(name string) (cleanup func(func())) {\n")
+	fmt.Fprintf(out, "\t_read(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\tcleanup = s.cleanup\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "\tif cleanup == nil {\n")
+	fmt.Fprintf(out, "\t\tpanic(name + \": no test to restore the old value for, use Scope or SetController first\")\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\treturn\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// Inits are run with nothing mocked
+	fmt.Fprintf(out, "func callInits(inits ...func()) {\n")
+	fmt.Fprintf(out, "\t_stateLock.Lock()\n")
+	fmt.Fprintf(out, "\tbase := _base\n")
+	fmt.Fprintf(out, "\t_base = _newScope(nil)\n")
+	fmt.Fprintf(out, "\t_stateLock.Unlock()\n")
+	fmt.Fprintf(out, "\tfor _, f := range inits {\n")
+	fmt.Fprintf(out, "\t\tf()\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\t_stateLock.Lock()\n")
+	fmt.Fprintf(out, "\t_base = base\n")
+	fmt.Fprintf(out, "\t_stateLock.Unlock()\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func (_ *_meta) MockAll(enabled bool) {\n")
+	fmt.Fprintf(out, "\t_write(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\ts.allMocked = enabled\n")
+	fmt.Fprintf(out, "\t\ts.enabledMocks = make(map[string]bool)\n")
+	fmt.Fprintf(out, "\t\ts.disabledMocks = make(map[string]bool)\n")
+	fmt.Fprintf(out, "\t\ts.spyAll = false\n")
+	fmt.Fprintf(out, "\t\ts.spiedMocks = make(map[string]bool)\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "}\n")
+
+	fmt.Fprintf(out, "func (_ *_meta) EnableMock(names ...string) {\n")
+	fmt.Fprintf(out, "\t_write(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\tfor _, name := range names {\n")
+	fmt.Fprintf(out, "\t\t\ts.enabledMocks[name] = true\n")
+	fmt.Fprintf(out, "\t\t\tdelete(s.disabledMocks, name)\n")
+	fmt.Fprintf(out, "\t\t\tdelete(s.spiedMocks, name)\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func (_ *_meta) DisableMock(names ...string) {\n")
+	fmt.Fprintf(out, "\t_write(func(s *_scope) {\n")
+	fmt.Fprintf(out, "\t\tfor _, name := range names {\n")
+	fmt.Fprintf(out, "\t\t\ts.disabledMocks[name] = true\n")
+	fmt.Fprintf(out, "\t\t\tdelete(s.enabledMocks, name)\n")
+	fmt.Fprintf(out, "\t\t\tdelete(s.spiedMocks, name)\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// Scope gives the calling test (and the goroutines it starts) a copy of
+	// the current state, which is thrown away when the test finishes.
+	fmt.Fprintf(out, "func (_ *_meta) Scope(t _testingT) {\n")
+	fmt.Fprintf(out, "\tt.Helper()\n")
+	fmt.Fprintf(out, "\tid := _goid()\n")
+	fmt.Fprintf(out, "\t_stateLock.Lock()\n")
+	fmt.Fprintf(out, "\ts := _newScope(_current())\n")
+	fmt.Fprintf(out, "\ts.cleanup = t.Cleanup\n")
+	fmt.Fprintf(out, "\tprev, _ := _scopeOf.Load(id)\n")
+	fmt.Fprintf(out, "\t_scopes = append(_scopes, s)\n")
+	fmt.Fprintf(out, "\t_scopeOf.Store(id, s)\n")
+	fmt.Fprintf(out, "\t_stateLock.Unlock()\n")
+	fmt.Fprintf(out, "\tt.Cleanup(func() {\n")
+	fmt.Fprintf(out, "\t\t_stateLock.Lock()\n")
+	fmt.Fprintf(out, "\t\tdefer _stateLock.Unlock()\n")
+	fmt.Fprintf(out, "\t\tfor i := range _scopes {\n")
+	fmt.Fprintf(out, "\t\t\tif _scopes[i] == s {\n")
+	fmt.Fprintf(out, "\t\t\t\t_scopes = append(_scopes[:i], _scopes[i+1:]...)\n")
+	fmt.Fprintf(out, "\t\t\t\tbreak\n")
+	fmt.Fprintf(out, "\t\t\t}\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\ts.goroutines.Range(func(id, _ interface{}) bool {\n")
+	fmt.Fprintf(out, "\t\t\t_scopeOf.Delete(id)\n")
+	fmt.Fprintf(out, "\t\t\treturn true\n")
+	fmt.Fprintf(out, "\t\t})\n")
+	fmt.Fprintf(out, "\t\tif prev != nil {\n")
+	fmt.Fprintf(out, "\t\t\t_scopeOf.Store(id, prev)\n")
+	fmt.Fprintf(out, "\t\t} else {\n")
+	fmt.Fprintf(out, "\t\t\t_scopeOf.Delete(id)\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// CheckLeaks fails the test if the current state has been changed when
+	// the test finishes.
+	fmt.Fprintf(out, "func (_ *_meta) CheckLeaks(t _testingT) {\n")
+	fmt.Fprintf(out, "\tt.Helper()\n")
+	fmt.Fprintf(out, "\tvar s *_scope\n")
+	fmt.Fprintf(out, "\tvar before string\n")
+	fmt.Fprintf(out, "\t_read(func(current *_scope) {\n")
+	fmt.Fprintf(out, "\t\ts, before = current, current.describe()\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "\tt.Cleanup(func() {\n")
+	fmt.Fprintf(out, "\t\t_stateLock.RLock()\n")
+	fmt.Fprintf(out, "\t\tafter := s.describe()\n")
+	fmt.Fprintf(out, "\t\t_stateLock.RUnlock()\n")
+	fmt.Fprintf(out, "\t\tif after != before {\n")
+	fmt.Fprintf(out, "\t\t\tt.Errorf(\"mock state left modified by test:\\n\\tbefore: %%s\\n\\tafter:  %%s\", before, after)\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t})\n")
+	fmt.Fprintf(out, "}\n\n")
+}
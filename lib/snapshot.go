@@ -0,0 +1,164 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"fmt"
+	"io"
+)
+
+// snapshot writes the methods of the meta type used to save and restore the
+// package variables, so that state kept by the real code (caches, registries
+// etc) doesn't leak from one test into the next.
+func (m *mockGen) snapshot(out io.Writer) {
+	// Each file adds pointers to the variables it declares, as we can't
+	// refer to variables from files excluded by build constraints.
+	fmt.Fprintf(out, "var (\n")
+	fmt.Fprintf(out, "\t_vars []interface{}\n")
+	fmt.Fprintf(out, "\t_snapshot []_reflect.Value\n")
+	fmt.Fprintf(out, ")\n\n")
+
+	fmt.Fprintf(out, "func _addVars(vars ...interface{}) bool {\n")
+	fmt.Fprintf(out, "\t_vars = append(_vars, vars...)\n")
+	fmt.Fprintf(out, "\treturn true\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// The lock types are left as their zero value, rather than copying the
+	// state of a lock that may be held - or a sync.Once that has been done.
+	fmt.Fprintf(out, "var _locks = map[_reflect.Type]bool{\n")
+	for _, lock := range []string{"Mutex", "RWMutex", "Once", "WaitGroup"} {
+		fmt.Fprintf(out, "\t_reflect.TypeOf((*_sync.%s)(nil)).Elem(): true,\n",
+			lock)
+	}
+	fmt.Fprintf(out, "}\n\n")
+
+	// Values are copied all the way down, as the real code is as likely to
+	// change the elements of a slice, or a struct through a pointer, as it is
+	// to replace a variable.  Pointers to the types of other packages aren't
+	// followed, the snapshot shares them - as they usually point at state
+	// belonging to the other package (e.g. time.UTC or http.DefaultTransport).
+	// So changes made through them (even to a *sync.Map or *bytes.Buffer owned
+	// by this package) aren't undone.  Anything reachable more than once is
+	// only copied once, which also takes care of cycles.
+	fmt.Fprintf(out, "type _cloneKey struct {\n")
+	fmt.Fprintf(out, "\tp uintptr\n")
+	fmt.Fprintf(out, "\tt _reflect.Type\n")
+	fmt.Fprintf(out, "\tn int\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func _clone(v _reflect.Value, seen map[_cloneKey]_reflect.Value) _reflect.Value {\n")
+	fmt.Fprintf(out, "\tc := _reflect.New(v.Type()).Elem()\n")
+	fmt.Fprintf(out, "\t_copy(c, v, seen)\n")
+	fmt.Fprintf(out, "\treturn c\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// Unexported fields can only be read and written through their address,
+	// so everything is copied from (and to) an addressable value.
+	fmt.Fprintf(out, "func _rw(v _reflect.Value) _reflect.Value {\n")
+	fmt.Fprintf(out, "\treturn _reflect.NewAt(v.Type(), _unsafe.Pointer(v.UnsafeAddr())).Elem()\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func _copy(c, v _reflect.Value, seen map[_cloneKey]_reflect.Value) {\n")
+	fmt.Fprintf(out, "\tif _locks[v.Type()] {\n")
+	fmt.Fprintf(out, "\t\treturn\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tif !v.CanAddr() {\n")
+	fmt.Fprintf(out, "\t\ta := _reflect.New(v.Type()).Elem()\n")
+	fmt.Fprintf(out, "\t\ta.Set(v)\n")
+	fmt.Fprintf(out, "\t\tv = a\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tswitch v.Kind() {\n")
+	fmt.Fprintf(out, "\tcase _reflect.Ptr:\n")
+	fmt.Fprintf(out, "\t\tpkg := v.Type().Elem().PkgPath()\n")
+	fmt.Fprintf(out, "\t\tif v.IsNil() || (pkg != \"\" && pkg != _reflect.TypeOf(_packageMock{}).PkgPath()) {\n")
+	fmt.Fprintf(out, "\t\t\tbreak\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\tkey := _cloneKey{v.Pointer(), v.Type(), 0}\n")
+	fmt.Fprintf(out, "\t\tif p, found := seen[key]; found {\n")
+	fmt.Fprintf(out, "\t\t\tc.Set(p)\n")
+	fmt.Fprintf(out, "\t\t\treturn\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\tp := _reflect.New(v.Type().Elem())\n")
+	fmt.Fprintf(out, "\t\tseen[key] = p\n")
+	fmt.Fprintf(out, "\t\tc.Set(p)\n")
+	fmt.Fprintf(out, "\t\t_copy(p.Elem(), _rw(v.Elem()), seen)\n")
+	fmt.Fprintf(out, "\t\treturn\n")
+	fmt.Fprintf(out, "\tcase _reflect.Map:\n")
+	fmt.Fprintf(out, "\t\tif v.IsNil() {\n")
+	fmt.Fprintf(out, "\t\t\treturn\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\tkey := _cloneKey{v.Pointer(), v.Type(), 0}\n")
+	fmt.Fprintf(out, "\t\tif m, found := seen[key]; found {\n")
+	fmt.Fprintf(out, "\t\t\tc.Set(m)\n")
+	fmt.Fprintf(out, "\t\t\treturn\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\tm := _reflect.MakeMapWithSize(v.Type(), v.Len())\n")
+	fmt.Fprintf(out, "\t\tseen[key] = m\n")
+	fmt.Fprintf(out, "\t\tc.Set(m)\n")
+	fmt.Fprintf(out, "\t\titer := v.MapRange()\n")
+	fmt.Fprintf(out, "\t\tfor iter.Next() {\n")
+	fmt.Fprintf(out, "\t\t\tm.SetMapIndex(iter.Key(), _clone(iter.Value(), seen))\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\treturn\n")
+	fmt.Fprintf(out, "\tcase _reflect.Slice:\n")
+	fmt.Fprintf(out, "\t\tif v.IsNil() {\n")
+	fmt.Fprintf(out, "\t\t\treturn\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\tkey := _cloneKey{v.Pointer(), v.Type(), v.Len()}\n")
+	fmt.Fprintf(out, "\t\tif s, found := seen[key]; found {\n")
+	fmt.Fprintf(out, "\t\t\tc.Set(s)\n")
+	fmt.Fprintf(out, "\t\t\treturn\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\ts := _reflect.MakeSlice(v.Type(), v.Len(), v.Cap())\n")
+	fmt.Fprintf(out, "\t\tseen[key] = s\n")
+	fmt.Fprintf(out, "\t\tc.Set(s)\n")
+	fmt.Fprintf(out, "\t\tfor i := 0; i < v.Len(); i++ {\n")
+	fmt.Fprintf(out, "\t\t\t_copy(s.Index(i), _rw(v.Index(i)), seen)\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\treturn\n")
+	fmt.Fprintf(out, "\tcase _reflect.Array:\n")
+	fmt.Fprintf(out, "\t\tfor i := 0; i < v.Len(); i++ {\n")
+	fmt.Fprintf(out, "\t\t\t_copy(c.Index(i), _rw(v.Index(i)), seen)\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\treturn\n")
+	fmt.Fprintf(out, "\tcase _reflect.Struct:\n")
+	fmt.Fprintf(out, "\t\tfor i := 0; i < v.NumField(); i++ {\n")
+	fmt.Fprintf(out, "\t\t\t_copy(_rw(c.Field(i)), _rw(v.Field(i)), seen)\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\treturn\n")
+	fmt.Fprintf(out, "\tcase _reflect.Interface:\n")
+	fmt.Fprintf(out, "\t\tif !v.IsNil() {\n")
+	fmt.Fprintf(out, "\t\t\tc.Set(_clone(v.Elem(), seen))\n")
+	fmt.Fprintf(out, "\t\t}\n")
+	fmt.Fprintf(out, "\t\treturn\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tc.Set(v)\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	fmt.Fprintf(out, "func (_ *_meta) Snapshot() {\n")
+	fmt.Fprintf(out, "\tsnapshot := make([]_reflect.Value, len(_vars))\n")
+	fmt.Fprintf(out, "\tseen := make(map[_cloneKey]_reflect.Value)\n")
+	fmt.Fprintf(out, "\tfor i, v := range _vars {\n")
+	fmt.Fprintf(out, "\t\tsnapshot[i] = _clone(_reflect.ValueOf(v).Elem(), seen)\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\t_stateLock.Lock()\n")
+	fmt.Fprintf(out, "\tdefer _stateLock.Unlock()\n")
+	fmt.Fprintf(out, "\t_snapshot = snapshot\n")
+	fmt.Fprintf(out, "}\n\n")
+
+	// The snapshot is copied again, so that it can be restored more than once
+	fmt.Fprintf(out, "func (_ *_meta) Restore() {\n")
+	fmt.Fprintf(out, "\t_stateLock.RLock()\n")
+	fmt.Fprintf(out, "\tsnapshot := _snapshot\n")
+	fmt.Fprintf(out, "\t_stateLock.RUnlock()\n")
+	fmt.Fprintf(out, "\tif snapshot == nil {\n")
+	fmt.Fprintf(out, "\t\tpanic(\"Restore called without a Snapshot\")\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "\tseen := make(map[_cloneKey]_reflect.Value)\n")
+	fmt.Fprintf(out, "\tfor i, v := range _vars {\n")
+	fmt.Fprintf(out, "\t\t_reflect.ValueOf(v).Elem().Set(_clone(snapshot[i], seen))\n")
+	fmt.Fprintf(out, "\t}\n")
+	fmt.Fprintf(out, "}\n\n")
+}
@@ -9,13 +9,15 @@ import (
 	"go/ast"
 	"go/parser"
 	"go/token"
-	"io"
+	"io/ioutil"
 	"os"
+	"sort"
 	"strings"
 )
 
 type rewrite struct {
 	offset  int
+	length  int
 	content string
 }
 
@@ -64,15 +66,14 @@ func mockFileImports(src, dst string, change map[string]string, cfg *Config) err
 			}
 
 			start := fset.Position(s.Path.Pos()).Offset
-			rewrites = append(rewrites, rewrite{start + 1, change[impPath]})
+			rewrites = append(rewrites, rewrite{start + 1, len(impPath), newPath})
 		}
 	}
 
-	r, err := os.Open(src)
+	data, err := ioutil.ReadFile(src)
 	if err != nil {
 		return err
 	}
-	defer r.Close()
 
 	w, err := os.Create(dst)
 	if err != nil {
@@ -80,9 +81,20 @@ func mockFileImports(src, dst string, change map[string]string, cfg *Config) err
 	}
 	defer w.Close()
 
-	// Start by copying the complete file contents
-	_, err = io.Copy(w, r)
-	if err != nil {
+	// Copy the file contents, applying the rewrites as we go.  The labels we
+	// rewrite to don't have to be the same length as the original import
+	// paths, so we can't just patch the file in place.
+	pos := 0
+	for _, rw := range rewrites {
+		if _, err := w.Write(data[pos:rw.offset]); err != nil {
+			return err
+		}
+		if _, err := w.WriteString(rw.content); err != nil {
+			return err
+		}
+		pos = rw.offset + rw.length
+	}
+	if _, err := w.Write(data[pos:]); err != nil {
 		return err
 	}
 
@@ -94,26 +106,19 @@ func mockFileImports(src, dst string, change map[string]string, cfg *Config) err
 			return err
 		}
 		if len(i) > 0 {
+			pkgs := make([]string, 0, len(i))
+			for pkg := range i {
+				pkgs = append(pkgs, pkg)
+			}
+			sort.Strings(pkgs)
 			fmt.Fprintf(w, "\nfunc init() {\n")
-			for pkg, impPath := range i {
-				c := cfg.Mock(impPath)
+			for _, pkg := range pkgs {
+				c := cfg.Mock(i[pkg])
 				fmt.Fprintf(w, "\t%s.%s().MockAll(true)\n", pkg, c.MOCK)
 			}
 			fmt.Fprintf(w, "}\n")
 		}
 	}
 
-	// Now we go back and apply any rewrites
-	for _, rw := range rewrites {
-		_, err := w.Seek(int64(rw.offset), 0)
-		if err != nil {
-			return err
-		}
-		_, err = w.WriteString(rw.content)
-		if err != nil {
-			return err
-		}
-	}
-
 	return nil
 }
@@ -0,0 +1,269 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// StaticMocksDir is the sub-directory of the output directory that GenStatic
+// puts the mocks of the package's interfaces in, as withmock would put them in
+// the _mocks_ package.
+const StaticMocksDir = "mocks"
+
+// generatedHeader is added to the start of every Go file written by GenStatic,
+// which also allows us to spot generated files that are no longer needed.
+const generatedHeader = "// Code generated by withmock gen. DO NOT EDIT.\n\n"
+
+// GenStatic generates the mock version of the package impPath, and mocks of
+// it's interfaces, in the same way as they are generated when running under
+// withmock - but for writing into a directory that can be committed (so the
+// code is formatted with gofmt).  The result maps file names (relative to the
+// output directory) to their content.
+func GenStatic(impPath string, cfg *MockConfig) (map[string][]byte, error) {
+	srcPath, err := LookupImportPath(impPath)
+	if err != nil {
+		return nil, Cerr{"LookupImportPath", err}
+	}
+
+	tmpDir, err := ioutil.TempDir("", "withmock-gen")
+	if err != nil {
+		return nil, Cerr{"ioutil.TempDir", err}
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dstPath := filepath.Join(tmpDir, "pkg")
+	if err := os.MkdirAll(dstPath, 0700); err != nil {
+		return nil, Cerr{"os.MkdirAll", err}
+	}
+
+	if _, err := MakePkg(srcPath, dstPath, impPath, true, cfg); err != nil {
+		return nil, Cerr{"MakePkg", err}
+	}
+
+	name, err := getPackageName(impPath, srcPath)
+	if err != nil {
+		return nil, Cerr{"getPackageName", err}
+	}
+
+	// The interface mocks use the real package, rather than the mock version.
+	// We can't use a dot import, as that would clash with the mock types that
+	// withmock adds to the package if it is then used under withmock.
+	mocksPath := filepath.Join(dstPath, StaticMocksDir)
+	err = mockInterfaces(mocksPath, impPath, impPath, name, cfg)
+	if err != nil {
+		return nil, Cerr{"mockInterfaces", err}
+	}
+
+	files := make(map[string][]byte)
+
+	err = filepath.Walk(dstPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		// Non-go files may be symlinks to the original, so we read through
+		// the link to get the content.
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dstPath, path)
+		if err != nil {
+			return err
+		}
+
+		// Not all of the generated code is run through gofmt when running
+		// under withmock, but committed code should be - otherwise running
+		// gofmt would make verify fail.
+		if strings.HasSuffix(path, ".go") {
+			data, err = format.Source(append([]byte(generatedHeader), data...))
+			if err != nil {
+				return fmt.Errorf("Failed to run gofmt on '%s': %s", rel, err)
+			}
+		}
+
+		files[rel] = data
+
+		return nil
+	})
+	if err != nil {
+		return nil, Cerr{"filepath.Walk", err}
+	}
+
+	return files, nil
+}
+
+// generatedFiles returns the names of the files in dir that were written by
+// GenStatic.
+func generatedFiles(dir string) (map[string]bool, error) {
+	found := make(map[string]bool)
+
+	for _, sub := range []string{"", StaticMocksDir} {
+		entries, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			name := filepath.Join(sub, entry.Name())
+			if entry.IsDir() || !strings.HasSuffix(name, ".go") {
+				continue
+			}
+
+			data, err := ioutil.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+
+			if bytes.HasPrefix(data, []byte(generatedHeader)) {
+				found[name] = true
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// isStaticMock returns true if the package in dir was written by GenStatic.
+func isStaticMock(dir string) bool {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+
+	found := false
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") ||
+			strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || !bytes.HasPrefix(data, []byte(generatedHeader)) {
+			return false
+		}
+
+		found = true
+	}
+
+	return found
+}
+
+// linkStaticMock links the files of the static mock package in src into dst,
+// and returns the imports of the package.  Unlike symlinkPackage, the
+// sub-directories are left alone - as the interface mocks are a separate
+// package.
+func linkStaticMock(src, dst string) (importSet, error) {
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return nil, Cerr{"os.MkdirAll", err}
+	}
+
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return nil, Cerr{"ioutil.ReadDir", err}
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || isModuleFile(entry.Name()) {
+			continue
+		}
+
+		from := filepath.Join(src, entry.Name())
+		to := filepath.Join(dst, entry.Name())
+		if err := os.Symlink(from, to); err != nil {
+			return nil, Cerr{"os.Symlink", err}
+		}
+	}
+
+	imports, err := GetImports(src, false)
+	if err != nil {
+		return nil, Cerr{"GetImports", err}
+	}
+
+	return imports, nil
+}
+
+// WriteGenerated writes the files generated by GenStatic into dir, removing
+// any previously generated files that are no longer required.
+func WriteGenerated(dir string, files map[string][]byte) error {
+	old, err := generatedFiles(dir)
+	if err != nil {
+		return Cerr{"generatedFiles", err}
+	}
+
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return Cerr{"os.MkdirAll", err}
+		}
+
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			return Cerr{"ioutil.WriteFile", err}
+		}
+	}
+
+	for name := range old {
+		if _, found := files[name]; found {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return Cerr{"os.Remove", err}
+		}
+	}
+
+	return nil
+}
+
+// CheckGenerated compares the files generated by GenStatic with the contents
+// of dir, and returns the names of any files that are out of date, missing, or
+// should no longer be there (in sorted order).
+func CheckGenerated(dir string, files map[string][]byte) ([]string, error) {
+	old, err := generatedFiles(dir)
+	if err != nil {
+		return nil, Cerr{"generatedFiles", err}
+	}
+
+	stale := []string{}
+
+	for name, data := range files {
+		current, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, Cerr{"ioutil.ReadFile", err}
+		}
+
+		if err != nil || !bytes.Equal(current, data) {
+			stale = append(stale, name)
+		}
+	}
+
+	for name := range old {
+		if _, found := files[name]; !found {
+			stale = append(stale, name)
+		}
+	}
+
+	sort.Strings(stale)
+
+	return stale, nil
+}
@@ -0,0 +1,176 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// pkgTypes holds the result of type checking a package, which is only needed
+// to find the types of variables that don't have the type written in the
+// declaration.
+type pkgTypes struct {
+	pkg  *types.Package
+	defs map[*ast.Ident]types.Object
+
+	// importMap maps import paths as written in the source to the actual
+	// package path (e.g. for vendored packages).
+	importMap map[string]string
+
+	// err is the first problem found type checking the package, as the types
+	// of any variables that depend on it can't be found.
+	err error
+}
+
+// checkTypes type checks the package made up of files (which are in dir),
+// using the export data of the packages it imports.  Any errors are recorded,
+// rather than returned, as the types that could be found are still useful.
+func checkTypes(fset *token.FileSet, dir string, files []*ast.File) *pkgTypes {
+	pt := &pkgTypes{
+		defs:      make(map[*ast.Ident]types.Object),
+		importMap: make(map[string]string),
+	}
+
+	if len(files) == 0 {
+		pt.err = fmt.Errorf("no files to type check")
+		return pt
+	}
+
+	exports, err := exportData(dir, pt.importMap)
+	if err != nil {
+		pt.err = err
+		return pt
+	}
+
+	gc := importer.ForCompiler(fset, "gc", func(path string) (io.ReadCloser, error) {
+		if file := exports[path]; file != "" {
+			return os.Open(file)
+		}
+		return nil, fmt.Errorf("no export data for %s", path)
+	})
+
+	conf := types.Config{
+		Importer: importerFunc(func(path string) (*types.Package, error) {
+			if actual, found := pt.importMap[path]; found {
+				path = actual
+			}
+			return gc.Import(path)
+		}),
+		FakeImportC: true,
+		Error: func(err error) {
+			if pt.err == nil {
+				pt.err = err
+			}
+		},
+	}
+
+	info := &types.Info{Defs: pt.defs}
+
+	pt.pkg, _ = conf.Check(files[0].Name.Name, fset, files, info)
+
+	return pt
+}
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) {
+	return f(path)
+}
+
+// exportData returns the export data files of the dependencies of the package
+// in dir, keyed by import path - building them if required.  The import map of
+// the package is added to importMap.
+func exportData(dir string, importMap map[string]string) (map[string]string, error) {
+	cmd := exec.Command("go", "list", "-e", "-export", "-deps", "-f",
+		"{{.ImportPath}} {{.Export}}{{if not .DepOnly}}"+
+			"{{range $from, $to := .ImportMap}} {{$from}}={{$to}}{{end}}{{end}}",
+		".")
+	cmd.Dir = dir
+
+	out, err := GetCmdOutput(cmd)
+	if err != nil {
+		return nil, Cerr{"GetCmdOutput", err}
+	}
+
+	exports := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		exports[fields[0]] = fields[1]
+		for _, mapping := range fields[2:] {
+			if i := strings.Index(mapping, "="); i >= 0 {
+				importMap[mapping[:i]] = mapping[i+1:]
+			}
+		}
+	}
+
+	return exports, nil
+}
+
+// typeString returns the type of the variable ident, as it can be written in
+// a file with the given imports (name to import path).  An error is returned
+// if the type can't be found, or can't be written in the file.
+func (pt *pkgTypes) typeString(ident *ast.Ident, imports map[string]string) (string, error) {
+	obj, found := pt.defs[ident]
+	if !found || obj == nil || obj.Type() == types.Typ[types.Invalid] {
+		if pt.err != nil {
+			return "", pt.err
+		}
+		return "", fmt.Errorf("unable to find the type of %s", ident.Name)
+	}
+
+	names := make(map[string]string)
+	for name, impPath := range imports {
+		if actual, found := pt.importMap[impPath]; found {
+			impPath = actual
+		}
+		names[impPath] = name
+	}
+
+	missing := ""
+	t := types.TypeString(obj.Type(), func(pkg *types.Package) string {
+		if pkg == pt.pkg {
+			return ""
+		}
+		name, found := names[pkg.Path()]
+		if !found && missing == "" {
+			missing = pkg.Path()
+		}
+		if name == "." {
+			return ""
+		}
+		return name
+	})
+
+	if missing != "" {
+		return "", fmt.Errorf("type %s uses %s, which isn't imported", t,
+			missing)
+	}
+
+	// Unexported types of other packages can't be written at all
+	expr, err := parser.ParseExpr(t)
+	if err != nil {
+		return "", fmt.Errorf("unable to write type %s", t)
+	}
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if s, ok := n.(*ast.SelectorExpr); ok && !s.Sel.IsExported() {
+			err = fmt.Errorf("type %s isn't exported", t)
+		}
+		return err == nil
+	})
+
+	return t, err
+}
@@ -0,0 +1,334 @@
+// Copyright 2013 Julian Phillips.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// workFile is the subset of a go.work file that we care about, as reported by
+// "go work edit -json".
+type workFile struct {
+	Go      string
+	Use     []workUse
+	Replace []modReplace
+}
+
+type workUse struct {
+	DiskPath string
+}
+
+// getWorkFile returns the go.work file in use for the current directory, or
+// an empty string if there isn't one.
+func getWorkFile() (string, error) {
+	work, err := GetOutput("go", "env", "GOWORK")
+	if err != nil {
+		return "", err
+	}
+
+	if work == "off" {
+		return "", nil
+	}
+
+	return work, nil
+}
+
+// readWorkFile parses the go.work file found at path.
+func readWorkFile(path string) (*workFile, error) {
+	out, err := GetOutput("go", "work", "edit", "-json", path)
+	if err != nil {
+		return nil, err
+	}
+
+	wf := &workFile{}
+	if err := json.Unmarshal([]byte(out), wf); err != nil {
+		return nil, Cerr{"json.Unmarshal", err}
+	}
+
+	return wf, nil
+}
+
+func (wf *workFile) write(path string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	fmt.Fprintf(out, "go %s\n", wf.Go)
+
+	if len(wf.Use) > 0 {
+		fmt.Fprintf(out, "\nuse (\n")
+		for _, u := range wf.Use {
+			fmt.Fprintf(out, "\t%s\n", u.DiskPath)
+		}
+		fmt.Fprintf(out, ")\n")
+	}
+
+	if len(wf.Replace) > 0 {
+		fmt.Fprintf(out, "\nreplace (\n")
+		for _, r := range wf.Replace {
+			fmt.Fprintf(out, "\t%s => %s\n", r.Old, r.New)
+		}
+		fmt.Fprintf(out, ")\n")
+	}
+
+	return nil
+}
+
+// workPath returns the path of the go.work file to be used inside the work
+// area.
+func (s *moduleSet) workPath() string {
+	return filepath.Join(filepath.Dir(s.root), "go.work")
+}
+
+// goWork returns the value that GOWORK should have inside the work area.
+func (s *moduleSet) goWork() string {
+	if s.work == "" {
+		return "off"
+	}
+	return s.workPath()
+}
+
+// writeWork creates a workspace that uses all the modules in the work area in
+// place of the originals.  Unless inPlace is set, the code under test comes
+// from the main module in the work area instead of the original workspace
+// modules.
+func (s *moduleSet) writeWork() error {
+	orig, err := readWorkFile(s.work)
+	if err != nil {
+		return Cerr{"readWorkFile", err}
+	}
+
+	work := &workFile{Go: orig.Go}
+
+	// Modules that are in the workspace can't also be replaced
+	used := make(map[string]bool)
+
+	use := func(path, dir, goVersion string) {
+		work.Use = append(work.Use, workUse{DiskPath: dir})
+		if goVersionLess(work.Go, goVersion) {
+			work.Go = goVersion
+		}
+		used[path] = true
+	}
+
+	if s.inPlace {
+		for _, mod := range s.workMods {
+			use(mod.Path, mod.Dir, mod.GoVersion)
+		}
+	} else {
+		// The main module takes the requirements of the workspace modules,
+		// so that their dependencies can still be found with -mod=readonly.
+		// Modules that will be in the workspace don't need requiring.
+		main := &modFile{
+			Module: modVersion{Path: testModule},
+			Go:     orig.Go,
+		}
+
+		inWork := make(map[string]bool)
+		for path := range s.mods {
+			inWork[path] = true
+		}
+		for _, mod := range s.workMods {
+			inWork[mod.Path] = true
+		}
+
+		for _, mod := range s.workMods {
+			mf, err := readModFile(mod.GoMod)
+			if err != nil {
+				return Cerr{"readModFile", err}
+			}
+			for _, r := range mf.Require {
+				if inWork[r.Path] {
+					continue
+				}
+				main.Require = append(main.Require, r)
+				inWork[r.Path] = true
+			}
+		}
+
+		if err := os.MkdirAll(s.mainDir(), 0700); err != nil {
+			return Cerr{"MkdirAll", err}
+		}
+
+		if err := main.write(filepath.Join(s.mainDir(), "go.mod")); err != nil {
+			return Cerr{"main.write", err}
+		}
+
+		use(testModule, s.mainDir(), orig.Go)
+	}
+
+	paths := make([]string, 0, len(s.mods))
+	for path := range s.mods {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		dir, goVersion, err := s.writeModule(path, orig.Go)
+		if err != nil {
+			return err
+		}
+		use(path, dir, goVersion)
+	}
+
+	// Our copies of the workspace modules don't include their replacements,
+	// so we need to include them along with the original replacements.  The
+	// go.work replacements come first, as they would normally win.
+	replaced := make(map[string]bool)
+
+	replace := func(r modReplace, base string) {
+		if used[r.Old.Path] || replaced[r.Old.String()] {
+			return
+		}
+		if r.New.Version == "" && !filepath.IsAbs(r.New.Path) {
+			r.New.Path = filepath.Join(base, r.New.Path)
+		}
+		work.Replace = append(work.Replace, r)
+		replaced[r.Old.String()] = true
+	}
+
+	for _, r := range orig.Replace {
+		replace(r, filepath.Dir(s.work))
+	}
+
+	for _, mod := range s.workMods {
+		mf, err := readModFile(mod.GoMod)
+		if err != nil {
+			return Cerr{"readModFile", err}
+		}
+		for _, r := range mf.Replace {
+			replace(r, mod.Dir)
+		}
+	}
+
+	if err := work.write(s.workPath()); err != nil {
+		return Cerr{"work.write", err}
+	}
+
+	// Finally, the workspace needs all of the checksums from the original
+	// workspace and it's modules.
+	sums := []string{filepath.Join(filepath.Dir(s.work), "go.work.sum")}
+	for _, mod := range s.workMods {
+		sums = append(sums, filepath.Join(mod.Dir, "go.sum"))
+	}
+
+	out, err := os.Create(s.workPath() + ".sum")
+	if err != nil {
+		return Cerr{"os.Create", err}
+	}
+	defer out.Close()
+
+	for _, sum := range sums {
+		if !exists(sum) {
+			continue
+		}
+		data, err := ioutil.ReadFile(sum)
+		if err != nil {
+			return Cerr{"ReadFile", err}
+		}
+		if _, err := out.Write(data); err != nil {
+			return Cerr{"out.Write", err}
+		}
+	}
+
+	return nil
+}
+
+// goVersionLess returns true if go version a is older than b (e.g. "1.21" is
+// older than "1.21.3").
+func goVersionLess(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+
+	num := func(s string) int {
+		if i := strings.IndexFunc(s, func(r rune) bool {
+			return r < '0' || r > '9'
+		}); i >= 0 {
+			s = s[:i]
+		}
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if x, y := num(as[i]), num(bs[i]); x != y {
+			return x < y
+		}
+	}
+
+	return len(as) < len(bs)
+}
+
+// ListPackages returns the packages matched by pattern, as reported by "go
+// list".  However, unlike "go list", a relative pattern ending in "/..." also
+// matches the packages of any workspace modules below the directory (e.g.
+// "./..." at the root of a workspace).
+func ListPackages(pattern string) ([]string, error) {
+	list, err := GetOutput("go", "list", pattern)
+	if err == nil {
+		return splitLines(list), nil
+	}
+
+	if !strings.HasPrefix(pattern, ".") || !strings.HasSuffix(pattern, "/...") {
+		return nil, err
+	}
+
+	work, werr := getWorkFile()
+	if werr != nil || work == "" {
+		return nil, err
+	}
+
+	base, werr := filepath.Abs(strings.TrimSuffix(pattern, "/..."))
+	if werr != nil {
+		return nil, err
+	}
+
+	mods, werr := getMainModules(work)
+	if werr != nil {
+		return nil, werr
+	}
+
+	pkgs := []string{}
+	for _, mod := range mods {
+		if !isInside(mod.Dir, base) {
+			continue
+		}
+
+		cmd := exec.Command("go", "list", "./...")
+		cmd.Dir = mod.Dir
+		list, err := GetCmdOutput(cmd)
+		if err != nil {
+			return nil, err
+		}
+
+		pkgs = append(pkgs, splitLines(list)...)
+	}
+
+	if len(pkgs) == 0 {
+		return nil, err
+	}
+
+	return pkgs, nil
+}
+
+func splitLines(s string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -22,6 +22,10 @@ var (
 	exclFile = flag.String("exclude", "", "any package listed in the given file will not be mocked, even if marked in test code.")
 	cfgFile  = flag.String("c", "", "load config from the specified file")
 	debug    = flag.Bool("debug", false, "enable extra output for debugging mock genertion issues")
+	overlay  = flag.Bool("overlay", false, "use the original code in place via an overlay, instead of copying packages into the work area")
+	goos     = flag.String("goos", "", "generate code for, and run the command with, the given GOOS")
+	goarch   = flag.String("goarch", "", "generate code for, and run the command with, the given GOARCH")
+	tags     = flag.String("tags", "", "comma separated list of build tags to use when generating code, and running the command")
 )
 
 func usage() {
@@ -31,6 +35,11 @@ func usage() {
 		"where imports of the package in the current directory which are "+
 		"marked for mocking are replacement by automatically generated mock "+
 		"versions for use with gomock.\n\n")
+	fmt.Fprintf(os.Stderr, "The cache of generated packages can be managed "+
+		"using \"%s cache\".\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Mocks can be written out for use without "+
+		"%s using \"%s gen\", and checked using \"%s verify\".\n\n",
+		os.Args[0], os.Args[0], os.Args[0])
 	fmt.Fprintf(os.Stderr, "options:\n\n")
 	flag.PrintDefaults()
 }
@@ -67,6 +76,33 @@ func doit() error {
 		os.Exit(1)
 	}
 
+	// "withmock cache ..." manages the cache, rather than running a command
+
+	if flag.Arg(0) == "cache" {
+		return doCache(flag.Args()[1:])
+	}
+
+	// Set the target and tags before anything runs the go command
+
+	if *goos != "" || *goarch != "" {
+		if err := lib.SetTarget(*goos, *goarch); err != nil {
+			return err
+		}
+	}
+
+	if *tags != "" {
+		if err := lib.SetBuildTags(*tags); err != nil {
+			return err
+		}
+	}
+
+	// "withmock gen ..." and "withmock verify ..." work with mocks written
+	// to disk, rather than running a command
+
+	if flag.Arg(0) == "gen" || flag.Arg(0) == "verify" {
+		return doGen(flag.Arg(0), flag.Args()[1:])
+	}
+
 	// First we need to create a context
 
 	ctxt, err := lib.NewContext()
@@ -83,6 +119,10 @@ func doit() error {
 		ctxt.DisableRewrite()
 	}
 
+	if *overlay {
+		ctxt.UseOverlay()
+	}
+
 	// Load the excluded packages file if configured
 
 	if *exclFile != "" {
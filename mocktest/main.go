@@ -9,7 +9,6 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"strings"
 	"syscall"
 
 	"github.com/qur/withmock/lib"
@@ -25,6 +24,10 @@ var (
 	exclFile = flag.String("exclude", "", "any package listed in the given file will not be mocked, even if marked in test code.")
 	cfgFile  = flag.String("c", "", "load config from the specified file")
 	debug    = flag.Bool("debug", false, "enable extra output for debugging mock genertion issues")
+	overlay  = flag.Bool("overlay", false, "use the original code in place via an overlay, instead of copying packages into the work area")
+	goos     = flag.String("goos", "", "generate code for, and run the command with, the given GOOS")
+	goarch   = flag.String("goarch", "", "generate code for, and run the command with, the given GOARCH")
+	tags     = flag.String("tags", "", "comma separated list of build tags to use when generating code, and running the command")
 )
 
 func usage() {
@@ -63,6 +66,20 @@ func doit() error {
 	flag.Usage = usage
 	flag.Parse()
 
+	// Set the target and tags before anything runs the go command
+
+	if *goos != "" || *goarch != "" {
+		if err := lib.SetTarget(*goos, *goarch); err != nil {
+			return err
+		}
+	}
+
+	if *tags != "" {
+		if err := lib.SetBuildTags(*tags); err != nil {
+			return err
+		}
+	}
+
 	args := flag.Args()
 	if len(args) == 0 {
 		args = []string{"."}
@@ -73,17 +90,11 @@ func doit() error {
 	pkgs := []string{}
 
 	for _, arg := range args {
-		list, err := lib.GetOutput("go", "list", arg)
+		list, err := lib.ListPackages(arg)
 		if err != nil {
-			return lib.Cerr{"go list", err}
-		}
-		for _, pkg := range strings.Split(list, "\n") {
-			pkg = strings.TrimSpace(pkg)
-			if len(pkg) == 0 {
-				continue
-			}
-			pkgs = append(pkgs, pkg)
+			return lib.Cerr{"ListPackages", err}
 		}
+		pkgs = append(pkgs, list...)
 	}
 
 	if len(pkgs) == 0 {
@@ -91,6 +102,23 @@ func doit() error {
 		os.Exit(1)
 	}
 
+	// With an overlay there is only one version of each package, so a package
+	// under test can't also be mocked for another package.  So we test each
+	// package on it's own.
+
+	if *overlay {
+		for _, pkg := range pkgs {
+			if err := testPackages([]string{pkg}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return testPackages(pkgs)
+}
+
+func testPackages(pkgs []string) error {
 	// First we need to create a context
 
 	ctxt, err := lib.NewContext()
@@ -107,6 +135,10 @@ func doit() error {
 		ctxt.DisableRewrite()
 	}
 
+	if *overlay {
+		ctxt.UseOverlay()
+	}
+
 	// Load the excluded packages file if configured
 
 	if *exclFile != "" {
@@ -126,7 +158,7 @@ func doit() error {
 	// Start building the command string that we will run
 
 	command := "go"
-	args = []string{"test"}
+	args := []string{"test"}
 	if *verbose {
 		args = append(args, "-v")
 	}
@@ -0,0 +1,12 @@
+package code
+
+import (
+	"fmt"
+
+	"github.com/qur/withmock/scenarios/auto_controller/lib"
+	"github.com/qur/withmock/scenarios/auto_controller/lib2"
+)
+
+func Describe(i int) string {
+	return fmt.Sprintf("%s: %d", lib2.Name(), lib.Double(i))
+}
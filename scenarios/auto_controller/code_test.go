@@ -0,0 +1,56 @@
+package code
+
+import (
+	"fmt"
+	"testing"
+
+	"code.google.com/p/gomock/gomock"
+
+	"github.com/qur/withmock/scenarios/auto_controller/lib"  // mock
+	"github.com/qur/withmock/scenarios/auto_controller/lib2" // mock
+)
+
+func TestDescribe(t *testing.T) {
+	withmock.T(t)
+
+	lib.EXPECT().Double(2).Return(5)
+	lib2.MOCK().On("Name").Return("mock")
+
+	if s := Describe(2); s != "mock: 5" {
+		t.Errorf("Expected 'mock: 5', got '%s'", s)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	for i := 1; i <= 4; i++ {
+		i := i
+		t.Run(fmt.Sprintf("test%d", i), func(t *testing.T) {
+			t.Parallel()
+
+			withmock.T(t)
+
+			lib.EXPECT().Double(gomock.Any()).Return(i)
+			lib2.MOCK().On("Name").Return(fmt.Sprint("mock", i))
+
+			expected := fmt.Sprintf("mock%d: %d", i, i)
+			if s := Describe(1); s != expected {
+				t.Errorf("Expected '%s', got '%s'", expected, s)
+			}
+		})
+	}
+}
+
+func TestController(t *testing.T) {
+	// The controller is returned, for use with mocks of interfaces
+	m := withmock.T(t)
+	if m.Controller == nil {
+		t.Fatalf("Expected a controller")
+	}
+
+	lib.EXPECT().Double(3).Return(7)
+	lib2.MOCK().On("Name").Return("mock")
+
+	if s := Describe(3); s != "mock: 7" {
+		t.Errorf("Expected 'mock: 7', got '%s'", s)
+	}
+}
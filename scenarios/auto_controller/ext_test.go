@@ -0,0 +1,18 @@
+package code_test
+
+import (
+	"testing"
+
+	"github.com/qur/withmock/scenarios/auto_controller/lib2" // mock
+)
+
+func TestExternal(t *testing.T) {
+	// Only lib2 is mocked here, so there is no controller
+	withmock.T(t)
+
+	lib2.MOCK().On("Name").Return("external")
+
+	if s := lib2.Name(); s != "external" {
+		t.Errorf("Expected 'external', got '%s'", s)
+	}
+}
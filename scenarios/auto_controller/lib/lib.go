@@ -0,0 +1,5 @@
+package lib
+
+func Double(i int) int {
+	return i * 2
+}
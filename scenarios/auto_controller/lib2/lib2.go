@@ -0,0 +1,5 @@
+package lib2
+
+func Name() string {
+	return "real"
+}
@@ -0,0 +1,9 @@
+package code
+
+import (
+	"github.com/qur/withmock/scenarios/build_tags/lib"
+)
+
+func TryMe() error {
+	return lib.Wibble()
+}
@@ -0,0 +1,9 @@
+//go:build !purego
+
+package lib
+
+import "example.invalid/asm"
+
+func wibble() error {
+	return asm.Wibble()
+}
@@ -0,0 +1,7 @@
+//go:build purego
+
+package lib
+
+func wibble() error {
+	return nil
+}
@@ -0,0 +1,9 @@
+package code
+
+import (
+	"github.com/qur/withmock/scenarios/cross_target/lib"
+)
+
+func Root() string {
+	return lib.Drive() + lib.Separator()
+}
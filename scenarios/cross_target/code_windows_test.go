@@ -0,0 +1,22 @@
+package code
+
+import (
+	"testing"
+
+	"code.google.com/p/gomock/gomock"
+
+	"github.com/qur/withmock/scenarios/cross_target/lib" // mock
+)
+
+func TestRoot(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	lib.MOCK().SetController(ctrl)
+	lib.EXPECT().Drive().Return("D:")
+	lib.EXPECT().Separator().Return("\\")
+
+	if r := Root(); r != "D:\\" {
+		t.Errorf("Expected 'D:\\', got '%s'", r)
+	}
+}
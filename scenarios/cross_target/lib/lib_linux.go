@@ -0,0 +1,5 @@
+package lib
+
+func Separator() string {
+	return "/"
+}
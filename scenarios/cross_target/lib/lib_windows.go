@@ -0,0 +1,9 @@
+package lib
+
+func Separator() string {
+	return "\\"
+}
+
+func Drive() string {
+	return "C:"
+}
@@ -0,0 +1,9 @@
+package code
+
+import (
+	"github.com/qur/withmock/scenarios/excluded_files/lib"
+)
+
+func TryMe() error {
+	return lib.Wibble()
+}
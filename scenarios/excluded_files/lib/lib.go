@@ -0,0 +1,9 @@
+package lib
+
+import (
+	"fmt"
+)
+
+func Wibble() error {
+	return fmt.Errorf("Not Mocked!")
+}
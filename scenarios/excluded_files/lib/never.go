@@ -0,0 +1,13 @@
+//go:build never
+
+package lib
+
+import "example.invalid/missing"
+
+type Source interface {
+	Get() missing.Value
+}
+
+func Wibble() error {
+	return missing.Wibble()
+}
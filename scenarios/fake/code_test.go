@@ -0,0 +1,212 @@
+package code
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qur/withmock/scenarios/fake/lib" // mock
+)
+
+func TestDescribe(t *testing.T) {
+	lib.MOCK().Scope(t)
+
+	lib.FAKE().Fetch(func(url string) (string, error) {
+		return "hello", nil
+	})
+
+	// Join has no fake, so the real version is called
+	s, err := Describe("http://example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s != "http://example.com: hello" {
+		t.Errorf("Expected 'http://example.com: hello', got '%s'", s)
+	}
+}
+
+func TestDescribeReset(t *testing.T) {
+	lib.MOCK().Scope(t)
+
+	// The fake set by TestDescribe should have been forgotten
+	if _, err := Describe("http://example.com"); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestUnscoped(t *testing.T) {
+	lib.FAKE().Fetch(func(url string) (string, error) {
+		return "unscoped", nil
+	})
+
+	// The fake is seen by the goroutines started by the test too
+	done := make(chan string)
+	go func() {
+		s, _ := Describe("url")
+		done <- s
+	}()
+	if s := <-done; s != "url: unscoped" {
+		t.Errorf("Expected 'url: unscoped', got '%s'", s)
+	}
+
+	// And by it's subtests, as they are part of the same test
+	t.Run("sub", func(t *testing.T) {
+		if s, _ := Describe("url"); s != "url: unscoped" {
+			t.Errorf("Expected 'url: unscoped', got '%s'", s)
+		}
+	})
+}
+
+func TestUnscopedReset(t *testing.T) {
+	// Without a scope, the fake set by TestUnscoped still belongs to that
+	// test - so the real version is called here
+	if _, err := Describe("url"); err == nil || err.Error() != "not implemented" {
+		t.Errorf("Expected the real Fetch to fail, got %v", err)
+	}
+}
+
+func TestJoin(t *testing.T) {
+	lib.MOCK().Scope(t)
+
+	t.Run("sub", func(t *testing.T) {
+		lib.FAKE().Join(func(sep string, parts ...string) string {
+			return sep + parts[1]
+		})
+	})
+
+	// The fake set by a subtest is kept for the rest of the test
+	if s := lib.Join("-", "a", "b"); s != "-b" {
+		t.Errorf("Expected '-b', got '%s'", s)
+	}
+}
+
+func TestCount(t *testing.T) {
+	lib.MOCK().Scope(t)
+
+	c1 := &lib.Client{}
+	c2 := &lib.Client{}
+
+	c1.FAKE().Lookup(func(key string) (int, error) {
+		return 42, nil
+	})
+
+	if n := Count(c1, "key"); n != 42 {
+		t.Errorf("Expected 42, got %d", n)
+	}
+	if n := Count(c2, "key"); n != -1 {
+		t.Errorf("Expected -1, got %d", n)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	lib.MOCK().Scope(t)
+
+	s := lib.MOCK().NewStore()
+
+	data := map[string]string{"a": "value"}
+	s.FAKE().Get(func(key string) (string, error) {
+		return data[key], nil
+	})
+	s.FAKE().Put(func(key, value string) error {
+		data[key] = value
+		return nil
+	})
+
+	if err := Copy(s, "a", "b"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if data["b"] != "value" {
+		t.Errorf("Expected 'value', got '%s'", data["b"])
+	}
+}
+
+func TestHead(t *testing.T) {
+	lib.MOCK().Scope(t)
+
+	lib.FAKE_First[string]().First(func(items []string) string {
+		return "fake"
+	})
+
+	if s := Head([]string{"a"}); s != "fake" {
+		t.Errorf("Expected 'fake', got '%s'", s)
+	}
+	if n := lib.First([]int{1}); n != 1 {
+		t.Errorf("Expected 1, got %d", n)
+	}
+}
+
+func TestNames(t *testing.T) {
+	lib.MOCK().Scope(t)
+
+	// Count has a value receiver, so all Names values share the same fake
+	lib.Names{}.FAKE().Count(func() int {
+		return 7
+	})
+
+	if n := (lib.Names{"a"}).Count(); n != 7 {
+		t.Errorf("Expected 7, got %d", n)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	for _, want := range []string{"one", "two"} {
+		want := want
+		t.Run(want, func(t *testing.T) {
+			t.Parallel()
+			lib.MOCK().Scope(t)
+
+			// Each test has it's own fakes, so they don't see each other's
+			lib.FAKE().Fetch(func(url string) (string, error) {
+				return want, nil
+			})
+			for i := 0; i < 100; i++ {
+				s, err := Describe("url")
+				if err != nil {
+					t.Fatalf("Unexpected error: %s", err)
+				}
+				if s != "url: "+want {
+					t.Fatalf("Expected 'url: %s', got '%s'", want, s)
+				}
+			}
+		})
+	}
+}
+
+func TestSince(t *testing.T) {
+	lib.MOCK().Scope(t)
+
+	// The hooks use types from packages imported by the mocked package
+	lib.FAKE().Since(func(t time.Time) time.Duration {
+		return time.Second
+	})
+	c := &lib.Client{}
+	c.FAKE().Timeout(func() time.Duration {
+		return time.Hour
+	})
+
+	if d := lib.Since(time.Now()); d != time.Second {
+		t.Errorf("Expected 1s, got %s", d)
+	}
+	if d := c.Timeout(); d != time.Hour {
+		t.Errorf("Expected 1h, got %s", d)
+	}
+}
+
+func TestSetWhileCalling(t *testing.T) {
+	lib.MOCK().Scope(t)
+
+	// Setting a hook while another goroutine calls the function is safe (as
+	// checked by go test -race)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			Describe("url")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		lib.FAKE().Fetch(func(url string) (string, error) {
+			return "set", nil
+		})
+	}
+	<-done
+}
@@ -0,0 +1,37 @@
+package lib
+
+import (
+	"errors"
+	"strings"
+)
+
+type Store interface {
+	Get(key string) (string, error)
+	Put(key, value string) error
+}
+
+type Client struct {
+	name string
+}
+
+func (c *Client) Lookup(key string) (int, error) {
+	return 0, errors.New("not implemented")
+}
+
+func Fetch(url string) (string, error) {
+	return "", errors.New("not implemented")
+}
+
+func Join(sep string, parts ...string) string {
+	return strings.Join(parts, sep)
+}
+
+func First[T any](items []T) T {
+	return items[0]
+}
+
+type Names []string
+
+func (n Names) Count() int {
+	return len(n)
+}
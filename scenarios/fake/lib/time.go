@@ -0,0 +1,13 @@
+package lib
+
+import (
+	"time"
+)
+
+func Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (c *Client) Timeout() time.Duration {
+	return time.Minute
+}
@@ -0,0 +1,52 @@
+package code
+
+import (
+	"fmt"
+
+	"github.com/qur/withmock/scenarios/generic_interface/lib"
+)
+
+type Number interface {
+	~int | ~int64 | ~float64
+}
+
+type Keyed interface {
+	comparable
+	Key() string
+}
+
+type Getter[T any] interface {
+	Get() T
+}
+
+type Source[T any] interface {
+	Getter[T]
+	fmt.Stringer
+	Next() (T, error)
+}
+
+type Pair[K comparable, V any] interface {
+	Getter[V]
+	Key() K
+}
+
+func Read[T any](src Source[T]) (T, error) {
+	if _, err := src.Next(); err != nil {
+		var zero T
+		return zero, err
+	}
+	return src.Get(), nil
+}
+
+func Lookup(c lib.Cache[string, int], key string) int {
+	v, ok := c.Get(key)
+	if !ok {
+		c.Put(key, 1)
+		return 1
+	}
+	return v
+}
+
+func Describe[K comparable, V any](p Pair[K, V]) string {
+	return fmt.Sprintf("%v=%v", p.Key(), p.Get())
+}
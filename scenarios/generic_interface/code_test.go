@@ -0,0 +1,64 @@
+package code_test
+
+import (
+	"testing"
+
+	"code.google.com/p/gomock/gomock"
+
+	"github.com/qur/withmock/scenarios/generic_interface/lib" // mock
+
+	"github.com/qur/withmock/scenarios/generic_interface"
+	"github.com/qur/withmock/scenarios/generic_interface/_mocks_"
+)
+
+func TestRead(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	code_mocks.SetController(ctrl)
+
+	src := code_mocks.NewSource[int]()
+
+	src.EXPECT().Next().Return(1, nil)
+	src.EXPECT().Get().Return(42)
+
+	v, err := code.Read[int](src)
+	if err != nil {
+		t.Errorf("Unexpected error return: %s", err)
+	}
+	if v != 42 {
+		t.Errorf("Expected 42, got %d", v)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	code_mocks.SetController(ctrl)
+
+	p := code_mocks.NewPair[string, int]()
+
+	p.EXPECT().Key().Return("a")
+	p.EXPECT().Get().Return(1)
+
+	if s := code.Describe[string, int](p); s != "a=1" {
+		t.Errorf("Expected a=1, got %s", s)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	lib.MOCK().SetController(ctrl)
+
+	c := &lib.MockCache[string, int]{}
+
+	c.EXPECT().Get("a").Return(0, false)
+	c.EXPECT().Put("a", 1)
+
+	if v := code.Lookup(c, "a"); v != 1 {
+		t.Errorf("Expected 1, got %d", v)
+	}
+}
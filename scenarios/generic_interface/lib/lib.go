@@ -0,0 +1,10 @@
+package lib
+
+type Cache[K comparable, V any] interface {
+	Get(key K) (V, bool)
+	Put(key K, value V)
+}
+
+type Ordered interface {
+	~int | ~string
+}
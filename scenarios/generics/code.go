@@ -0,0 +1,26 @@
+package code
+
+import (
+	"strconv"
+
+	"github.com/qur/withmock/scenarios/generics/lib"
+)
+
+func Total(values []string) int {
+	ints := lib.Map(values, func(s string) int {
+		i, _ := strconv.Atoi(s)
+		return i
+	})
+	return lib.Sum(ints...)
+}
+
+func Fill(l *lib.List[string], values ...string) int {
+	for _, v := range values {
+		l.Push(v)
+	}
+	return l.Len()
+}
+
+func Describe(p lib.Pair[string, int]) string {
+	return p.String()
+}
@@ -0,0 +1,52 @@
+package code
+
+import (
+	"testing"
+
+	"code.google.com/p/gomock/gomock"
+
+	"github.com/qur/withmock/scenarios/generics/lib" // mock
+)
+
+func TestTotal(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	lib.MOCK().SetController(ctrl)
+	lib.EXPECT_Map[string, int]().Map([]string{"1", "2"}, gomock.Any()).Return([]int{1, 2})
+	lib.EXPECT_Sum[int]().Sum(1, 2).Return(42)
+
+	if total := Total([]string{"1", "2"}); total != 42 {
+		t.Errorf("Expected 42, got %d", total)
+	}
+}
+
+func TestFill(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	lib.MOCK().SetController(ctrl)
+
+	l := &lib.List[string]{}
+	l.EXPECT().Push("a")
+	l.EXPECT().Push("b")
+	l.EXPECT().Len().Return(7)
+
+	if n := Fill(l, "a", "b"); n != 7 {
+		t.Errorf("Expected 7, got %d", n)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	lib.MOCK().SetController(ctrl)
+
+	p := lib.Pair[string, int]{}
+	p.EXPECT().String().Return("mocked")
+
+	if s := Describe(p); s != "mocked" {
+		t.Errorf("Expected mocked, got %s", s)
+	}
+}
@@ -0,0 +1,42 @@
+package lib
+
+type Number interface {
+	~int | ~int64 | ~float64
+}
+
+func Sum[T Number](values ...T) T {
+	var total T
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
+
+func Map[T, U any](in []T, f func(T) U) []U {
+	out := make([]U, 0, len(in))
+	for _, v := range in {
+		out = append(out, f(v))
+	}
+	return out
+}
+
+type List[T any] struct {
+	items []T
+}
+
+func (l *List[T]) Push(v T) {
+	l.items = append(l.items, v)
+}
+
+func (l *List[E]) Len() int {
+	return len(l.items)
+}
+
+type Pair[K comparable, V any] struct {
+	Key K
+	Value V
+}
+
+func (p Pair[K, V]) String() string {
+	return "pair"
+}
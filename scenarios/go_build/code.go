@@ -0,0 +1,9 @@
+package code
+
+import (
+	"github.com/qur/withmock/scenarios/go_build/lib"
+)
+
+func TryMe() error {
+	return lib.Wibble()
+}
@@ -0,0 +1,7 @@
+//go:build ignore
+
+package lib
+
+func Wibble() error {
+	return nil
+}
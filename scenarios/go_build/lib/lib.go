@@ -0,0 +1,5 @@
+package lib
+
+func Wibble() error {
+	return wibble()
+}
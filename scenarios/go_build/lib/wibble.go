@@ -0,0 +1,7 @@
+//go:build go1.1 && (linux || darwin || !windows)
+
+package lib
+
+func wibble() error {
+	return nil
+}
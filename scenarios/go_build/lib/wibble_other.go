@@ -0,0 +1,7 @@
+//go:build !go1.1 || (windows && !linux)
+
+package lib
+
+func wibble() error {
+	return nil
+}
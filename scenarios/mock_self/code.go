@@ -0,0 +1,35 @@
+package code
+
+import (
+	"fmt"
+
+	"github.com/qur/withmock/scenarios/mock_self/lib"
+)
+
+func Total(names ...string) (int, error) {
+	total := 0
+	for _, name := range names {
+		n, err := Count(name)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func Count(name string) (int, error) {
+	n, err := lib.Lookup(name)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", name, err)
+	}
+	return n, nil
+}
+
+type Source interface {
+	Names() []string
+}
+
+func TotalOf(s Source) (int, error) {
+	return Total(s.Names()...)
+}
@@ -0,0 +1,48 @@
+package code
+
+// mock self
+
+import (
+	"testing"
+
+	"code.google.com/p/gomock/gomock"
+
+	"github.com/qur/withmock/scenarios/mock_self/lib" // mock
+)
+
+func TestTotal(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	MOCK().SetController(ctrl)
+	MOCK().EnableMock("Count")
+	defer MOCK().DisableMock("Count")
+
+	EXPECT().Count("a").Return(1, nil)
+	EXPECT().Count("b").Return(2, nil)
+
+	n, err := Total("a", "b")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if n != 3 {
+		t.Errorf("Expected 3, got %d", n)
+	}
+}
+
+func TestCount(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	lib.MOCK().SetController(ctrl)
+	lib.EXPECT().Lookup("a").Return(4, nil)
+
+	// Count isn't mocked, so the real code is run
+	n, err := Count("a")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if n != 4 {
+		t.Errorf("Expected 4, got %d", n)
+	}
+}
@@ -0,0 +1,49 @@
+package code_test
+
+import (
+	"errors"
+	"testing"
+
+	"code.google.com/p/gomock/gomock"
+
+	"github.com/qur/withmock/scenarios/mock_self"
+	"github.com/qur/withmock/scenarios/mock_self/_mocks_"
+)
+
+func TestTotalError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	code.MOCK().SetController(ctrl)
+	code.MOCK().EnableMock("Count")
+	defer code.MOCK().DisableMock("Count")
+
+	code.EXPECT().Count("a").Return(0, errors.New("failed"))
+
+	if _, err := code.Total("a", "b"); err == nil || err.Error() != "failed" {
+		t.Errorf("Expected 'failed' error, got %v", err)
+	}
+}
+
+func TestTotalOf(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	code.MOCK().SetController(ctrl)
+	code.MOCK().EnableMock("Total")
+	defer code.MOCK().DisableMock("Total")
+
+	code_mocks.SetController(ctrl)
+
+	s := code_mocks.NewSource()
+	s.EXPECT().Names().Return([]string{"a", "b"})
+	code.EXPECT().Total("a", "b").Return(5, nil)
+
+	n, err := code.TotalOf(s)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if n != 5 {
+		t.Errorf("Expected 5, got %d", n)
+	}
+}
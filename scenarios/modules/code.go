@@ -0,0 +1,20 @@
+package code
+
+import "example.com/modules/lib"
+
+func Describe(url string) (string, error) {
+	s, err := lib.Fetch(url)
+	if err != nil {
+		return "", err
+	}
+	return url + ": " + s, nil
+}
+
+// Recovered returns what recover sees for a nil panic, which depends on the
+// panicnil setting of the main module.
+func Recovered() (r interface{}) {
+	defer func() {
+		r = recover()
+	}()
+	panic(nil)
+}
@@ -0,0 +1,28 @@
+package code
+
+import (
+	"testing"
+
+	"example.com/modules/lib" // mock
+)
+
+func TestDescribe(t *testing.T) {
+	lib.FAKE().Fetch(func(url string) (string, error) {
+		return "hello", nil
+	})
+
+	s, err := Describe("http://example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s != "http://example.com: hello" {
+		t.Errorf("Expected 'http://example.com: hello', got '%s'", s)
+	}
+}
+
+func TestGoDebug(t *testing.T) {
+	// The godebug setting from go.mod should have been kept
+	if r := Recovered(); r != nil {
+		t.Errorf("Expected nil, got %v", r)
+	}
+}
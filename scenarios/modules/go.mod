@@ -0,0 +1,7 @@
+module example.com/modules
+
+go 1.23
+
+toolchain go1.23.0
+
+godebug panicnil=1
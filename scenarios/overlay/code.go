@@ -0,0 +1,16 @@
+package code
+
+import (
+	"runtime"
+
+	"github.com/qur/withmock/scenarios/overlay/lib"
+)
+
+func TryMe() error {
+	return lib.Wibble()
+}
+
+func Where() string {
+	_, file, _, _ := runtime.Caller(0)
+	return file
+}
@@ -0,0 +1,33 @@
+package code
+
+import (
+	"strings"
+	"testing"
+
+	"code.google.com/p/gomock/gomock"
+
+	"github.com/qur/withmock/scenarios/overlay/lib" // mock
+)
+
+func TestTryMe(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	lib.MOCK().SetController(ctrl)
+	lib.EXPECT().Wibble().Return(nil)
+
+	// Run the function we want to test
+	err := TryMe()
+
+	if err != nil {
+		t.Errorf("Unexpected error return: %s", err)
+	}
+}
+
+func TestWhere(t *testing.T) {
+	// With an overlay the code under test is built from it's original
+	// location, rather than a copy in the work area
+	if file := Where(); strings.Contains(file, "/_test_/") {
+		t.Errorf("Expected original location, got '%s'", file)
+	}
+}
@@ -0,0 +1,20 @@
+package code
+
+import (
+	"fmt"
+
+	"github.com/qur/withmock/scenarios/record/lib"
+)
+
+func Describe(c *lib.Client, keys ...string) (string, error) {
+	descs := []string{}
+	for _, key := range keys {
+		item, err := c.Lookup(key)
+		if err != nil {
+			return "", err
+		}
+		descs = append(descs, fmt.Sprintf("%s=%d", item.Name, item.Count))
+	}
+	lib.Log("described")
+	return lib.Join(", ", descs...), nil
+}
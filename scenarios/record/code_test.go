@@ -0,0 +1,195 @@
+package code
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/qur/withmock/scenarios/record/lib" // mock
+)
+
+func TestRecordReplay(t *testing.T) {
+	lib.MOCK().MockAll(true)
+	defer lib.MOCK().MockAll(false)
+
+	file := filepath.Join(t.TempDir(), "describe.json")
+
+	t.Run("record", func(t *testing.T) {
+		lib.MOCK().Record(t, file)
+
+		s, err := Describe(&lib.Client{}, "a", "bb")
+		if err != nil || s != "a=1, bb=2" {
+			t.Errorf("Expected 'a=1, bb=2', got '%s', %v", s, err)
+		}
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		lib.MOCK().Replay(t, file)
+
+		s, err := Describe(&lib.Client{}, "a", "bb")
+		if err != nil || s != "a=1, bb=2" {
+			t.Errorf("Expected 'a=1, bb=2', got '%s', %v", s, err)
+		}
+	})
+}
+
+// TestReplayGolden replays a recording made when Lookup returned different
+// values, so we know that the real code isn't being called.
+func TestReplayGolden(t *testing.T) {
+	lib.MOCK().MockAll(true)
+	defer lib.MOCK().MockAll(false)
+
+	lib.MOCK().Replay(t, "testdata/golden.json")
+
+	s, err := Describe(&lib.Client{}, "a")
+	if err != nil || s != "x=42" {
+		t.Errorf("Expected 'x=42', got '%s', %v", s, err)
+	}
+
+	_, err = Describe(&lib.Client{}, "")
+	if err == nil || err.Error() != "lookup failed" {
+		t.Errorf("Expected 'lookup failed', got %v", err)
+	}
+}
+
+type fakeT struct {
+	*testing.T
+	errors []string
+}
+
+func (f *fakeT) Errorf(format string, args ...interface{}) {
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+}
+
+func TestReplayMismatch(t *testing.T) {
+	lib.MOCK().MockAll(true)
+	defer lib.MOCK().MockAll(false)
+
+	ft := &fakeT{T: t}
+	lib.MOCK().Replay(ft, "testdata/golden.json")
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected a panic")
+			}
+		}()
+		Describe(&lib.Client{}, "b")
+	}()
+
+	if len(ft.errors) != 1 || !strings.Contains(ft.errors[0],
+		`expected: Client.Lookup("a")`) {
+		t.Errorf("Expected a mismatch error, got %v", ft.errors)
+	}
+}
+
+type upperCodec struct{}
+
+func (upperCodec) Encode(v interface{}) ([]byte, error) {
+	if s, ok := v.(string); ok {
+		v = strings.ToUpper(s)
+	}
+	return json.Marshal(v)
+}
+
+func (upperCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func TestCodec(t *testing.T) {
+	lib.MOCK().EnableMock("Join")
+	defer lib.MOCK().MockAll(false)
+
+	lib.MOCK().SetCodec(upperCodec{})
+	defer lib.MOCK().SetCodec(nil)
+
+	file := filepath.Join(t.TempDir(), "join.json")
+
+	t.Run("record", func(t *testing.T) {
+		lib.MOCK().Record(t, file)
+		lib.Join("-", "a", "b")
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		lib.MOCK().Replay(t, file)
+		if s := lib.Join("-", "a", "b"); s != "A-B" {
+			t.Errorf("Expected 'A-B', got '%s'", s)
+		}
+	})
+}
+
+func check(ok bool) (p interface{}) {
+	defer func() {
+		p = recover()
+	}()
+	lib.Check(ok)
+	return nil
+}
+
+func TestRecordPanic(t *testing.T) {
+	lib.MOCK().EnableMock("Check")
+	defer lib.MOCK().MockAll(false)
+
+	file := filepath.Join(t.TempDir(), "check.json")
+
+	t.Run("record", func(t *testing.T) {
+		lib.MOCK().Record(t, file)
+		if p := check(false); p != "check failed" {
+			t.Errorf("Expected 'check failed', got %v", p)
+		}
+		if p := check(true); p != nil {
+			t.Errorf("Unexpected panic: %v", p)
+		}
+	})
+
+	// The panic is part of the recording, so it happens again
+	t.Run("replay", func(t *testing.T) {
+		lib.MOCK().Replay(t, file)
+		if p := check(false); p != "check failed" {
+			t.Errorf("Expected 'check failed', got %v", p)
+		}
+		if p := check(true); p != nil {
+			t.Errorf("Unexpected panic: %v", p)
+		}
+	})
+}
+
+func TestParallel(t *testing.T) {
+	for _, upper := range []bool{false, true} {
+		upper := upper
+		t.Run(fmt.Sprint(upper), func(t *testing.T) {
+			t.Parallel()
+
+			// Each test has it's own codec and recording
+			lib.MOCK().Scope(t)
+			lib.MOCK().EnableMock("Join")
+			if upper {
+				lib.MOCK().SetCodec(upperCodec{})
+			}
+
+			want := "a-b"
+			if upper {
+				want = "A-B"
+			}
+			file := filepath.Join(t.TempDir(), "join.json")
+
+			t.Run("record", func(t *testing.T) {
+				lib.MOCK().Record(t, file)
+				for i := 0; i < 100; i++ {
+					lib.Join("-", "a", "b")
+				}
+			})
+
+			t.Run("replay", func(t *testing.T) {
+				lib.MOCK().Replay(t, file)
+				for i := 0; i < 100; i++ {
+					if s := lib.Join("-", "a", "b"); s != want {
+						t.Fatalf("Expected '%s', got '%s'", want, s)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package lib
+
+import (
+	"errors"
+	"strings"
+)
+
+type Item struct {
+	Name  string
+	Count int
+}
+
+type Client struct {
+	name string
+}
+
+func (c *Client) Lookup(key string) (*Item, error) {
+	if key == "" {
+		return nil, errors.New("no key")
+	}
+	return &Item{Name: key, Count: len(key)}, nil
+}
+
+func Join(sep string, parts ...string) string {
+	return strings.Join(parts, sep)
+}
+
+func Log(msg string) {
+}
+
+func Check(ok bool) {
+	if !ok {
+		panic("check failed")
+	}
+}
@@ -0,0 +1,31 @@
+package code
+
+import (
+	"sync"
+
+	"github.com/qur/withmock/scenarios/scope/lib"
+)
+
+// DoubleAll doubles each value in it's own goroutine.
+func DoubleAll(values ...int) []int {
+	results := make([]int, len(values))
+	wg := sync.WaitGroup{}
+	for i, v := range values {
+		wg.Add(1)
+		go func(i, v int) {
+			defer wg.Done()
+			results[i] = lib.Double(v)
+		}(i, v)
+	}
+	wg.Wait()
+	return results
+}
+
+// DoubleLater doubles each value from goroutines started by another goroutine.
+func DoubleLater(values ...int) []int {
+	results := make(chan []int)
+	go func() {
+		results <- DoubleAll(values...)
+	}()
+	return <-results
+}
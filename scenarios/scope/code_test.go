@@ -0,0 +1,167 @@
+package code
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"code.google.com/p/gomock/gomock"
+
+	"github.com/qur/withmock/scenarios/scope/lib" // mock
+)
+
+func TestParallel(t *testing.T) {
+	for i := 1; i <= 4; i++ {
+		i := i
+		t.Run(fmt.Sprintf("mock%d", i), func(t *testing.T) {
+			t.Parallel()
+
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			lib.MOCK().Scope(t)
+			lib.MOCK().SetController(ctrl)
+			lib.MOCK().MockAll(true)
+
+			lib.EXPECT().Double(gomock.Any()).Return(i).Times(3)
+
+			for _, n := range DoubleAll(1, 2, 3) {
+				if n != i {
+					t.Errorf("Expected %d, got %d", i, n)
+				}
+			}
+		})
+		t.Run(fmt.Sprintf("real%d", i), func(t *testing.T) {
+			t.Parallel()
+
+			lib.MOCK().Scope(t)
+			lib.MOCK().MockAll(false)
+
+			results := DoubleAll(1, 2, 3)
+			if results[0] != 2 || results[1] != 4 || results[2] != 6 {
+				t.Errorf("Expected [2 4 6], got %v", results)
+			}
+		})
+	}
+}
+
+func TestNested(t *testing.T) {
+	for i := 1; i <= 4; i++ {
+		i := i
+		t.Run(fmt.Sprintf("mock%d", i), func(t *testing.T) {
+			t.Parallel()
+
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			lib.MOCK().Scope(t)
+			lib.MOCK().SetController(ctrl)
+			lib.MOCK().MockAll(true)
+
+			// The calls are made by goroutines started from a goroutine that
+			// the test started, which still find the test's scope
+			lib.EXPECT().Double(gomock.Any()).Return(i).Times(2)
+
+			for _, n := range DoubleLater(1, 2) {
+				if n != i {
+					t.Errorf("Expected %d, got %d", i, n)
+				}
+			}
+		})
+	}
+}
+
+func TestUntraced(t *testing.T) {
+	call := make(chan bool)
+	done := make(chan interface{})
+
+	// The goroutine is started by a test without a scope, so it can't be
+	// traced to the scopes of the subtests
+	go func() {
+		<-call
+		defer func() {
+			done <- recover()
+		}()
+		lib.Double(1)
+	}()
+
+	t.Run("outer", func(t *testing.T) {
+		lib.MOCK().Scope(t)
+		t.Run("inner", func(t *testing.T) {
+			lib.MOCK().Scope(t)
+
+			// With more than one scope, the goroutine can't be given one
+			call <- true
+			r := <-done
+			if r == nil || !strings.Contains(fmt.Sprint(r), "can't be traced") {
+				t.Errorf("Expected a panic, got %v", r)
+			}
+		})
+	})
+}
+
+func TestSubtest(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	lib.MOCK().Scope(t)
+	lib.MOCK().SetController(ctrl)
+	lib.MOCK().MockAll(true)
+
+	t.Run("inherit", func(t *testing.T) {
+		// Without a scope of it's own, the subtest uses the parent's
+		lib.EXPECT().Name().Return("mock")
+		if s := lib.Name(); s != "mock" {
+			t.Errorf("Expected 'mock', got '%s'", s)
+		}
+	})
+
+	t.Run("push", func(t *testing.T) {
+		lib.MOCK().Scope(t)
+		lib.MOCK().DisableMock("Name")
+		if s := lib.Name(); s != "real" {
+			t.Errorf("Expected 'real', got '%s'", s)
+		}
+	})
+
+	// And once the subtest is finished, it's scope is gone
+	lib.EXPECT().Name().Return("mock")
+	if s := lib.Name(); s != "mock" {
+		t.Errorf("Expected 'mock', got '%s'", s)
+	}
+}
+
+type fakeT struct {
+	*testing.T
+	errors []string
+}
+
+func (f *fakeT) Errorf(format string, args ...interface{}) {
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+}
+
+func TestCheckLeaks(t *testing.T) {
+	lib.MOCK().CheckLeaks(t)
+
+	// A test in it's own scope can't leak
+	t.Run("scoped", func(t *testing.T) {
+		lib.MOCK().CheckLeaks(t)
+		lib.MOCK().Scope(t)
+		lib.MOCK().MockAll(true)
+	})
+
+	ft := &fakeT{}
+	t.Run("leaky", func(t *testing.T) {
+		ft.T = t
+		lib.MOCK().CheckLeaks(ft)
+		lib.MOCK().EnableMock("Double")
+	})
+
+	if len(ft.errors) != 1 || !strings.Contains(ft.errors[0],
+		`EnableMock["Double"]`) {
+		t.Errorf("Expected a leak to be reported, got %v", ft.errors)
+	}
+
+	// Put things back as they were (withmock mocks everything by default)
+	lib.MOCK().MockAll(true)
+}
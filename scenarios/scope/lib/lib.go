@@ -0,0 +1,9 @@
+package lib
+
+func Double(i int) int {
+	return i * 2
+}
+
+func Name() string {
+	return "real"
+}
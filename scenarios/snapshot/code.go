@@ -0,0 +1,13 @@
+package code
+
+import (
+	"github.com/qur/withmock/scenarios/snapshot/lib"
+)
+
+func Count(keys ...string) int {
+	total := 0
+	for _, key := range keys {
+		total += lib.Lookup(key)
+	}
+	return total
+}
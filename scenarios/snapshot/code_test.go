@@ -0,0 +1,60 @@
+package code
+
+import (
+	"testing"
+
+	"github.com/qur/withmock/scenarios/snapshot/lib" // mock
+)
+
+func init() {
+	lib.MOCK().Snapshot()
+}
+
+func TestFirst(t *testing.T) {
+	lib.MOCK().Restore()
+	lib.MOCK().MockAll(false)
+
+	lib.Register("first")
+	lib.SetLevel(0, 10)
+	lib.Rename("first")
+
+	if n := Count("a", "bb", "a"); n != 4 {
+		t.Errorf("Expected 4, got %d", n)
+	}
+	if calls, size, setup := lib.Stats(); calls != 3 || size != 2 || !setup {
+		t.Errorf("Expected 3 2 true, got %d %d %v", calls, size, setup)
+	}
+}
+
+func TestSecond(t *testing.T) {
+	lib.MOCK().Restore()
+	lib.MOCK().MockAll(false)
+
+	// Everything should be as it was after init, rather than left over
+	// from TestFirst
+	if calls, size, setup := lib.Stats(); calls != 0 || size != 0 || setup {
+		t.Errorf("Expected 0 0 false, got %d %d %v", calls, size, setup)
+	}
+	if r := lib.Registered(); len(r) != 1 || r[0] != "default" {
+		t.Errorf("Expected [default], got %v", r)
+	}
+
+	// Changes made to the elements of a slice, or through a pointer, should
+	// also be undone
+	if l := lib.Levels(); l[0] != 1 {
+		t.Errorf("Expected level 1, got %d", l[0])
+	}
+	c := lib.Current
+	if c.Name != "default" || c.Tags[0] != "default" || c.Owner != c {
+		t.Errorf("Expected default config, got %s %v %v", c.Name, c.Tags,
+			c.Owner == c)
+	}
+	lib.Rename("second")
+
+	if n := Count("ccc"); n != 3 {
+		t.Errorf("Expected 3, got %d", n)
+	}
+	if calls, size, setup := lib.Stats(); calls != 1 || size != 1 || !setup {
+		t.Errorf("Expected 1 1 true, got %d %d %v", calls, size, setup)
+	}
+}
@@ -0,0 +1,65 @@
+package lib
+
+import "sync"
+
+var (
+	cache    = map[string]int{}
+	registry []string
+	calls    int
+	once     sync.Once
+	setup    bool
+	levels   = []int{1, 2, 3}
+)
+
+type Config struct {
+	mu    sync.Mutex
+	Name  string
+	Tags  []string
+	Owner *Config
+}
+
+var Current = &Config{Name: "default", Tags: []string{"default"}}
+
+func init() {
+	Register("default")
+	Current.Owner = Current
+}
+
+func SetLevel(i, level int) {
+	levels[i] = level
+}
+
+func Levels() []int {
+	return levels
+}
+
+func Rename(name string) {
+	Current.mu.Lock()
+	defer Current.mu.Unlock()
+	Current.Name = name
+	Current.Tags[0] = name
+}
+
+func Register(name string) {
+	registry = append(registry, name)
+}
+
+func Registered() []string {
+	return registry
+}
+
+func Lookup(key string) int {
+	once.Do(func() {
+		setup = true
+	})
+	calls++
+	if v, found := cache[key]; found {
+		return v
+	}
+	cache[key] = len(key)
+	return cache[key]
+}
+
+func Stats() (int, int, bool) {
+	return calls, len(cache), setup
+}
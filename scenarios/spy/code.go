@@ -0,0 +1,23 @@
+package code
+
+import (
+	"github.com/qur/withmock/scenarios/spy/lib"
+)
+
+func Describe(c *lib.Client, key string) string {
+	n, err := c.Lookup(key)
+	if err != nil {
+		lib.Log(err.Error())
+		return ""
+	}
+	lib.Log("found " + key)
+	return lib.Join(": ", key, string(rune('0'+n)))
+}
+
+func MustCheck(ok bool) (err interface{}) {
+	defer func() {
+		err = recover()
+	}()
+	lib.Check(ok)
+	return nil
+}
@@ -0,0 +1,124 @@
+package code
+
+import (
+	"testing"
+
+	"code.google.com/p/gomock/gomock"
+
+	"github.com/qur/withmock/scenarios/spy/lib" // mock
+)
+
+func TestDescribe(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	lib.MOCK().SetController(ctrl)
+	lib.MOCK().MockAll(true)
+	lib.MOCK().ClearCalls()
+
+	// Log is mocked, while Lookup and Join run for real
+	lib.MOCK().Spy("Client.Lookup", "Join")
+	lib.EXPECT().Log("found abc")
+
+	c := &lib.Client{}
+	if s := Describe(c, "abc"); s != "abc: 3" {
+		t.Errorf("Expected 'abc: 3', got '%s'", s)
+	}
+
+	calls := lib.MOCK().Calls("Client.Lookup")
+	if len(calls) != 1 {
+		t.Fatalf("Expected 1 call, got %d", len(calls))
+	}
+	if calls[0].Recv != c {
+		t.Errorf("Expected receiver %p, got %v", c, calls[0].Recv)
+	}
+	if calls[0].Args[0] != "abc" {
+		t.Errorf("Expected 'abc', got %v", calls[0].Args[0])
+	}
+	if calls[0].Results[0] != 3 || calls[0].Results[1] != nil {
+		t.Errorf("Expected 3 and nil, got %v", calls[0].Results)
+	}
+	if calls[0].Start.IsZero() || calls[0].Duration < 0 {
+		t.Errorf("Expected timing, got %v, %v", calls[0].Start,
+			calls[0].Duration)
+	}
+
+	calls = lib.MOCK().Calls("Join")
+	if len(calls) != 1 {
+		t.Fatalf("Expected 1 call, got %d", len(calls))
+	}
+	parts := calls[0].Args[1].([]string)
+	if len(parts) != 2 || parts[0] != "abc" || parts[1] != "3" {
+		t.Errorf("Expected [abc 3], got %v", parts)
+	}
+
+	if n := len(lib.MOCK().Calls("Log")); n != 0 {
+		t.Errorf("Expected no calls of mocked Log, got %d", n)
+	}
+}
+
+func TestSpyAll(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	lib.MOCK().SetController(ctrl)
+	lib.MOCK().SpyAll(true)
+	lib.MOCK().ClearCalls()
+
+	// Mocking can still be enabled for a particular function
+	lib.MOCK().EnableMock("Log")
+	lib.EXPECT().Log("no key")
+
+	if s := Describe(&lib.Client{}, ""); s != "" {
+		t.Errorf("Expected '', got '%s'", s)
+	}
+
+	calls := lib.MOCK().Calls("Client.Lookup")
+	if len(calls) != 1 || calls[0].Results[1] == nil {
+		t.Errorf("Expected 1 failed call, got %v", calls)
+	}
+
+	if err := MustCheck(false); err != "check failed" {
+		t.Errorf("Expected 'check failed', got %v", err)
+	}
+	if err := MustCheck(true); err != nil {
+		t.Errorf("Unexpected panic: %v", err)
+	}
+
+	calls = lib.MOCK().Calls("Check")
+	if len(calls) != 2 {
+		t.Fatalf("Expected 2 calls, got %d", len(calls))
+	}
+	if calls[0].Panic != "check failed" || calls[1].Panic != nil {
+		t.Errorf("Expected the first call to panic, got %v and %v",
+			calls[0].Panic, calls[1].Panic)
+	}
+
+	lib.MOCK().SpyAll(false)
+}
+
+func TestParallel(t *testing.T) {
+	for _, key := range []string{"a", "b"} {
+		key := key
+		t.Run(key, func(t *testing.T) {
+			t.Parallel()
+			lib.MOCK().Scope(t)
+			lib.MOCK().Spy("Join")
+
+			for i := 0; i < 100; i++ {
+				lib.Join(": ", key)
+			}
+
+			// Each scope only has the calls made by it's own test
+			calls := lib.MOCK().Calls("Join")
+			if len(calls) != 100 {
+				t.Fatalf("Expected 100 calls, got %d", len(calls))
+			}
+			for _, call := range calls {
+				if parts := call.Args[1].([]string); parts[0] != key {
+					t.Fatalf("Expected [%s], got %v", key, parts)
+				}
+			}
+		})
+	}
+}
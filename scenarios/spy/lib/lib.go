@@ -0,0 +1,31 @@
+package lib
+
+import (
+	"errors"
+	"strings"
+)
+
+type Client struct {
+	name string
+}
+
+func (c *Client) Lookup(key string) (int, error) {
+	if key == "" {
+		return 0, errors.New("no key")
+	}
+	return len(key), nil
+}
+
+func Join(sep string, parts ...string) string {
+	return strings.Join(parts, sep)
+}
+
+func Log(msg string) {
+	panic("not mocked")
+}
+
+func Check(ok bool) {
+	if !ok {
+		panic("check failed")
+	}
+}
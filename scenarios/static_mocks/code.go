@@ -0,0 +1,13 @@
+package code
+
+import (
+	"github.com/qur/withmock/scenarios/static_mocks/lib"
+)
+
+func Run(d lib.Doer) (string, error) {
+	r, err := d.Do(1, lib.Option{Verbose: true})
+	if err != nil {
+		return "", err
+	}
+	return r.Value, nil
+}
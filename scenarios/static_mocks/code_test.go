@@ -0,0 +1,39 @@
+package code
+
+import (
+	"testing"
+
+	"code.google.com/p/gomock/gomock"
+
+	"github.com/qur/withmock/scenarios/static_mocks/lib"
+	mocklib "github.com/qur/withmock/scenarios/static_mocks/mock_lib"
+	"github.com/qur/withmock/scenarios/static_mocks/mock_lib/mocks"
+)
+
+func TestRun(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	lib_mocks.SetController(ctrl)
+
+	d := lib_mocks.NewDoer()
+	d.EXPECT().Do(1, lib.Option{Verbose: true}).Return(&lib.Result{"one"}, nil)
+
+	if s, err := Run(d); s != "one" || err != nil {
+		t.Errorf("Expected one, got %s (%v)", s, err)
+	}
+}
+
+func TestWibble(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mocklib.MOCK().SetController(ctrl)
+	mocklib.MOCK().MockAll(true)
+
+	mocklib.EXPECT().Wibble().Return(nil)
+
+	if err := mocklib.Wibble(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,20 @@
+package lib
+
+import "fmt"
+
+type Option struct {
+	Verbose bool
+}
+
+type Result struct {
+	Value string
+}
+
+type Doer interface {
+	Do(n int, opts ...Option) (*Result, error)
+	Each(f func(Result) bool) map[string][]Result
+}
+
+func Wibble() error {
+	return fmt.Errorf("Not Mocked!")
+}
@@ -0,0 +1,78 @@
+// Code generated by withmock gen. DO NOT EDIT.
+
+package lib
+
+import "code.google.com/p/gomock/gomock"
+
+import fmt "fmt"
+
+type Option struct {
+	Verbose bool
+}
+
+type Result struct {
+	Value string
+}
+
+type Doer interface {
+	Do(n int, opts ...Option) (*Result, error)
+	Each(f func(Result) bool) map[string][]Result
+}
+
+func _real_Wibble() error {
+	return fmt.Errorf("Not Mocked!")
+}
+func Wibble() error {
+	return _pkgMock.Wibble()
+}
+func (_m *_packageMock) Wibble() error {
+	if _spying("Wibble") {
+		_c := _spyStart(nil)
+		defer func() {
+			_spyEnd("Wibble", _c, recover())
+		}()
+		ret0 := _real_Wibble()
+		_c.Results = []interface{}{ret0}
+		return ret0
+	}
+	if !_isMocked("Wibble") {
+		return _real_Wibble()
+	}
+	if _tp := _currentTape(); _tp != nil {
+		if _tp.replay {
+			_c := _tp.replayCall("Wibble")
+			var ret0 error
+			_tp.decode(_c, 0, &ret0)
+			return ret0
+		}
+		_c := _tp.recordCall("Wibble")
+		defer func() {
+			_tp.recordPanic(_c, recover())
+		}()
+		ret0 := _real_Wibble()
+		_tp.encode(_c, ret0)
+		return ret0
+	}
+	_c := _ctrl()
+	if _c == nil {
+		panic("withmock: no gomock controller set, call SetController or withmock.T(t)")
+	}
+	ret := _c.Call(_m, "Wibble")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+func (_mr *_package_Rec) Wibble() *gomock.Call {
+	_c := _ctrl()
+	if _c == nil {
+		panic("withmock: no gomock controller set, call SetController or withmock.T(t)")
+	}
+	return _c.RecordCall(_mr.mock, "Wibble")
+}
+
+// Make sure gomock is used
+var _ = gomock.Any()
+
+// Make sure inits are called
+func init() {
+	callInits()
+}
@@ -0,0 +1,754 @@
+// Code generated by withmock gen. DO NOT EDIT.
+
+package lib
+
+import "code.google.com/p/gomock/gomock"
+
+import _bytes "bytes"
+
+import _json "encoding/json"
+
+import _errors "errors"
+
+import _fmt "fmt"
+
+import _os "os"
+
+import _filepath "path/filepath"
+
+import _reflect "reflect"
+
+import _runtime "runtime"
+
+import _sort "sort"
+
+import _strconv "strconv"
+
+import _strings "strings"
+
+import _sync "sync"
+
+import _time "time"
+
+import _unsafe "unsafe"
+
+type _meta struct{}
+type _packageMock struct{ int }
+
+type _spyCall struct {
+	Recv     interface{}
+	Args     []interface{}
+	Results  []interface{}
+	Panic    interface{}
+	Start    _time.Time
+	Duration _time.Duration
+}
+
+var (
+	_pkgMock = &_packageMock{}
+)
+
+type _testingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+	Cleanup(f func())
+}
+
+type _scope struct {
+	allMocked     bool
+	enabledMocks  map[string]bool
+	disabledMocks map[string]bool
+	spyAll        bool
+	spiedMocks    map[string]bool
+	calls         map[string][]*_spyCall
+	tape          *_tape
+	codec         _codec
+	cleanup       func(func())
+	goroutines    _sync.Map
+	ctrl          *gomock.Controller
+}
+
+func _newScope(parent *_scope) *_scope {
+	s := &_scope{
+		enabledMocks:  make(map[string]bool),
+		disabledMocks: make(map[string]bool),
+		spiedMocks:    make(map[string]bool),
+		calls:         make(map[string][]*_spyCall),
+		codec:         _jsonCodec{},
+	}
+	if parent != nil {
+		s.allMocked = parent.allMocked
+		s.spyAll = parent.spyAll
+		s.tape = parent.tape
+		s.codec = parent.codec
+		for name := range parent.enabledMocks {
+			s.enabledMocks[name] = true
+		}
+		for name := range parent.disabledMocks {
+			s.disabledMocks[name] = true
+		}
+		for name := range parent.spiedMocks {
+			s.spiedMocks[name] = true
+		}
+	}
+	if parent != nil {
+		s.ctrl = parent.ctrl
+	}
+	return s
+}
+
+func (s *_scope) describe() string {
+	names := func(set map[string]bool) []string {
+		names := []string{}
+		for name := range set {
+			names = append(names, name)
+		}
+		_sort.Strings(names)
+		return names
+	}
+	return _fmt.Sprintf("MockAll(%v) EnableMock%q DisableMock%q SpyAll(%v) Spy%q",
+		s.allMocked, names(s.enabledMocks), names(s.disabledMocks),
+		s.spyAll, names(s.spiedMocks))
+}
+
+var (
+	_base      = _newScope(nil)
+	_scopes    []*_scope
+	_scopeOf   _sync.Map
+	_stateLock _sync.RWMutex
+)
+
+func _goroutine(trace string) (id, parent int64, creator string) {
+	parse := func(s string) int64 {
+		if i := _strings.IndexAny(s, " \n"); i >= 0 {
+			s = s[:i]
+		}
+		id, _ := _strconv.ParseInt(s, 10, 64)
+		return id
+	}
+	id = parse(_strings.TrimPrefix(trace, "goroutine "))
+	const createdBy = "\ncreated by "
+	if i := _strings.LastIndex(trace, createdBy); i >= 0 {
+		creator = trace[i+len(createdBy):]
+		if i = _strings.Index(creator, "\n"); i >= 0 {
+			creator = creator[:i]
+		}
+		if i = _strings.Index(creator, " in goroutine "); i >= 0 {
+			parent = parse(creator[i+len(" in goroutine "):])
+			creator = creator[:i]
+		}
+	}
+	return
+}
+
+func _goid() int64 {
+	buf := make([]byte, 64)
+	n := _runtime.Stack(buf, false)
+	id, _, _ := _goroutine(string(buf[:n]))
+	return id
+}
+
+func _ancestors() (ids []int64, test int64) {
+	stack := func(all bool) string {
+		buf := make([]byte, 4096)
+		for {
+			if n := _runtime.Stack(buf, all); n < len(buf) {
+				return string(buf[:n])
+			}
+			buf = make([]byte, 2*len(buf))
+		}
+	}
+	const testRun = "testing.(*T).Run"
+	id, parent, creator := _goroutine(stack(false))
+	ids = append(ids, id)
+	if creator == testRun {
+		test = id
+	}
+	if parent == 0 {
+		return
+	}
+	parents := make(map[int64]int64)
+	creators := make(map[int64]string)
+	for _, trace := range _strings.Split(stack(true), "\n\n") {
+		id, parent, creator := _goroutine(trace)
+		parents[id], creators[id] = parent, creator
+	}
+	for parent != 0 {
+		creator, running := creators[parent]
+		if !running || parent >= ids[len(ids)-1] {
+			break
+		}
+		ids = append(ids, parent)
+		if creator == testRun {
+			test = parent
+		}
+		parent = parents[parent]
+	}
+	return
+}
+
+func _current() *_scope {
+	if len(_scopes) == 0 {
+		return _base
+	}
+	id := _goid()
+	if s, ok := _scopeOf.Load(id); ok {
+		return s.(*_scope)
+	}
+	ids, _ := _ancestors()
+	for _, parent := range ids[1:] {
+		if s, ok := _scopeOf.Load(parent); ok {
+			s.(*_scope).goroutines.Store(id, true)
+			_scopeOf.Store(id, s)
+			return s.(*_scope)
+		}
+	}
+	if len(_scopes) > 1 {
+		panic(_fmt.Sprintf("mock: goroutine %d can't be traced to a test with a scope, "+
+			"and there are %d scopes to choose from", id, len(_scopes)))
+	}
+	return _scopes[0]
+}
+
+func _read(f func(s *_scope)) {
+	_stateLock.RLock()
+	defer _stateLock.RUnlock()
+	f(_current())
+}
+
+func _write(f func(s *_scope)) {
+	_stateLock.Lock()
+	defer _stateLock.Unlock()
+	f(_current())
+}
+
+func _isMocked(name string) (mocked bool) {
+	_read(func(s *_scope) {
+		mocked = (s.allMocked || s.enabledMocks[name]) && !s.disabledMocks[name]
+	})
+	return
+}
+
+func _cleanup(name string) (cleanup func(func())) {
+	_read(func(s *_scope) {
+		cleanup = s.cleanup
+	})
+	if cleanup == nil {
+		panic(name + ": no test to restore the old value for, use Scope or SetController first")
+	}
+	return
+}
+
+func callInits(inits ...func()) {
+	_stateLock.Lock()
+	base := _base
+	_base = _newScope(nil)
+	_stateLock.Unlock()
+	for _, f := range inits {
+		f()
+	}
+	_stateLock.Lock()
+	_base = base
+	_stateLock.Unlock()
+}
+
+func (_ *_meta) MockAll(enabled bool) {
+	_write(func(s *_scope) {
+		s.allMocked = enabled
+		s.enabledMocks = make(map[string]bool)
+		s.disabledMocks = make(map[string]bool)
+		s.spyAll = false
+		s.spiedMocks = make(map[string]bool)
+	})
+}
+func (_ *_meta) EnableMock(names ...string) {
+	_write(func(s *_scope) {
+		for _, name := range names {
+			s.enabledMocks[name] = true
+			delete(s.disabledMocks, name)
+			delete(s.spiedMocks, name)
+		}
+	})
+}
+
+func (_ *_meta) DisableMock(names ...string) {
+	_write(func(s *_scope) {
+		for _, name := range names {
+			s.disabledMocks[name] = true
+			delete(s.enabledMocks, name)
+			delete(s.spiedMocks, name)
+		}
+	})
+}
+
+func (_ *_meta) Scope(t _testingT) {
+	t.Helper()
+	id := _goid()
+	_stateLock.Lock()
+	s := _newScope(_current())
+	s.cleanup = t.Cleanup
+	prev, _ := _scopeOf.Load(id)
+	_scopes = append(_scopes, s)
+	_scopeOf.Store(id, s)
+	_stateLock.Unlock()
+	t.Cleanup(func() {
+		_stateLock.Lock()
+		defer _stateLock.Unlock()
+		for i := range _scopes {
+			if _scopes[i] == s {
+				_scopes = append(_scopes[:i], _scopes[i+1:]...)
+				break
+			}
+		}
+		s.goroutines.Range(func(id, _ interface{}) bool {
+			_scopeOf.Delete(id)
+			return true
+		})
+		if prev != nil {
+			_scopeOf.Store(id, prev)
+		} else {
+			_scopeOf.Delete(id)
+		}
+	})
+}
+
+func (_ *_meta) CheckLeaks(t _testingT) {
+	t.Helper()
+	var s *_scope
+	var before string
+	_read(func(current *_scope) {
+		s, before = current, current.describe()
+	})
+	t.Cleanup(func() {
+		_stateLock.RLock()
+		after := s.describe()
+		_stateLock.RUnlock()
+		if after != before {
+			t.Errorf("mock state left modified by test:\n\tbefore: %s\n\tafter:  %s", before, after)
+		}
+	})
+}
+
+func MOCK() *_meta {
+	return nil
+}
+func _ctrl() (ctrl *gomock.Controller) {
+	_read(func(s *_scope) {
+		ctrl = s.ctrl
+	})
+	return
+}
+func (_ *_meta) SetController(controller *gomock.Controller) {
+	_write(func(s *_scope) {
+		s.ctrl = controller
+	})
+}
+func _spying(name string) (spying bool) {
+	_read(func(s *_scope) {
+		spying = s.spiedMocks[name] || (s.spyAll && !s.enabledMocks[name] && !s.disabledMocks[name])
+	})
+	return
+}
+
+func _spyStart(recv interface{}, args ...interface{}) *_spyCall {
+	return &_spyCall{Recv: recv, Args: args, Start: _time.Now()}
+}
+
+func _spyEnd(name string, c *_spyCall, p interface{}) {
+	c.Duration = _time.Since(c.Start)
+	c.Panic = p
+	_write(func(s *_scope) {
+		s.calls[name] = append(s.calls[name], c)
+	})
+	if p != nil {
+		panic(p)
+	}
+}
+
+func (_ *_meta) SpyAll(enabled bool) {
+	_write(func(s *_scope) {
+		s.spyAll = enabled
+		s.spiedMocks = make(map[string]bool)
+	})
+}
+
+func (_ *_meta) Spy(names ...string) {
+	_write(func(s *_scope) {
+		for _, name := range names {
+			s.spiedMocks[name] = true
+			delete(s.enabledMocks, name)
+			delete(s.disabledMocks, name)
+		}
+	})
+}
+
+func (_ *_meta) Calls(name string) (calls []*_spyCall) {
+	_read(func(s *_scope) {
+		calls = append(calls, s.calls[name]...)
+	})
+	return
+}
+
+func (_ *_meta) ClearCalls() {
+	_write(func(s *_scope) {
+		s.calls = make(map[string][]*_spyCall)
+	})
+}
+
+type _codec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte, v interface{}) error
+}
+
+type _jsonCodec struct{}
+
+func (_jsonCodec) Encode(v interface{}) ([]byte, error) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	return _json.Marshal(v)
+}
+
+func (_jsonCodec) Decode(data []byte, v interface{}) error {
+	if err, ok := v.(*error); ok {
+		var msg *string
+		if e := _json.Unmarshal(data, &msg); e != nil {
+			return e
+		}
+		if msg != nil {
+			*err = _errors.New(*msg)
+		}
+		return nil
+	}
+	return _json.Unmarshal(data, v)
+}
+
+type _tapeCall struct {
+	Name    string             `json:"name"`
+	Args    []_json.RawMessage `json:"args"`
+	Results []_json.RawMessage `json:"results"`
+	Panic   *string            `json:"panic,omitempty"`
+}
+
+func (c *_tapeCall) String() string {
+	buf := &_bytes.Buffer{}
+	buf.WriteString(c.Name + "(")
+	for i, arg := range c.Args {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		if _json.Compact(buf, arg) != nil {
+			buf.Write(arg)
+		}
+	}
+	buf.WriteString(")")
+	return buf.String()
+}
+
+type _tape struct {
+	t      _testingT
+	file   string
+	codec  _codec
+	replay bool
+	calls  []*_tapeCall
+	next   int
+	lock   _sync.Mutex
+}
+
+func _currentTape() (tp *_tape) {
+	_read(func(s *_scope) {
+		tp = s.tape
+	})
+	return
+}
+
+func _setTape(tp *_tape) func() {
+	var scope *_scope
+	_write(func(s *_scope) {
+		scope = s
+		s.tape = tp
+	})
+	return func() {
+		_stateLock.Lock()
+		defer _stateLock.Unlock()
+		if scope.tape == tp {
+			scope.tape = nil
+		}
+	}
+}
+
+func _currentCodec() (codec _codec) {
+	_read(func(s *_scope) {
+		codec = s.codec
+	})
+	return
+}
+
+func (tp *_tape) fail(format string, args ...interface{}) {
+	msg := _fmt.Sprintf(format, args...)
+	tp.t.Errorf("%s", msg)
+	panic(msg)
+}
+
+func (tp *_tape) encodeAll(values []interface{}) []_json.RawMessage {
+	encoded := make([]_json.RawMessage, len(values))
+	for i, v := range values {
+		data, err := tp.codec.Encode(v)
+		if err != nil {
+			tp.fail("%s: can't encode %T: %s", tp.file, v, err)
+		}
+		encoded[i] = data
+	}
+	return encoded
+}
+
+func (tp *_tape) recordCall(name string, args ...interface{}) *_tapeCall {
+	c := &_tapeCall{Name: name, Args: tp.encodeAll(args)}
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	tp.calls = append(tp.calls, c)
+	return c
+}
+
+func (tp *_tape) encode(c *_tapeCall, results ...interface{}) {
+	encoded := tp.encodeAll(results)
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	c.Results = encoded
+}
+
+func (tp *_tape) recordPanic(c *_tapeCall, p interface{}) {
+	if p == nil {
+		return
+	}
+	msg := _fmt.Sprint(p)
+	tp.lock.Lock()
+	c.Results = nil
+	c.Panic = &msg
+	tp.lock.Unlock()
+	panic(p)
+}
+
+func (tp *_tape) replayCall(name string, args ...interface{}) *_tapeCall {
+	c := &_tapeCall{Name: name, Args: tp.encodeAll(args)}
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	if tp.next >= len(tp.calls) {
+		tp.fail("replaying %s: unexpected call %s, after all %d recorded calls", tp.file, c, len(tp.calls))
+	}
+	want := tp.calls[tp.next]
+	tp.next++
+	if want.String() != c.String() {
+		tp.fail("replaying %s: call %d doesn't match the recording:\n\texpected: %s\n\tgot:      %s", tp.file, tp.next, want, c)
+	}
+	if want.Panic != nil {
+		panic(*want.Panic)
+	}
+	return want
+}
+
+func (tp *_tape) decode(c *_tapeCall, i int, v interface{}) {
+	if i >= len(c.Results) {
+		tp.fail("replaying %s: %s has no result %d", tp.file, c, i)
+	}
+	if err := tp.codec.Decode(c.Results[i], v); err != nil {
+		tp.fail("replaying %s: can't decode result %d of %s: %s", tp.file, i, c, err)
+	}
+}
+
+func (_ *_meta) SetCodec(codec _codec) {
+	if codec == nil {
+		codec = _jsonCodec{}
+	}
+	_write(func(s *_scope) {
+		s.codec = codec
+	})
+}
+
+func (_ *_meta) Record(t _testingT, file string) {
+	t.Helper()
+	tp := &_tape{t: t, file: file, codec: _currentCodec()}
+	stop := _setTape(tp)
+	t.Cleanup(func() {
+		stop()
+		tp.lock.Lock()
+		data, err := _json.MarshalIndent(tp.calls, "", "\t")
+		tp.lock.Unlock()
+		if err == nil {
+			err = _os.MkdirAll(_filepath.Dir(file), 0777)
+		}
+		if err == nil {
+			err = _os.WriteFile(file, append(data, '\n'), 0666)
+		}
+		if err != nil {
+			t.Errorf("Failed to write recording %s: %s", file, err)
+		}
+	})
+}
+
+func (_ *_meta) Replay(t _testingT, file string) {
+	t.Helper()
+	tp := &_tape{t: t, file: file, codec: _currentCodec(), replay: true}
+	data, err := _os.ReadFile(file)
+	if err == nil {
+		err = _json.Unmarshal(data, &tp.calls)
+	}
+	if err != nil {
+		t.Fatalf("Failed to read recording %s: %s", file, err)
+	}
+	stop := _setTape(tp)
+	t.Cleanup(func() {
+		stop()
+		tp.lock.Lock()
+		defer tp.lock.Unlock()
+		if tp.next < len(tp.calls) {
+			t.Errorf("replaying %s: %d recorded calls were not made, starting with %s", file, len(tp.calls)-tp.next, tp.calls[tp.next])
+		}
+	})
+}
+
+var (
+	_vars     []interface{}
+	_snapshot []_reflect.Value
+)
+
+func _addVars(vars ...interface{}) bool {
+	_vars = append(_vars, vars...)
+	return true
+}
+
+var _locks = map[_reflect.Type]bool{
+	_reflect.TypeOf((*_sync.Mutex)(nil)).Elem():     true,
+	_reflect.TypeOf((*_sync.RWMutex)(nil)).Elem():   true,
+	_reflect.TypeOf((*_sync.Once)(nil)).Elem():      true,
+	_reflect.TypeOf((*_sync.WaitGroup)(nil)).Elem(): true,
+}
+
+type _cloneKey struct {
+	p uintptr
+	t _reflect.Type
+	n int
+}
+
+func _clone(v _reflect.Value, seen map[_cloneKey]_reflect.Value) _reflect.Value {
+	c := _reflect.New(v.Type()).Elem()
+	_copy(c, v, seen)
+	return c
+}
+
+func _rw(v _reflect.Value) _reflect.Value {
+	return _reflect.NewAt(v.Type(), _unsafe.Pointer(v.UnsafeAddr())).Elem()
+}
+
+func _copy(c, v _reflect.Value, seen map[_cloneKey]_reflect.Value) {
+	if _locks[v.Type()] {
+		return
+	}
+	if !v.CanAddr() {
+		a := _reflect.New(v.Type()).Elem()
+		a.Set(v)
+		v = a
+	}
+	switch v.Kind() {
+	case _reflect.Ptr:
+		pkg := v.Type().Elem().PkgPath()
+		if v.IsNil() || (pkg != "" && pkg != _reflect.TypeOf(_packageMock{}).PkgPath()) {
+			break
+		}
+		key := _cloneKey{v.Pointer(), v.Type(), 0}
+		if p, found := seen[key]; found {
+			c.Set(p)
+			return
+		}
+		p := _reflect.New(v.Type().Elem())
+		seen[key] = p
+		c.Set(p)
+		_copy(p.Elem(), _rw(v.Elem()), seen)
+		return
+	case _reflect.Map:
+		if v.IsNil() {
+			return
+		}
+		key := _cloneKey{v.Pointer(), v.Type(), 0}
+		if m, found := seen[key]; found {
+			c.Set(m)
+			return
+		}
+		m := _reflect.MakeMapWithSize(v.Type(), v.Len())
+		seen[key] = m
+		c.Set(m)
+		iter := v.MapRange()
+		for iter.Next() {
+			m.SetMapIndex(iter.Key(), _clone(iter.Value(), seen))
+		}
+		return
+	case _reflect.Slice:
+		if v.IsNil() {
+			return
+		}
+		key := _cloneKey{v.Pointer(), v.Type(), v.Len()}
+		if s, found := seen[key]; found {
+			c.Set(s)
+			return
+		}
+		s := _reflect.MakeSlice(v.Type(), v.Len(), v.Cap())
+		seen[key] = s
+		c.Set(s)
+		for i := 0; i < v.Len(); i++ {
+			_copy(s.Index(i), _rw(v.Index(i)), seen)
+		}
+		return
+	case _reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			_copy(c.Index(i), _rw(v.Index(i)), seen)
+		}
+		return
+	case _reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			_copy(_rw(c.Field(i)), _rw(v.Field(i)), seen)
+		}
+		return
+	case _reflect.Interface:
+		if !v.IsNil() {
+			c.Set(_clone(v.Elem(), seen))
+		}
+		return
+	}
+	c.Set(v)
+}
+
+func (_ *_meta) Snapshot() {
+	snapshot := make([]_reflect.Value, len(_vars))
+	seen := make(map[_cloneKey]_reflect.Value)
+	for i, v := range _vars {
+		snapshot[i] = _clone(_reflect.ValueOf(v).Elem(), seen)
+	}
+	_stateLock.Lock()
+	defer _stateLock.Unlock()
+	_snapshot = snapshot
+}
+
+func (_ *_meta) Restore() {
+	_stateLock.RLock()
+	snapshot := _snapshot
+	_stateLock.RUnlock()
+	if snapshot == nil {
+		panic("Restore called without a Snapshot")
+	}
+	seen := make(map[_cloneKey]_reflect.Value)
+	for i, v := range _vars {
+		_reflect.ValueOf(v).Elem().Set(_clone(snapshot[i], seen))
+	}
+}
+
+type _package_Rec struct {
+	mock *_packageMock
+}
+
+func EXPECT() *_package_Rec {
+	return &_package_Rec{_pkgMock}
+}
+
+// Make sure gomock is used
+var _ = gomock.Any()
@@ -0,0 +1,81 @@
+// Code generated by withmock gen. DO NOT EDIT.
+
+package lib_mocks
+
+import (
+	gomock "code.google.com/p/gomock/gomock"
+	lib "github.com/qur/withmock/scenarios/static_mocks/lib"
+	_sync "sync"
+)
+
+var (
+	_controller *gomock.Controller
+	_ctrlLock   _sync.Mutex
+)
+
+func _ctrl() *gomock.Controller {
+	_ctrlLock.Lock()
+	defer _ctrlLock.Unlock()
+	return _controller
+}
+
+func SetController(controller *gomock.Controller) {
+	_ctrlLock.Lock()
+	defer _ctrlLock.Unlock()
+	_controller = controller
+}
+
+type MockDoer struct{ int }
+
+var _ lib.Doer = &MockDoer{}
+
+func NewDoer() *MockDoer {
+	return &MockDoer{}
+}
+
+func (_m *MockDoer) Do(p0 int, p1 ...lib.Option) (*lib.Result, error) {
+	args := []interface{}{p0}
+	for _, v := range p1 {
+		args = append(args, v)
+	}
+	_c := _ctrl()
+	if _c == nil {
+		panic("withmock: no gomock controller set, call SetController or withmock.T(t)")
+	}
+	ret := _c.Call(_m, "Do", args...)
+	ret0, _ := ret[0].(*lib.Result)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+func (_mr *_mock_Doer_rec) Do(p0 interface{}, p1 ...interface{}) *gomock.Call {
+	args := append([]interface{}{p0}, p1...)
+	_c := _ctrl()
+	if _c == nil {
+		panic("withmock: no gomock controller set, call SetController or withmock.T(t)")
+	}
+	return _c.RecordCall(_mr.mock, "Do", args...)
+}
+func (_m *MockDoer) Each(p0 func(lib.Result) bool) map[string][]lib.Result {
+	_c := _ctrl()
+	if _c == nil {
+		panic("withmock: no gomock controller set, call SetController or withmock.T(t)")
+	}
+	ret := _c.Call(_m, "Each", p0)
+	ret0, _ := ret[0].(map[string][]lib.Result)
+	return ret0
+}
+func (_mr *_mock_Doer_rec) Each(p0 interface{}) *gomock.Call {
+	_c := _ctrl()
+	if _c == nil {
+		panic("withmock: no gomock controller set, call SetController or withmock.T(t)")
+	}
+	return _c.RecordCall(_mr.mock, "Each", p0)
+}
+
+type _mock_Doer_rec struct {
+	mock *MockDoer
+}
+
+func (_m *MockDoer) EXPECT() *_mock_Doer_rec {
+	return &_mock_Doer_rec{_m}
+}
@@ -0,0 +1,31 @@
+package code
+
+import (
+	"github.com/qur/withmock/scenarios/testify/lib"
+	"github.com/qur/withmock/scenarios/testify/lib2"
+)
+
+func Describe(url string) (string, error) {
+	body, err := lib.Fetch(url)
+	if err != nil {
+		return "", err
+	}
+	lib.Log("fetched " + url)
+	return lib.Join(": ", url, body), nil
+}
+
+func Count(c *lib.Client, key string) int {
+	n, err := c.Lookup(key)
+	if err != nil {
+		return -1
+	}
+	return lib2.Double(n)
+}
+
+func Copy(s lib.Store, from, to string) error {
+	value, err := s.Get(from)
+	if err != nil {
+		return err
+	}
+	return s.Put(to, value)
+}
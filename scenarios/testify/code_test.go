@@ -0,0 +1,84 @@
+package code
+
+import (
+	"errors"
+	"testing"
+
+	"code.google.com/p/gomock/gomock"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/qur/withmock/scenarios/testify/lib"  // mock
+	"github.com/qur/withmock/scenarios/testify/lib2" // mock
+)
+
+func TestDescribe(t *testing.T) {
+	lib.MOCK().Reset()
+	lib.MOCK().MockAll(true)
+	lib.MOCK().Test(t)
+
+	lib.MOCK().On("Fetch", "http://example.com").Return("hello", nil)
+	lib.MOCK().On("Log", mock.Anything)
+	lib.MOCK().On("Join", ": ", "http://example.com", "hello").Return("joined")
+
+	s, err := Describe("http://example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s != "joined" {
+		t.Errorf("Expected joined, got %s", s)
+	}
+
+	lib.MOCK().AssertExpectations(t)
+}
+
+func TestDescribeError(t *testing.T) {
+	lib.MOCK().Reset()
+	lib.MOCK().MockAll(true)
+	lib.MOCK().Test(t)
+
+	lib.MOCK().On("Fetch", mock.Anything).Return("", errors.New("failed"))
+
+	if _, err := Describe("http://example.com"); err == nil {
+		t.Errorf("Expected an error")
+	}
+
+	lib.MOCK().AssertExpectations(t)
+	lib.MOCK().AssertNotCalled(t, "Log", mock.Anything)
+}
+
+func TestCount(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	lib.MOCK().Reset()
+	lib.MOCK().MockAll(true)
+	lib.MOCK().Test(t)
+
+	// lib2 is still mocked with gomock
+	lib2.MOCK().SetController(ctrl)
+	lib2.MOCK().MockAll(true)
+
+	c := &lib.Client{}
+	lib.MOCK().On("Client.Lookup", c, "key").Return(21, nil)
+	lib2.EXPECT().Double(21).Return(42)
+
+	if n := Count(c, "key"); n != 42 {
+		t.Errorf("Expected 42, got %d", n)
+	}
+
+	lib.MOCK().AssertExpectations(t)
+}
+
+func TestCopy(t *testing.T) {
+	s := lib.MOCK().NewStore()
+	s.Test(t)
+
+	s.On("Get", "a").Return("value", nil)
+	s.On("Put", "b", "value").Return(nil)
+
+	if err := Copy(s, "a", "b"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	s.AssertExpectations(t)
+}
@@ -0,0 +1,5 @@
+package lib2
+
+func Double(i int) int {
+	return i * 2
+}
@@ -0,0 +1,22 @@
+package code
+
+import (
+	"github.com/qur/withmock/scenarios/unexported/lib"
+	"github.com/qur/withmock/scenarios/unexported/lib2"
+)
+
+func Hello(addr string) (string, error) {
+	c, err := lib.Connect(addr)
+	if err != nil {
+		return "", err
+	}
+	return c.Send("hello", "world"), nil
+}
+
+func Save(key, value string) string {
+	s := &lib2.Store{}
+	if !s.Put(key, value) {
+		return "failed"
+	}
+	return lib2.Get(key)
+}
@@ -0,0 +1,68 @@
+package code
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+
+	"github.com/qur/withmock/scenarios/unexported/lib"  // mock
+	"github.com/qur/withmock/scenarios/unexported/lib2" // mock
+)
+
+func TestHello(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	lib.MOCK().SetController(ctrl)
+
+	// Run the real exported functions, mocking what they call
+	lib.MOCK().MockAll(false)
+	lib.MOCK().EnableMock("dial")
+
+	lib.MOCK().EXPECT_dial("example.com:80").Return(nil)
+
+	s, err := Hello("example.com:80")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s != "example.com:80: hello world" {
+		t.Errorf("Expected 'example.com:80: hello world', got '%s'", s)
+	}
+}
+
+func TestSend(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	lib.MOCK().SetController(ctrl)
+	lib.MOCK().MockAll(false)
+	lib.MOCK().EnableMock("Conn.format")
+
+	c := &lib.Conn{}
+	lib.MOCK().EXPECT_Conn_format(c, "a", gomock.Any()).Return("mocked")
+
+	if s := c.Send("a", "b"); s != "mocked" {
+		t.Errorf("Expected 'mocked', got '%s'", s)
+	}
+}
+
+func TestHelloReal(t *testing.T) {
+	lib.MOCK().MockAll(false)
+
+	if _, err := Hello("example.com:80"); err == nil || err.Error() != "no network" {
+		t.Errorf("Expected 'no network' error, got %v", err)
+	}
+}
+
+func TestSave(t *testing.T) {
+	lib2.MOCK().FAKE_lookup(func(key string) string {
+		return "fake " + key
+	})
+	lib2.MOCK().FAKE_Store_write(&lib2.Store{}, func(key, value string) bool {
+		return true
+	})
+
+	if s := Save("key", "value"); s != "fake key" {
+		t.Errorf("Expected 'fake key', got '%s'", s)
+	}
+}
@@ -0,0 +1,29 @@
+package lib
+
+import (
+	"errors"
+	"strings"
+)
+
+type Conn struct {
+	addr string
+}
+
+func Connect(addr string) (*Conn, error) {
+	if err := dial(addr); err != nil {
+		return nil, err
+	}
+	return &Conn{addr: addr}, nil
+}
+
+func (c *Conn) Send(parts ...string) string {
+	return c.format(parts...)
+}
+
+func dial(addr string) error {
+	return errors.New("no network")
+}
+
+func (c *Conn) format(parts ...string) string {
+	return c.addr + ": " + strings.Join(parts, " ")
+}
@@ -0,0 +1,19 @@
+package lib2
+
+type Store struct{}
+
+func Get(key string) string {
+	return lookup(key)
+}
+
+func (s *Store) Put(key, value string) bool {
+	return s.write(key, value)
+}
+
+func lookup(key string) string {
+	return "real " + key
+}
+
+func (s *Store) write(key, value string) bool {
+	return false
+}
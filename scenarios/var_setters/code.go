@@ -0,0 +1,12 @@
+package code
+
+import (
+	"fmt"
+
+	"github.com/qur/withmock/scenarios/var_setters/lib"
+)
+
+func Describe() string {
+	return fmt.Sprintf("%s %v %v %s %d/%d", lib.Greet(lib.Name), lib.Timeout,
+		lib.ErrFailed, lib.Secret(), lib.Count, lib.Limit)
+}
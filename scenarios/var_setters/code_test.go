@@ -0,0 +1,99 @@
+package code
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/qur/withmock/scenarios/var_setters/lib" // mock
+)
+
+const real = "hello real 1s failed hidden 1/0"
+
+func TestSetters(t *testing.T) {
+	t.Run("set", func(t *testing.T) {
+		lib.MOCK().Scope(t)
+		lib.MOCK().DisableMock("Secret")
+
+		lib.MOCK().SetName("mock")
+		lib.MOCK().SetTimeout(time.Minute)
+		lib.MOCK().SetErrFailed(errors.New("broken"))
+		lib.MOCK().SetGreet(func(name string) string {
+			return "hi " + name
+		})
+		lib.MOCK().SetCount(2)
+		lib.MOCK().SetLimit(3)
+
+		// Setting twice should still restore the original value
+		lib.MOCK().SetName("other")
+
+		expected := "hi other 1m0s broken hidden 2/3"
+		if s := Describe(); s != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, s)
+		}
+	})
+
+	t.Run("restored", func(t *testing.T) {
+		lib.MOCK().Scope(t)
+		lib.MOCK().DisableMock("Secret")
+
+		if s := Describe(); s != real {
+			t.Errorf("Expected '%s', got '%s'", real, s)
+		}
+	})
+}
+
+func TestClient(t *testing.T) {
+	client := &http.Client{Timeout: time.Hour}
+
+	t.Run("set", func(t *testing.T) {
+		lib.MOCK().Scope(t)
+		lib.MOCK().SetClient(client)
+
+		if lib.Client != client {
+			t.Errorf("Client not set")
+		}
+	})
+
+	if lib.Client == client {
+		t.Errorf("Client not restored")
+	}
+}
+
+func TestUntyped(t *testing.T) {
+	started := time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("set", func(t *testing.T) {
+		lib.MOCK().Scope(t)
+		lib.MOCK().SetLookup(func(url string) (*http.Response, error) {
+			return nil, errors.New("offline")
+		})
+		lib.MOCK().SetStarted(started)
+		lib.MOCK().SetFallback("mock")
+		lib.MOCK().SetHeader(http.Header{"X-Name": {"mock"}})
+
+		if _, err := lib.Lookup("http://example.com"); err == nil || err.Error() != "offline" {
+			t.Errorf("Lookup not set, got error %v", err)
+		}
+		if !lib.Started.Equal(started) {
+			t.Errorf("Started not set")
+		}
+		if lib.Fallback != "mock" {
+			t.Errorf("Fallback not set")
+		}
+		if h := lib.Header.Get("X-Name"); h != "mock" {
+			t.Errorf("Expected header 'mock', got '%s'", h)
+		}
+	})
+
+	if lib.Started.Equal(started) {
+		t.Errorf("Started not restored")
+	}
+	if lib.Fallback != "real" {
+		t.Errorf("Fallback not restored")
+	}
+	if h := lib.Header.Get("X-Name"); h != "real" {
+		t.Errorf("Header not restored, got '%s'", h)
+	}
+}
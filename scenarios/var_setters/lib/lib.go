@@ -0,0 +1,40 @@
+package lib
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+var Name = "real"
+
+var (
+	Timeout   time.Duration = time.Second
+	Client                  = &http.Client{}
+	ErrFailed               = errors.New("failed")
+	Greet                   = func(name string) string {
+		return "hello " + name
+	}
+)
+
+var Count = 1
+
+var Limit int
+
+var Lookup = http.DefaultClient.Get
+
+var (
+	Started  = time.Now()
+	Fallback = Name
+	Header   = http.Header{"X-Name": {"real"}}
+)
+
+// Values of unexported types of other packages can't be set, so NoBody has no
+// setter
+var NoBody = http.NoBody
+
+var secret = "hidden"
+
+func Secret() string {
+	return secret
+}
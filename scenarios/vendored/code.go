@@ -0,0 +1,9 @@
+package code
+
+import (
+	"example.com/lib"
+)
+
+func TryMe() error {
+	return lib.Wibble()
+}
@@ -0,0 +1,14 @@
+package app
+
+import (
+	"example.com/dep"
+	"example.com/lib"
+)
+
+func Describe(url string) (string, error) {
+	s, err := lib.Fetch(url)
+	if err != nil {
+		return "", err
+	}
+	return dep.Shout(url + ": " + s), nil
+}
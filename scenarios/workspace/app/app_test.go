@@ -0,0 +1,21 @@
+package app
+
+import (
+	"testing"
+
+	"example.com/lib" // mock
+)
+
+func TestDescribe(t *testing.T) {
+	lib.FAKE().Fetch(func(url string) (string, error) {
+		return "hello", nil
+	})
+
+	s, err := Describe("http://example.com")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s != "HTTP://EXAMPLE.COM: HELLO!" {
+		t.Errorf("Expected 'HTTP://EXAMPLE.COM: HELLO!', got '%s'", s)
+	}
+}
@@ -0,0 +1,7 @@
+package dep
+
+import "strings"
+
+func Shout(s string) string {
+	return strings.ToUpper(s) + "!"
+}
@@ -0,0 +1,7 @@
+package lib
+
+import "errors"
+
+func Fetch(url string) (string, error) {
+	return "", errors.New("no network")
+}